@@ -0,0 +1,199 @@
+package proxytv
+
+import (
+	"compress/gzip"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var errCacheMiss = errors.New("cache miss")
+
+var cacheNameRegex = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+// diskCache stores the last successfully parsed content of each source, so
+// that proxytv can serve data on startup while the sources are unavailable.
+// Content is stored gzip compressed alongside a JSON metadata file.
+type diskCache struct {
+	dir string
+}
+
+type cacheMeta struct {
+	URLHash      string    `json:"urlHash"`
+	FetchedAt    time.Time `json:"fetchedAt"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"lastModified,omitempty"`
+}
+
+func newDiskCache(dir string) (*diskCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("unable to create cache directory: %w", err)
+	}
+	return &diskCache{dir: dir}, nil
+}
+
+func (c *diskCache) path(kind string, name string) string {
+	return filepath.Join(c.dir, fmt.Sprintf("%s-%s", kind, cacheNameRegex.ReplaceAllString(name, "_")))
+}
+
+func urlHash(uri string) string {
+	sum := sha1.Sum([]byte(uri))
+	return hex.EncodeToString(sum[:])
+}
+
+// open returns a reader for the cached content of a source, or errCacheMiss if
+// nothing was cached for the source's current URL.
+func (c *diskCache) open(kind string, name string, uri string) (io.ReadCloser, *cacheMeta, error) {
+	base := c.path(kind, name)
+
+	data, err := os.ReadFile(base + ".json")
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil, errCacheMiss
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	meta := &cacheMeta{}
+	if err := json.Unmarshal(data, meta); err != nil {
+		return nil, nil, fmt.Errorf("invalid cache metadata: %w", err)
+	}
+	if meta.URLHash != urlHash(uri) {
+		return nil, nil, errCacheMiss
+	}
+
+	f, err := os.Open(base + ".gz")
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil, errCacheMiss
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	reader, err := decompressReader(f, f.Name(), "")
+	if err != nil {
+		return nil, nil, err
+	}
+	return reader, meta, nil
+}
+
+// create returns a writer for new content of a source. Nothing replaces the
+// existing cache entry until commit is called.
+func (c *diskCache) create(kind string, name string, uri string) (*cacheWriter, error) {
+	f, err := os.CreateTemp(c.dir, ".tmp-*")
+	if err != nil {
+		return nil, err
+	}
+	return &cacheWriter{
+		base: c.path(kind, name),
+		uri:  uri,
+		file: f,
+		gz:   gzip.NewWriter(f),
+	}, nil
+}
+
+type cacheWriter struct {
+	base string
+	uri  string
+	file *os.File
+	gz   *gzip.Writer
+}
+
+func (w *cacheWriter) Write(p []byte) (int, error) {
+	return w.gz.Write(p)
+}
+
+func (w *cacheWriter) commit(etag string, lastModified string) error {
+	if err := w.gz.Close(); err != nil {
+		w.abort()
+		return err
+	}
+	if err := w.file.Close(); err != nil {
+		os.Remove(w.file.Name())
+		return err
+	}
+	if err := os.Rename(w.file.Name(), w.base+".gz"); err != nil {
+		os.Remove(w.file.Name())
+		return err
+	}
+
+	data, err := json.Marshal(&cacheMeta{
+		URLHash:      urlHash(w.uri),
+		FetchedAt:    time.Now(),
+		ETag:         etag,
+		LastModified: lastModified,
+	})
+	if err != nil {
+		return err
+	}
+
+	tmp := w.base + ".json.tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, w.base+".json")
+}
+
+func (w *cacheWriter) abort() {
+	w.file.Close()
+	os.Remove(w.file.Name())
+}
+
+// cacheTee copies everything read from a source into a new cache entry.
+type cacheTee struct {
+	io.Reader
+	name   string
+	writer *cacheWriter
+}
+
+func (p *Provider) teeCache(reader io.Reader, kind string, name string, uri string) *cacheTee {
+	tee := &cacheTee{Reader: reader, name: name}
+	if p.cache == nil {
+		return tee
+	}
+
+	w, err := p.cache.create(kind, name, uri)
+	if err != nil {
+		log.WithError(err).WithField("source", name).Warn("unable to create cache entry")
+		return tee
+	}
+
+	tee.Reader = io.TeeReader(reader, w)
+	tee.writer = w
+	return tee
+}
+
+// complete reads the rest of the content, which parsers may leave unread, and
+// records a successful fetch: the validators of the response are promoted and
+// the cache entry committed. Neither happens unless the whole body was read,
+// so that a truncated download isn't reused as unchanged by later refreshes.
+func (t *cacheTee) complete(state *sourceState) error {
+	if _, err := io.Copy(io.Discard, t.Reader); err != nil {
+		t.abort()
+		return err
+	}
+	state.fetched()
+	if t.writer == nil {
+		return nil
+	}
+
+	etag, lastModified := state.validators()
+	if err := t.writer.commit(etag, lastModified); err != nil {
+		log.WithError(err).WithField("source", t.name).Warn("unable to write cache entry")
+	}
+	return nil
+}
+
+// abort discards the cache entry of content that failed to load.
+func (t *cacheTee) abort() {
+	if t.writer != nil {
+		t.writer.abort()
+	}
+}
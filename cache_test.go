@@ -0,0 +1,109 @@
+package proxytv
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProviderCache(t *testing.T) {
+	m3u := newConditionalServer(testM3uContent, `"m3u-v1"`)
+	defer m3u.Close()
+	epg := newConditionalServer(testEpgContent, `"epg-v1"`)
+	defer epg.Close()
+
+	newConfig := func(cacheDir string) *Config {
+		config := &Config{
+			IPTVUrl:  m3u.URL + "/iptv.m3u",
+			EPGUrl:   epg.URL + "/epg.xml",
+			CacheDir: cacheDir,
+			Filters:  []*Filter{{Type: "id", Value: ".*"}},
+		}
+		require.NoError(t, config.compileFilterRegexps())
+		return config
+	}
+
+	cacheDir := t.TempDir()
+
+	t.Run("Empty cache", func(t *testing.T) {
+		provider, err := NewProvider(newConfig(cacheDir))
+		require.NoError(t, err)
+		assert.ErrorIs(t, provider.LoadCache(), errCacheMiss)
+	})
+
+	provider, err := NewProvider(newConfig(cacheDir))
+	require.NoError(t, err)
+	require.NoError(t, provider.Refresh())
+	assert.False(t, provider.IsStale())
+	expectedM3u := provider.GetM3u()
+	expectedEpg := readEPG(t, provider)
+
+	t.Run("Load from cache", func(t *testing.T) {
+		provider, err := NewProvider(newConfig(cacheDir))
+		require.NoError(t, err)
+		require.NoError(t, provider.LoadCache())
+
+		assert.Equal(t, expectedM3u, provider.GetM3u())
+		assert.Equal(t, expectedEpg, readEPG(t, provider))
+		assert.True(t, provider.IsStale())
+		assert.False(t, provider.GetLastRefresh().IsZero())
+		assert.Equal(t, fetchStatusCached, provider.GetSourceStatus()[0].LastStatus)
+
+		// The cached validators are used for the first refresh
+		require.NoError(t, provider.Refresh())
+		assert.False(t, provider.IsStale())
+		assert.Equal(t, int64(1), atomic.LoadInt64(&m3u.notModified))
+		assert.Equal(t, int64(1), atomic.LoadInt64(&epg.notModified))
+		assert.Equal(t, expectedM3u, provider.GetM3u())
+	})
+
+	t.Run("Cache for a different URL", func(t *testing.T) {
+		config := newConfig(cacheDir)
+		config.IPTVUrl = m3u.URL + "/other.m3u"
+		provider, err := NewProvider(config)
+		require.NoError(t, err)
+		assert.ErrorIs(t, provider.LoadCache(), errCacheMiss)
+	})
+
+	t.Run("Sources unavailable", func(t *testing.T) {
+		config := newConfig(cacheDir)
+		m3u.Close()
+		epg.Close()
+
+		provider, err := NewProvider(config)
+		require.NoError(t, err)
+		require.NoError(t, provider.LoadCache())
+		assert.Equal(t, expectedM3u, provider.GetM3u())
+		assert.True(t, provider.IsStale())
+	})
+}
+
+func TestProviderCacheXtream(t *testing.T) {
+	server := newFakeXtreamServer(t)
+
+	cacheDir := t.TempDir()
+	newConfig := func() *Config {
+		config := &Config{
+			CacheDir: cacheDir,
+			Sources: []*Source{
+				{Name: "xtream", Type: sourceTypeXtream, URL: server.URL, Username: "user", Password: "pass"},
+			},
+			Filters: []*Filter{{Type: "group", Value: "News"}},
+		}
+		require.NoError(t, config.compileFilterRegexps())
+		return config
+	}
+
+	provider, err := NewProvider(newConfig())
+	require.NoError(t, err)
+	require.NoError(t, provider.Refresh())
+	expectedM3u := provider.GetM3u()
+	server.Close()
+
+	provider, err = NewProvider(newConfig())
+	require.NoError(t, err)
+	require.NoError(t, provider.LoadCache())
+	assert.Equal(t, expectedM3u, provider.GetM3u())
+}
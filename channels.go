@@ -0,0 +1,246 @@
+package proxytv
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const channelMapFile = "channels.json"
+
+// channelMap assigns stable ids to channels, so that a client's saved
+// /channel/:channelId URLs keep pointing at the same channel when the
+// provider adds or removes channels. Ids are derived from the track's tvg-id,
+// or its source and name, and the assignments are persisted in the cache
+// directory so that hash collisions resolve the same way after a restart.
+//
+// Before stable ids, channels were numbered by their position in the
+// playlist. Those positions are recorded the first time ids are assigned and
+// keep resolving until the migration window ends.
+type channelMap struct {
+	lock   sync.Mutex
+	path   string
+	window time.Duration
+
+	IDs           map[string]string `json:"ids"`
+	Legacy        map[string]string `json:"legacy,omitempty"`
+	LegacyCreated time.Time         `json:"legacyCreated,omitempty"`
+	Numbers       map[string]int    `json:"numbers,omitempty"`
+
+	ProfileNumbers map[string]map[string]int `json:"profileNumbers,omitempty"`
+}
+
+func newChannelMap(path string, window time.Duration) *channelMap {
+	m := &channelMap{
+		path:   path,
+		window: window,
+		IDs:    make(map[string]string),
+	}
+	if path == "" {
+		return m
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.WithError(err).Warn("unable to read channel map")
+		}
+		return m
+	}
+	if err := json.Unmarshal(data, m); err != nil {
+		log.WithError(err).Warn("invalid channel map, ids will be reassigned")
+		m.IDs = make(map[string]string)
+		m.Legacy = nil
+	}
+	if m.IDs == nil {
+		m.IDs = make(map[string]string)
+	}
+	return m
+}
+
+// channelKey identifies the logical channel of a track.
+func channelKey(track *Track) string {
+	if id := track.Tags["tvg-id"]; id != "" {
+		return "id:" + id
+	}
+	source := ""
+	if track.Source != nil {
+		source = track.Source.Name
+	}
+	return fmt.Sprintf("name:%s/%s", source, track.Name)
+}
+
+func hashChannelKey(key string) string {
+	sum := sha1.Sum([]byte(key))
+	return hex.EncodeToString(sum[:5])
+}
+
+// assign sets the ID of each track, allocating ids for new channels.
+func (m *channelMap) assign(tracks []Track) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	changed := false
+	taken := make(map[string]bool, len(m.IDs))
+	for _, id := range m.IDs {
+		taken[id] = true
+	}
+
+	for i := range tracks {
+		key := channelKey(&tracks[i])
+		id, ok := m.IDs[key]
+		if !ok {
+			id = hashChannelKey(key)
+			for n := 2; taken[id]; n++ {
+				id = fmt.Sprintf("%s-%d", hashChannelKey(key), n)
+			}
+			m.IDs[key] = id
+			taken[id] = true
+			changed = true
+		}
+		tracks[i].ID = id
+	}
+
+	if m.Legacy == nil {
+		m.Legacy = make(map[string]string, len(tracks))
+		for i := range tracks {
+			m.Legacy[strconv.Itoa(i)] = tracks[i].ID
+		}
+		m.LegacyCreated = time.Now()
+		changed = true
+	}
+
+	if changed {
+		m.save()
+	}
+}
+
+// number sets the tvg-chno of the tracks matched by a filter with a start
+// number. Each filter numbers a block, from its start number up to the next
+// start number of another filter, in priority order. A channel keeps its
+// number for as long as it stays in the same block, even while it is missing
+// from the playlist, so numbers don't change when channels are added or
+// removed. Each profile numbers its channels separately from the main
+// playlist, which has an empty profile name.
+func (m *channelMap) number(tracks []Track, profile string) {
+	var starts []int
+	for i := range tracks {
+		if f := tracks[i].Filter; f != nil && f.StartNumber > 0 {
+			starts = append(starts, f.StartNumber)
+		}
+	}
+	if len(starts) == 0 {
+		return
+	}
+	sort.Ints(starts)
+	blockEnd := func(start int) int {
+		i := sort.SearchInts(starts, start+1)
+		if i == len(starts) {
+			return math.MaxInt
+		}
+		return starts[i]
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	numbers := m.numbersFor(profile)
+	taken := make(map[int]bool, len(numbers))
+	for _, n := range numbers {
+		taken[n] = true
+	}
+
+	changed := false
+	for i := range tracks {
+		track := &tracks[i]
+		if track.Filter == nil || track.Filter.StartNumber <= 0 {
+			continue
+		}
+		start, end := track.Filter.StartNumber, blockEnd(track.Filter.StartNumber)
+		key := channelKey(track)
+		n, ok := numbers[key]
+		if !ok || n < start || n >= end {
+			if ok {
+				delete(taken, n)
+			}
+			n = start
+			for taken[n] {
+				n++
+			}
+			if n >= end {
+				log.WithFields(log.Fields{"channel": track.Name, "number": n}).Warn("channel number overflows its filter block")
+			}
+			numbers[key] = n
+			taken[n] = true
+			changed = true
+		}
+		track.setTag("tvg-chno", strconv.Itoa(n))
+	}
+
+	if changed {
+		m.save()
+	}
+}
+
+func (m *channelMap) numbersFor(profile string) map[string]int {
+	if profile == "" {
+		if m.Numbers == nil {
+			m.Numbers = make(map[string]int)
+		}
+		return m.Numbers
+	}
+	if m.ProfileNumbers == nil {
+		m.ProfileNumbers = make(map[string]map[string]int)
+	}
+	if m.ProfileNumbers[profile] == nil {
+		m.ProfileNumbers[profile] = make(map[string]int)
+	}
+	return m.ProfileNumbers[profile]
+}
+
+// resolveLegacy returns the stable id for a numeric channel id issued before
+// stable ids were introduced.
+func (m *channelMap) resolveLegacy(legacyID string) (string, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, err := strconv.Atoi(legacyID); err != nil {
+		return "", false
+	}
+	if m.window > 0 && time.Since(m.LegacyCreated) > m.window {
+		return "", false
+	}
+	id, ok := m.Legacy[legacyID]
+	return id, ok
+}
+
+func (m *channelMap) save() {
+	if m.path == "" {
+		return
+	}
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		log.WithError(err).Error("unable to encode channel map")
+		return
+	}
+
+	tmp := m.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		log.WithError(err).Error("unable to write channel map")
+		return
+	}
+	if err := os.Rename(tmp, m.path); err != nil {
+		log.WithError(err).Error("unable to write channel map")
+	}
+}
@@ -0,0 +1,190 @@
+package proxytv
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChannelMap(t *testing.T) {
+	source := &Source{Name: "primary"}
+	track := func(id string, name string) Track {
+		return Track{Name: name, Tags: map[string]string{"tvg-id": id}, Source: source}
+	}
+
+	path := filepath.Join(t.TempDir(), channelMapFile)
+
+	m := newChannelMap(path, time.Hour)
+	tracks := []Track{track("id1", "Channel 1"), track("", "Channel 2"), track("id3", "Channel 3")}
+	m.assign(tracks)
+
+	assert.Equal(t, hashChannelKey("id:id1"), tracks[0].ID)
+	assert.Equal(t, hashChannelKey("name:primary/Channel 2"), tracks[1].ID)
+	ids := []string{tracks[0].ID, tracks[1].ID, tracks[2].ID}
+
+	// Removing and reordering channels keeps the ids
+	tracks = []Track{track("id3", "Channel 3"), track("id4", "Channel 4"), track("id1", "Channel 1 HD")}
+	m.assign(tracks)
+	assert.Equal(t, ids[2], tracks[0].ID)
+	assert.Equal(t, ids[0], tracks[2].ID)
+
+	// Legacy ids keep the positions from the first assignment
+	id, ok := m.resolveLegacy("1")
+	assert.True(t, ok)
+	assert.Equal(t, ids[1], id)
+	_, ok = m.resolveLegacy("3")
+	assert.False(t, ok)
+	_, ok = m.resolveLegacy(ids[0])
+	assert.False(t, ok)
+
+	// The map is persisted across restarts
+	m = newChannelMap(path, time.Hour)
+	tracks = []Track{track("id4", "Channel 4")}
+	m.assign(tracks)
+	assert.Equal(t, hashChannelKey("id:id4"), tracks[0].ID)
+	id, ok = m.resolveLegacy("0")
+	assert.True(t, ok)
+	assert.Equal(t, ids[0], id)
+
+	// Legacy ids stop resolving after the migration window
+	m.LegacyCreated = time.Now().Add(-2 * time.Hour)
+	_, ok = m.resolveLegacy("0")
+	assert.False(t, ok)
+}
+
+func TestChannelMapCollision(t *testing.T) {
+	m := newChannelMap("", 0)
+	// Simulate an existing channel that was assigned the hash of a new key
+	m.IDs["id:other"] = hashChannelKey("id:id1")
+
+	tracks := []Track{{Name: "Channel 1", Tags: map[string]string{"tvg-id": "id1"}}}
+	m.assign(tracks)
+	assert.Equal(t, hashChannelKey("id:id1")+"-2", tracks[0].ID)
+}
+
+func TestProviderStableChannelIDs(t *testing.T) {
+	dir := t.TempDir()
+	m3uPath := filepath.Join(dir, "iptv.m3u")
+	require.NoError(t, os.WriteFile(m3uPath, []byte(testM3uContent), 0644))
+	epgPath := filepath.Join(dir, "epg.xml")
+	require.NoError(t, os.WriteFile(epgPath, []byte(testEpgContent), 0644))
+
+	config := &Config{
+		IPTVUrl:             m3uPath,
+		EPGUrl:              epgPath,
+		CacheDir:            filepath.Join(dir, "cache"),
+		LegacyChannelWindow: time.Hour,
+		UseFFMPEG:           true,
+		ServerAddress:       "test.com:6078",
+		Filters:             []*Filter{{Type: "id", Value: ".*"}},
+	}
+	require.NoError(t, config.compileFilterRegexps())
+
+	provider, err := NewProvider(config)
+	require.NoError(t, err)
+	require.NoError(t, provider.Refresh())
+
+	id2 := hashChannelKey("id:id2")
+	assert.Contains(t, provider.GetM3u(), "http://test.com:6078/channel/"+id2)
+	assert.Equal(t, "Channel 2", provider.GetTrack(id2).Name)
+	assert.Equal(t, "Channel 2", provider.GetTrack("1").Name)
+
+	// A channel is added before channel 2 after a restart
+	require.NoError(t, os.WriteFile(m3uPath, []byte(`#EXTM3U
+#EXTINF:-1 tvg-id="id0" tvg-name="name0",Channel 0
+http://example.com/channel0
+`+testM3uContent[len("#EXTM3U\n"):]), 0644))
+
+	provider, err = NewProvider(config)
+	require.NoError(t, err)
+	require.NoError(t, provider.Refresh())
+
+	assert.Equal(t, "Channel 2", provider.GetTrack(id2).Name)
+	assert.Equal(t, "Channel 2", provider.GetTrack("1").Name)
+	assert.Equal(t, "Channel 0", provider.GetTrack(hashChannelKey("id:id0")).Name)
+	assert.Nil(t, provider.GetTrack("unknown").URI)
+}
+
+func TestChannelNumbers(t *testing.T) {
+	sports := &Filter{StartNumber: 100}
+	news := &Filter{StartNumber: 200}
+	other := &Filter{}
+	track := func(id string, filter *Filter) Track {
+		return Track{Name: id, Tags: map[string]string{"tvg-id": id}, Raw: `#EXTINF:-1 tvg-id="` + id + `",` + id, Filter: filter}
+	}
+	numbers := func(tracks []Track) []string {
+		var n []string
+		for i := range tracks {
+			n = append(n, tracks[i].Tags["tvg-chno"])
+		}
+		return n
+	}
+
+	path := filepath.Join(t.TempDir(), channelMapFile)
+	m := newChannelMap(path, 0)
+	tracks := []Track{track("s1", sports), track("s2", sports), track("n1", news), track("o1", other), track("s3", sports)}
+	m.number(tracks, "")
+	assert.Equal(t, []string{"100", "101", "200", "", "102"}, numbers(tracks))
+	assert.Equal(t, `#EXTINF:-1 tvg-id="s1" tvg-chno="100",s1`, tracks[0].Raw)
+
+	// Channels keep their numbers when others are removed or added, and new
+	// channels take the first number in their block that was never used, so
+	// that a channel that comes back gets its number back
+	m = newChannelMap(path, 0)
+	tracks = []Track{track("s4", sports), track("s3", sports), track("n1", news), track("s1", sports)}
+	m.number(tracks, "")
+	assert.Equal(t, []string{"103", "102", "200", "100"}, numbers(tracks))
+	tracks = []Track{track("s2", sports)}
+	m.number(tracks, "")
+	assert.Equal(t, []string{"101"}, numbers(tracks))
+
+	// A channel that moves to another block is renumbered
+	tracks = []Track{track("s1", news), track("n1", news)}
+	m.number(tracks, "")
+	assert.Equal(t, []string{"201", "200"}, numbers(tracks))
+
+	// Profiles number their channels separately
+	tracks = []Track{track("s2", news), track("s1", sports)}
+	m.number(tracks, "kids")
+	assert.Equal(t, []string{"200", "100"}, numbers(tracks))
+	m = newChannelMap(path, 0)
+	assert.Equal(t, 101, m.Numbers["id:s2"])
+	assert.Equal(t, 200, m.ProfileNumbers["kids"]["id:s2"])
+}
+
+func TestProviderChannelNumbers(t *testing.T) {
+	dir := t.TempDir()
+	m3uPath := filepath.Join(dir, "iptv.m3u")
+	require.NoError(t, os.WriteFile(m3uPath, []byte(testM3uContent), 0644))
+	epgPath := filepath.Join(dir, "epg.xml")
+	require.NoError(t, os.WriteFile(epgPath, []byte(testEpgContent), 0644))
+
+	config := &Config{
+		IPTVUrl: m3uPath,
+		EPGUrl:  epgPath,
+		Filters: []*Filter{{Type: "id", Value: "id2", StartNumber: 10}, {Type: "id", Value: ".*", StartNumber: 50}},
+	}
+	require.NoError(t, config.compileFilterRegexps())
+
+	provider, err := NewProvider(config)
+	require.NoError(t, err)
+	require.NoError(t, provider.Refresh())
+
+	assert.Equal(t, `#EXTM3U
+#EXTINF:-1 tvg-id="id2" tvg-name="name2" tvg-chno="10",Channel 2
+http://example.com/channel2
+#EXTINF:-1 tvg-id="id1" tvg-name="name1" tvg-chno="50",Channel 1
+http://example.com/channel1
+`, provider.GetM3u())
+
+	assert.Contains(t, readEPG(t, provider),
+		`<channel id="id1"><display-name>Channel 1</display-name><display-name>50</display-name><lcn>50</lcn></channel>`)
+
+	// Numbers are kept when the filters are reordered
+	require.NoError(t, provider.Refresh())
+	assert.Contains(t, provider.GetM3u(), `tvg-chno="10",Channel 2`)
+}
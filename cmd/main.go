@@ -109,9 +109,20 @@ func main() {
 		log.Fatalf("failed to create provider: %v", err)
 	}
 
-	err = provider.Refresh()
-	if err != nil {
-		log.Fatalf("failed to load provider: %v", err)
+	if err = provider.LoadCache(); err == nil {
+		log.Info("serving cached provider data, refreshing in the background")
+		go func() {
+			if err := provider.Refresh(); err != nil {
+				log.WithError(err).Error("failed to refresh provider")
+			}
+		}()
+	} else {
+		if config.CacheDir != "" {
+			log.WithError(err).Warn("unable to load cached provider data")
+		}
+		if err = provider.Refresh(); err != nil {
+			log.Fatalf("failed to load provider: %v", err)
+		}
 	}
 
 	stop := make(chan os.Signal, 1)
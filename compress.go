@@ -0,0 +1,171 @@
+package proxytv
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/ulikunitz/xz"
+)
+
+type compression string
+
+const (
+	compressionNone compression = ""
+	compressionGzip compression = "gzip"
+	compressionXz   compression = "xz"
+	compressionZip  compression = "zip"
+)
+
+var compressionMagic = []struct {
+	magic       []byte
+	compression compression
+}{
+	{[]byte{0x1f, 0x8b}, compressionGzip},
+	{[]byte{0xfd, '7', 'z', 'X', 'Z', 0x00}, compressionXz},
+	{[]byte{'P', 'K', 0x03, 0x04}, compressionZip},
+}
+
+// compressionHint returns the compression suggested by a Content-Encoding
+// header or the extension of a file path or URL.
+func compressionHint(name string, contentEncoding string) compression {
+	switch strings.ToLower(strings.TrimSpace(contentEncoding)) {
+	case "gzip", "x-gzip":
+		return compressionGzip
+	case "xz":
+		return compressionXz
+	}
+
+	if u, err := url.Parse(name); err == nil && u.Scheme != "" {
+		name = u.Path
+	}
+	switch strings.ToLower(path.Ext(name)) {
+	case ".gz", ".gzip":
+		return compressionGzip
+	case ".xz":
+		return compressionXz
+	case ".zip":
+		return compressionZip
+	}
+	return compressionNone
+}
+
+func detectCompression(magic []byte) compression {
+	for _, m := range compressionMagic {
+		if bytes.HasPrefix(magic, m.magic) {
+			return m.compression
+		}
+	}
+	return compressionNone
+}
+
+// decompressReader wraps a reader so that gzip, xz and zip content is
+// decompressed as it is read. The format is detected from the magic bytes;
+// the Content-Encoding header and file extension are only used as hints,
+// since HTTP clients may have already decoded the body.
+func decompressReader(rc io.ReadCloser, name string, contentEncoding string) (io.ReadCloser, error) {
+	br := bufio.NewReader(rc)
+	magic, _ := br.Peek(6)
+
+	detected := detectCompression(magic)
+	if hint := compressionHint(name, contentEncoding); hint != compressionNone && hint != detected {
+		log.WithFields(log.Fields{
+			"url":         redactURL(name),
+			"compression": hint,
+		}).Debug("content does not match expected compression, reading as detected")
+	}
+
+	switch detected {
+	case compressionGzip:
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			rc.Close()
+			return nil, fmt.Errorf("invalid gzip content: %w", err)
+		}
+		return &wrappedReadCloser{Reader: gz, closers: []io.Closer{gz, rc}}, nil
+	case compressionXz:
+		xzr, err := xz.NewReader(br)
+		if err != nil {
+			rc.Close()
+			return nil, fmt.Errorf("invalid xz content: %w", err)
+		}
+		return &wrappedReadCloser{Reader: xzr, closers: []io.Closer{rc}}, nil
+	case compressionZip:
+		defer rc.Close()
+		return openZipReader(br)
+	}
+
+	return &wrappedReadCloser{Reader: br, closers: []io.Closer{rc}}, nil
+}
+
+// openZipReader spools a zip archive to a temporary file, since the central
+// directory is at the end, and returns a reader for its first file.
+func openZipReader(r io.Reader) (io.ReadCloser, error) {
+	tmp, err := os.CreateTemp("", "proxytv-*.zip")
+	if err != nil {
+		return nil, err
+	}
+	cleanup := func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}
+
+	size, err := io.Copy(tmp, r)
+	if err != nil {
+		cleanup()
+		return nil, err
+	}
+
+	zr, err := zip.NewReader(tmp, size)
+	if err != nil {
+		cleanup()
+		return nil, fmt.Errorf("invalid zip content: %w", err)
+	}
+
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		entry, err := f.Open()
+		if err != nil {
+			cleanup()
+			return nil, err
+		}
+		return &wrappedReadCloser{Reader: entry, closers: []io.Closer{entry, closerFunc(func() error {
+			cleanup()
+			return nil
+		})}}, nil
+	}
+
+	cleanup()
+	return nil, fmt.Errorf("zip archive is empty")
+}
+
+type wrappedReadCloser struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (w *wrappedReadCloser) Close() error {
+	var firstErr error
+	for _, c := range w.closers {
+		if err := c.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+type closerFunc func() error
+
+func (f closerFunc) Close() error {
+	return f()
+}
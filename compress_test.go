@@ -0,0 +1,150 @@
+package proxytv
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/ulikunitz/xz"
+)
+
+const testEpgContent = `<?xml version="1.0" encoding="UTF-8"?>
+<tv><channel id="id1"><display-name>Channel 1</display-name></channel></tv>`
+
+func gzipBytes(t testing.TB, data []byte) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, err := w.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func xzBytes(t testing.TB, data []byte) []byte {
+	var buf bytes.Buffer
+	w, err := xz.NewWriter(&buf)
+	require.NoError(t, err)
+	_, err = w.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func zipBytes(t testing.TB, name string, data []byte) []byte {
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	f, err := w.Create(name)
+	require.NoError(t, err)
+	_, err = f.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func TestLoadReaderCompression(t *testing.T) {
+	content := []byte(testEpgContent)
+
+	tests := []struct {
+		name string
+		file string
+		data []byte
+	}{
+		{name: "Plain", file: "epg.xml", data: content},
+		{name: "Gzip", file: "epg.xml.gz", data: gzipBytes(t, content)},
+		{name: "Xz", file: "epg.xml.xz", data: xzBytes(t, content)},
+		{name: "Zip", file: "epg.zip", data: zipBytes(t, "epg.xml", content)},
+		{name: "Gzip without extension", file: "epg", data: gzipBytes(t, content)},
+		{name: "Plain with misleading extension", file: "epg.xml.gz", data: content},
+	}
+
+	dir := t.TempDir()
+
+	for _, tt := range tests {
+		t.Run(tt.name+" file", func(t *testing.T) {
+			path := filepath.Join(dir, tt.file)
+			require.NoError(t, os.WriteFile(path, tt.data, 0644))
+
+			reader, err := newFetcher(FetchConfig{}).load(path, "")
+			require.NoError(t, err)
+			defer reader.Close()
+
+			data, err := io.ReadAll(reader)
+			require.NoError(t, err)
+			assert.Equal(t, testEpgContent, string(data))
+		})
+
+		t.Run(tt.name+" url", func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write(tt.data)
+			}))
+			defer server.Close()
+
+			reader, err := newFetcher(FetchConfig{}).load(server.URL+"/"+tt.file, "")
+			require.NoError(t, err)
+			defer reader.Close()
+
+			data, err := io.ReadAll(reader)
+			require.NoError(t, err)
+			assert.Equal(t, testEpgContent, string(data))
+		})
+	}
+
+	t.Run("Content-Encoding gzip", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Write(gzipBytes(t, content))
+		}))
+		defer server.Close()
+
+		reader, err := newFetcher(FetchConfig{}).load(server.URL+"/xmltv.php", "")
+		require.NoError(t, err)
+		defer reader.Close()
+
+		data, err := io.ReadAll(reader)
+		require.NoError(t, err)
+		assert.Equal(t, testEpgContent, string(data))
+	})
+
+	t.Run("Corrupt gzip", func(t *testing.T) {
+		path := filepath.Join(dir, "corrupt.xml.gz")
+		require.NoError(t, os.WriteFile(path, []byte{0x1f, 0x8b, 0x00}, 0644))
+
+		_, err := newFetcher(FetchConfig{}).load(path, "")
+		assert.Error(t, err)
+	})
+}
+
+func TestProviderCompressedSources(t *testing.T) {
+	dir := t.TempDir()
+
+	m3uPath := filepath.Join(dir, "iptv.m3u.xz")
+	require.NoError(t, os.WriteFile(m3uPath, xzBytes(t, []byte(`#EXTM3U
+#EXTINF:-1 tvg-id="id1" tvg-name="name1",Channel 1
+http://example.com/channel1`)), 0644))
+
+	epgPath := filepath.Join(dir, "epg.xml.gz")
+	require.NoError(t, os.WriteFile(epgPath, gzipBytes(t, []byte(testEpgContent)), 0644))
+
+	config := &Config{
+		IPTVUrl: m3uPath,
+		EPGUrl:  epgPath,
+		Filters: []*Filter{{Type: "id", Value: ".*"}},
+	}
+	require.NoError(t, config.compileFilterRegexps())
+
+	provider, err := NewProvider(config)
+	require.NoError(t, err)
+	require.NoError(t, provider.Refresh())
+
+	assert.Equal(t, "Channel 1", provider.GetTrack("0").Name)
+	require.Len(t, provider.snapshot().epg.Channels, 1)
+	assert.Equal(t, "id1", provider.snapshot().epg.Channels[0].ID)
+}
@@ -4,16 +4,39 @@ import (
 	"fmt"
 	"os"
 	"regexp"
+	"strings"
+	"text/template"
 	"time"
 
 	"github.com/creasty/defaults"
 	"gopkg.in/yaml.v3"
 )
 
+const (
+	filterTypeID    = "id"
+	filterTypeGroup = "group"
+	filterTypeName  = "name"
+	filterTypeTag   = "tag"
+	filterTypeURL   = "url"
+	filterTypeHost  = "host"
+)
+
+// Filter selects tracks by matching a regular expression against one of their
+// attributes. A track matches when the filter and all of its And conditions
+// match, and none of its Except conditions do. Tracks matching an Exclude
+// filter are dropped, whichever other filters they match.
 type Filter struct {
 	Value  string         `yaml:"filter"`
 	Type   string         `yaml:"type"`
+	Tag    string         `yaml:"tag,omitempty"`
 	regexp *regexp.Regexp // Compiled regular expression
+
+	And     []*Filter `yaml:"and,omitempty"`
+	Except  []*Filter `yaml:"except,omitempty"`
+	Exclude bool      `yaml:"exclude,omitempty"`
+
+	// StartNumber is the tvg-chno of the first channel matched by the filter
+	StartNumber int `yaml:"startNumber,omitempty"`
 }
 
 // GetRegexp returns the compiled regular expression
@@ -21,6 +44,225 @@ func (f *Filter) GetRegexp() *regexp.Regexp {
 	return f.regexp
 }
 
+// field returns the attribute of the track that the filter matches.
+func (f *Filter) field(track *Track) string {
+	switch f.Type {
+	case filterTypeID:
+		return track.Tags["tvg-id"]
+	case filterTypeGroup:
+		return track.Tags["group-title"]
+	case filterTypeName:
+		return track.Tags["tvg-name"]
+	case filterTypeTag:
+		return track.Tags[f.Tag]
+	case filterTypeURL:
+		if track.URI != nil {
+			return track.URI.String()
+		}
+	case filterTypeHost:
+		if track.URI != nil {
+			return track.URI.Hostname()
+		}
+	}
+	return ""
+}
+
+// matches reports whether the track matches the filter and its conditions.
+// An empty attribute never matches.
+func (f *Filter) matches(track *Track) bool {
+	val := f.field(track)
+	if len(val) == 0 || !f.regexp.MatchString(val) {
+		return false
+	}
+	for _, cond := range f.And {
+		if !cond.matches(track) {
+			return false
+		}
+	}
+	for _, cond := range f.Except {
+		if cond.matches(track) {
+			return false
+		}
+	}
+	return true
+}
+
+const (
+	sourceTypeM3U    = "m3u"
+	sourceTypeXtream = "xtream"
+)
+
+// Source is a playlist provider. Sources are listed in priority order: when the
+// same tvg-id is found in more than one source, the earlier source wins.
+type Source struct {
+	Name      string    `yaml:"name"`
+	Type      string    `yaml:"type,omitempty"`
+	URL       string    `yaml:"url"`
+	UserAgent string    `yaml:"userAgent,omitempty"`
+	Filters   []*Filter `yaml:"filters"`
+
+	// Xtream Codes API settings
+	Username string `yaml:"username,omitempty"`
+	Password string `yaml:"password,omitempty"`
+	ShortEPG bool   `yaml:"shortEpg,omitempty"`
+}
+
+// EPGSource is an XMLTV guide provider. Guides are merged in priority order:
+// channels and programmes from earlier sources win, and later sources only
+// fill in channels and time ranges that are missing.
+type EPGSource struct {
+	Name      string `yaml:"name"`
+	URL       string `yaml:"url"`
+	UserAgent string `yaml:"userAgent,omitempty"`
+
+	// Offset shifts every programme in the guide
+	Offset    time.Duration `yaml:"-"`
+	OffsetStr string        `yaml:"offset,omitempty"`
+}
+
+// FetchConfig controls how playlists and guides are downloaded. Failed
+// requests are retried with exponential backoff and jitter, up to Attempts
+// times in total. A body that stalls for ReadTimeout once the response has
+// started fails the download without being retried.
+type FetchConfig struct {
+	ConnectTimeout    time.Duration `yaml:"-"`
+	ConnectTimeoutStr string        `yaml:"connectTimeout,omitempty" default:"10s"`
+	ReadTimeout       time.Duration `yaml:"-"`
+	ReadTimeoutStr    string        `yaml:"readTimeout,omitempty" default:"30s"`
+	Attempts          int           `yaml:"attempts,omitempty" default:"3"`
+	Backoff           time.Duration `yaml:"-"`
+	BackoffStr        string        `yaml:"backoff,omitempty" default:"1s"`
+	MaxBackoff        time.Duration `yaml:"-"`
+	MaxBackoffStr     string        `yaml:"maxBackoff,omitempty" default:"30s"`
+}
+
+// StreamConfig controls how upstream streams are read. A stream that doesn't
+// deliver any data within StartTimeout of being opened, or that stops
+// delivering data for StallTimeout, fails over to the channel's next variant.
+type StreamConfig struct {
+	StartTimeout    time.Duration `yaml:"-"`
+	StartTimeoutStr string        `yaml:"startTimeout,omitempty" default:"10s"`
+	StallTimeout    time.Duration `yaml:"-"`
+	StallTimeoutStr string        `yaml:"stallTimeout,omitempty" default:"30s"`
+}
+
+// HLSConfig controls the relaying of HLS channels as HLS. Variant restricts
+// master playlists to their "highest" or "lowest" bandwidth variant. A client
+// session ends once it hasn't made a request for SessionTimeout.
+type HLSConfig struct {
+	Enabled           bool          `yaml:"enabled,omitempty"`
+	Variant           string        `yaml:"variant,omitempty"`
+	SessionTimeout    time.Duration `yaml:"-"`
+	SessionTimeoutStr string        `yaml:"sessionTimeout,omitempty" default:"30s"`
+}
+
+// HDHomeRunConfig controls the emulation of an HDHomeRun tuner, for clients
+// such as Plex that can't use an M3U playlist. DeviceID is eight hex digits,
+// derived from the server address when it isn't set. SSDP announces the tuner
+// on the local network.
+type HDHomeRunConfig struct {
+	Enabled      bool   `yaml:"enabled,omitempty"`
+	DeviceID     string `yaml:"deviceId,omitempty"`
+	FriendlyName string `yaml:"friendlyName,omitempty" default:"ProxyTV"`
+	SSDP         bool   `yaml:"ssdp,omitempty"`
+}
+
+var hdhrDeviceIDRegexp = regexp.MustCompile(`^[0-9A-Fa-f]{8}$`)
+
+// EPGMapping assigns an EPG channel id to the tracks whose name is Name, or
+// matches Regex.
+type EPGMapping struct {
+	Name   string `yaml:"name,omitempty"`
+	Regex  string `yaml:"regex,omitempty"`
+	EPGID  string `yaml:"epgId"`
+	regexp *regexp.Regexp
+}
+
+func (m *EPGMapping) matches(name string) bool {
+	if m.regexp != nil {
+		return m.regexp.MatchString(name)
+	}
+	return strings.EqualFold(m.Name, name)
+}
+
+// Override rewrites the attributes of the tracks with the tvg-id TvgID, or
+// whose name matches Regex. Attributes that are empty are left unchanged.
+type Override struct {
+	TvgID  string `yaml:"tvgId,omitempty"`
+	Regex  string `yaml:"regex,omitempty"`
+	Name   string `yaml:"name,omitempty"`
+	Logo   string `yaml:"logo,omitempty"`
+	Group  string `yaml:"group,omitempty"`
+	Chno   string `yaml:"chno,omitempty"`
+	EPGID  string `yaml:"epgId,omitempty"`
+	regexp *regexp.Regexp
+}
+
+func (o *Override) matches(tvgID string, name string) bool {
+	if o.regexp != nil {
+		return o.regexp.MatchString(name)
+	}
+	return o.TvgID == tvgID
+}
+
+// Profile is a playlist and guide with its own filters, served at
+// /p/<name>/iptv.m3u and /p/<name>/epg.xml. Its overrides are applied after
+// the top-level overrides.
+type Profile struct {
+	Name      string      `yaml:"name"`
+	Filters   []*Filter   `yaml:"filters"`
+	Overrides []*Override `yaml:"overrides,omitempty"`
+}
+
+var profileNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// QualityRule adds Score to the rank of the tracks whose name, or whose tag
+// Tag when it is set, matches Regex.
+type QualityRule struct {
+	Regex  string `yaml:"regex"`
+	Tag    string `yaml:"tag,omitempty"`
+	Score  int    `yaml:"score"`
+	regexp *regexp.Regexp
+}
+
+const (
+	qualityTieBreakFirst = "first"
+	qualityTieBreakLast  = "last"
+)
+
+// QualityConfig ranks the tracks of a source that share a tvg-id. The track
+// with the highest score is served, and tracks with the same score are ranked
+// by their position in the playlist, first or last.
+type QualityConfig struct {
+	Rules    []*QualityRule `yaml:"rules,omitempty"`
+	TieBreak string         `yaml:"tieBreak,omitempty" default:"first"`
+}
+
+const (
+	epgMatchOff     = "off"
+	epgMatchSuggest = "suggest"
+	epgMatchApply   = "apply"
+)
+
+// EPGMatchConfig controls matching tracks without guide data to EPG channels
+// by comparing their names with the channels' display names.
+type EPGMatchConfig struct {
+	Mode      string  `yaml:"mode,omitempty" default:"off"`
+	Threshold float64 `yaml:"threshold,omitempty" default:"0.8"`
+}
+
+// PlaceholderEPGConfig controls the programmes generated for channels without
+// guide data. Title is a text/template executed with the channel's Name,
+// Group, TvgID and Number.
+type PlaceholderEPGConfig struct {
+	Enabled        bool          `yaml:"enabled,omitempty"`
+	BlockLength    time.Duration `yaml:"-"`
+	BlockLengthStr string        `yaml:"blockLength,omitempty" default:"1h"`
+	Days           int           `yaml:"days,omitempty" default:"2"`
+	Title          string        `yaml:"title,omitempty" default:"{{.Name}}"`
+	title          *template.Template
+}
+
 type Config struct {
 	LogLevel string `yaml:"logLevel,omitempty" default:"info"`
 	IPTVUrl  string `yaml:"iptvUrl"`
@@ -33,12 +275,50 @@ type Config struct {
 	UseFFMPEGPtr *bool `yaml:"ffmpeg,omitempty" default:"true"`
 	MaxStreams   int   `yaml:"maxStreams,omitempty" default:"1"`
 
+	// Relay copies streams from the upstream without ffmpeg when it is disabled
+	Relay bool `yaml:"relay,omitempty"`
+
 	RefreshInterval    time.Duration
 	RefreshIntervalStr string `yaml:"refreshInterval,omitempty" default:"12h"`
 
 	UserAgent string `yaml:"userAgent,omitempty" default:""`
 
-	Filters []*Filter `yaml:"filters"`
+	CacheDir string `yaml:"cacheDir,omitempty"`
+
+	LegacyChannelWindow    time.Duration
+	LegacyChannelWindowStr string `yaml:"legacyChannelWindow,omitempty" default:"720h"`
+
+	Fetch FetchConfig `yaml:"fetch,omitempty"`
+
+	Stream StreamConfig `yaml:"stream,omitempty"`
+
+	HLS HLSConfig `yaml:"hls,omitempty"`
+
+	HDHomeRun HDHomeRunConfig `yaml:"hdhomerun,omitempty"`
+
+	EPGPastDays   int `yaml:"epgPastDays,omitempty"`
+	EPGFutureDays int `yaml:"epgFutureDays,omitempty"`
+
+	// EPGOffsets shifts the programmes of channels by tvg-id
+	EPGOffsets    map[string]time.Duration `yaml:"-"`
+	EPGOffsetsStr map[string]string        `yaml:"epgOffsets,omitempty"`
+	EPGLocation   *time.Location           `yaml:"-"`
+	EPGTimezone   string                   `yaml:"epgTimezone,omitempty"`
+
+	EPGMappings []*EPGMapping  `yaml:"epgMappings,omitempty"`
+	EPGMatch    EPGMatchConfig `yaml:"epgMatch,omitempty"`
+
+	PlaceholderEPG PlaceholderEPGConfig `yaml:"placeholderEpg,omitempty"`
+
+	Overrides []*Override `yaml:"overrides,omitempty"`
+
+	Quality QualityConfig `yaml:"quality,omitempty"`
+
+	Profiles []*Profile `yaml:"profiles,omitempty"`
+
+	Filters    []*Filter    `yaml:"filters"`
+	Sources    []*Source    `yaml:"sources"`
+	EPGSources []*EPGSource `yaml:"epgSources"`
 }
 
 // LoadConfig reads a YAML config file from the given path and returns a Config pointer.
@@ -66,11 +346,52 @@ func LoadConfig(path string) (*Config, error) {
 		return nil, fmt.Errorf("invalid refreshInterval: %w", err)
 	}
 
-	if config.IPTVUrl == "" {
-		return nil, fmt.Errorf("iptvUrl is required")
+	config.LegacyChannelWindow, err = time.ParseDuration(config.LegacyChannelWindowStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid legacyChannelWindow: %w", err)
+	}
+
+	if err := config.Fetch.parseDurations(); err != nil {
+		return nil, err
+	}
+
+	if config.Stream.StartTimeout, err = time.ParseDuration(config.Stream.StartTimeoutStr); err != nil {
+		return nil, fmt.Errorf("invalid stream startTimeout: %w", err)
+	}
+	if config.Stream.StallTimeout, err = time.ParseDuration(config.Stream.StallTimeoutStr); err != nil {
+		return nil, fmt.Errorf("invalid stream stallTimeout: %w", err)
 	}
-	if config.EPGUrl == "" {
-		return nil, fmt.Errorf("epgUrl is required")
+
+	if config.HLS.SessionTimeout, err = time.ParseDuration(config.HLS.SessionTimeoutStr); err != nil {
+		return nil, fmt.Errorf("invalid hls sessionTimeout: %w", err)
+	}
+	if v := config.HLS.Variant; v != "" && v != hlsVariantHighest && v != hlsVariantLowest {
+		return nil, fmt.Errorf("invalid hls variant %q: must be %s or %s", v, hlsVariantHighest, hlsVariantLowest)
+	}
+
+	if config.EPGPastDays < 0 || config.EPGFutureDays < 0 {
+		return nil, fmt.Errorf("epgPastDays and epgFutureDays must not be negative")
+	}
+
+	if len(config.EPGOffsetsStr) > 0 {
+		config.EPGOffsets = make(map[string]time.Duration, len(config.EPGOffsetsStr))
+		for id, offset := range config.EPGOffsetsStr {
+			if config.EPGOffsets[id], err = time.ParseDuration(offset); err != nil {
+				return nil, fmt.Errorf("invalid epgOffsets for %q: %w", id, err)
+			}
+		}
+	}
+	if config.EPGTimezone != "" {
+		if config.EPGLocation, err = time.LoadLocation(config.EPGTimezone); err != nil {
+			return nil, fmt.Errorf("invalid epgTimezone: %w", err)
+		}
+	}
+
+	if config.IPTVUrl == "" && len(config.Sources) == 0 {
+		return nil, fmt.Errorf("iptvUrl or sources is required")
+	}
+	if config.EPGUrl == "" && len(config.EPGSources) == 0 && !config.hasShortEPG() {
+		return nil, fmt.Errorf("epgUrl or epgSources is required")
 	}
 	if config.ServerAddress == "" {
 		return nil, fmt.Errorf("serverAddress is required")
@@ -79,27 +400,364 @@ func LoadConfig(path string) (*Config, error) {
 	re := regexp.MustCompile(`^https?://`)
 	config.ServerAddress = re.ReplaceAllString(config.ServerAddress, "")
 
-	if err := validateFileOrURL(config.IPTVUrl); err != nil {
-		return nil, fmt.Errorf("invalid iptvUrl: %w", err)
+	if config.IPTVUrl != "" {
+		if err := validateFileOrURL(config.IPTVUrl); err != nil {
+			return nil, fmt.Errorf("invalid iptvUrl: %w", err)
+		}
+	}
+	if config.EPGUrl != "" {
+		if err := validateFileOrURL(config.EPGUrl); err != nil {
+			return nil, fmt.Errorf("invalid epgUrl: %w", err)
+		}
+	}
+
+	if err := config.validateSources(); err != nil {
+		return nil, err
 	}
-	if err := validateFileOrURL(config.EPGUrl); err != nil {
-		return nil, fmt.Errorf("invalid epgUrl: %w", err)
+	if err := config.validateEPGSources(); err != nil {
+		return nil, err
 	}
 
 	if err := config.compileFilterRegexps(); err != nil {
 		return nil, err
 	}
 
+	if err := config.validateEPGMatching(); err != nil {
+		return nil, err
+	}
+
+	if err := config.PlaceholderEPG.parse(); err != nil {
+		return nil, err
+	}
+
+	if err := config.validateOverrides(); err != nil {
+		return nil, err
+	}
+
+	if err := config.Quality.compile(); err != nil {
+		return nil, err
+	}
+
+	if err := config.validateProfiles(); err != nil {
+		return nil, err
+	}
+
+	if id := config.HDHomeRun.DeviceID; id != "" && !hdhrDeviceIDRegexp.MatchString(id) {
+		return nil, fmt.Errorf("invalid hdhomerun deviceId %q: must be 8 hex digits", id)
+	}
+
 	return config, nil
 }
 
+func (f *FetchConfig) parseDurations() error {
+	durations := []struct {
+		name  string
+		value string
+		dest  *time.Duration
+	}{
+		{"connectTimeout", f.ConnectTimeoutStr, &f.ConnectTimeout},
+		{"readTimeout", f.ReadTimeoutStr, &f.ReadTimeout},
+		{"backoff", f.BackoffStr, &f.Backoff},
+		{"maxBackoff", f.MaxBackoffStr, &f.MaxBackoff},
+	}
+	for _, d := range durations {
+		var err error
+		if *d.dest, err = time.ParseDuration(d.value); err != nil {
+			return fmt.Errorf("invalid fetch %s: %w", d.name, err)
+		}
+	}
+	if f.Attempts < 1 {
+		return fmt.Errorf("invalid fetch attempts: %d", f.Attempts)
+	}
+	return nil
+}
+
+func (c *PlaceholderEPGConfig) parse() error {
+	var err error
+	if c.BlockLength, err = time.ParseDuration(c.BlockLengthStr); err != nil {
+		return fmt.Errorf("invalid placeholderEpg blockLength: %w", err)
+	}
+	if c.BlockLength < time.Minute {
+		return fmt.Errorf("placeholderEpg blockLength must be at least 1m")
+	}
+	if c.Days < 1 {
+		return fmt.Errorf("placeholderEpg days must be at least 1")
+	}
+	if c.title, err = template.New("title").Parse(c.Title); err != nil {
+		return fmt.Errorf("invalid placeholderEpg title: %w", err)
+	}
+	return nil
+}
+
+// proxiesStreams reports whether streams are served by the server, either
+// remuxed by ffmpeg or relayed, rather than by the upstream. With only the
+// HLS relay enabled, just the HLS channels are served by the server.
+func (c *Config) proxiesStreams() bool {
+	return c.UseFFMPEG || c.Relay || c.HLS.Enabled
+}
+
+// iptvSources returns the configured playlist sources. When no sources are
+// configured, a single source is built from iptvUrl, userAgent and filters.
+// Sources without their own user agent or filters inherit the global ones.
+func (c *Config) iptvSources() []*Source {
+	if len(c.Sources) == 0 {
+		if c.IPTVUrl == "" {
+			return nil
+		}
+		c.Sources = []*Source{{Name: "default", URL: c.IPTVUrl}}
+	}
+
+	for _, src := range c.Sources {
+		if src.Type == "" {
+			src.Type = sourceTypeM3U
+		}
+		if src.UserAgent == "" {
+			src.UserAgent = c.UserAgent
+		}
+		if src.Filters == nil {
+			src.Filters = c.Filters
+		}
+	}
+
+	return c.Sources
+}
+
+func (c *Config) validateSources() error {
+	names := make(map[string]bool)
+	for i, src := range c.iptvSources() {
+		if src.Name == "" {
+			src.Name = fmt.Sprintf("source%d", i)
+		}
+		if names[src.Name] {
+			return fmt.Errorf("duplicate source name %q", src.Name)
+		}
+		names[src.Name] = true
+
+		if src.URL == "" {
+			return fmt.Errorf("source %q: url is required", src.Name)
+		}
+		if err := validateFileOrURL(src.URL); err != nil {
+			return fmt.Errorf("invalid url for source %q: %w", src.Name, err)
+		}
+
+		switch src.Type {
+		case sourceTypeM3U:
+		case sourceTypeXtream:
+			if !isURL(src.URL) {
+				return fmt.Errorf("source %q: xtream sources require an http url", src.Name)
+			}
+			if src.Username == "" || src.Password == "" {
+				return fmt.Errorf("source %q: xtream sources require a username and password", src.Name)
+			}
+		default:
+			return fmt.Errorf("source %q: invalid type %q", src.Name, src.Type)
+		}
+	}
+	return nil
+}
+
+func (c *Config) hasShortEPG() bool {
+	for _, src := range c.Sources {
+		if src.Type == sourceTypeXtream && src.ShortEPG {
+			return true
+		}
+	}
+	return false
+}
+
+// epgSources returns the configured guide sources. When no guide sources are
+// configured, a single source is built from epgUrl and userAgent.
+func (c *Config) epgSources() []*EPGSource {
+	if len(c.EPGSources) == 0 {
+		if c.EPGUrl == "" {
+			return nil
+		}
+		c.EPGSources = []*EPGSource{{Name: "default", URL: c.EPGUrl}}
+	}
+
+	for _, src := range c.EPGSources {
+		if src.UserAgent == "" {
+			src.UserAgent = c.UserAgent
+		}
+	}
+
+	return c.EPGSources
+}
+
+func (c *Config) validateEPGSources() error {
+	names := make(map[string]bool)
+	for i, src := range c.epgSources() {
+		if src.Name == "" {
+			src.Name = fmt.Sprintf("epg%d", i)
+		}
+		if names[src.Name] {
+			return fmt.Errorf("duplicate epg source name %q", src.Name)
+		}
+		names[src.Name] = true
+
+		if src.URL == "" {
+			return fmt.Errorf("epg source %q: url is required", src.Name)
+		}
+		if err := validateFileOrURL(src.URL); err != nil {
+			return fmt.Errorf("invalid url for epg source %q: %w", src.Name, err)
+		}
+
+		if src.OffsetStr != "" {
+			offset, err := time.ParseDuration(src.OffsetStr)
+			if err != nil {
+				return fmt.Errorf("invalid offset for epg source %q: %w", src.Name, err)
+			}
+			src.Offset = offset
+		}
+	}
+	return nil
+}
+
 func (c *Config) compileFilterRegexps() error {
-	for i, filter := range c.Filters {
+	if err := compileFilters(c.Filters); err != nil {
+		return err
+	}
+	for _, src := range c.Sources {
+		if err := compileFilters(src.Filters); err != nil {
+			return fmt.Errorf("source %q: %w", src.Name, err)
+		}
+	}
+	return nil
+}
+
+func (c *Config) validateEPGMatching() error {
+	for i, mapping := range c.EPGMappings {
+		if mapping.EPGID == "" {
+			return fmt.Errorf("epg mapping %d: epgId is required", i)
+		}
+		if (mapping.Name == "") == (mapping.Regex == "") {
+			return fmt.Errorf("epg mapping %d: one of name or regex is required", i)
+		}
+		if mapping.Regex != "" {
+			re, err := regexp.Compile(mapping.Regex)
+			if err != nil {
+				return fmt.Errorf("epg mapping %d: invalid regular expression: %w", i, err)
+			}
+			mapping.regexp = re
+		}
+	}
+
+	switch c.EPGMatch.Mode {
+	case epgMatchOff, epgMatchSuggest, epgMatchApply:
+	default:
+		return fmt.Errorf("invalid epgMatch mode %q", c.EPGMatch.Mode)
+	}
+	if c.EPGMatch.Threshold <= 0 || c.EPGMatch.Threshold > 1 {
+		return fmt.Errorf("epgMatch threshold must be between 0 and 1")
+	}
+	return nil
+}
+
+func (c *Config) validateOverrides() error {
+	return compileOverrides(c.Overrides)
+}
+
+func compileOverrides(overrides []*Override) error {
+	for i, override := range overrides {
+		if (override.TvgID == "") == (override.Regex == "") {
+			return fmt.Errorf("override %d: one of tvgId or regex is required", i)
+		}
+		if override.Name == "" && override.Logo == "" && override.Group == "" && override.Chno == "" && override.EPGID == "" {
+			return fmt.Errorf("override %d: nothing to override", i)
+		}
+		if override.Regex != "" {
+			re, err := regexp.Compile(override.Regex)
+			if err != nil {
+				return fmt.Errorf("override %d: invalid regular expression: %w", i, err)
+			}
+			override.regexp = re
+		}
+	}
+	return nil
+}
+
+func (c *Config) validateProfiles() error {
+	names := make(map[string]bool)
+	for i, profile := range c.Profiles {
+		if !profileNameRegexp.MatchString(profile.Name) {
+			return fmt.Errorf("profile %d: invalid name %q", i, profile.Name)
+		}
+		if names[profile.Name] {
+			return fmt.Errorf("duplicate profile name %q", profile.Name)
+		}
+		names[profile.Name] = true
+
+		if len(profile.Filters) == 0 {
+			return fmt.Errorf("profile %q: filters are required", profile.Name)
+		}
+		if err := compileFilters(profile.Filters); err != nil {
+			return fmt.Errorf("profile %q: %w", profile.Name, err)
+		}
+		if err := compileOverrides(profile.Overrides); err != nil {
+			return fmt.Errorf("profile %q: %w", profile.Name, err)
+		}
+	}
+	return nil
+}
+
+func (c *QualityConfig) compile() error {
+	switch c.TieBreak {
+	case qualityTieBreakFirst, qualityTieBreakLast:
+	default:
+		return fmt.Errorf("invalid quality tieBreak %q", c.TieBreak)
+	}
+	for i, rule := range c.Rules {
+		re, err := regexp.Compile(rule.Regex)
+		if err != nil {
+			return fmt.Errorf("invalid regular expression in quality rule %d: %w", i, err)
+		}
+		rule.regexp = re
+	}
+	return nil
+}
+
+func compileFilters(filters []*Filter) error {
+	for i, filter := range filters {
+		if err := compileFilter(filter, fmt.Sprintf("filter %d", i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func compileFilter(filter *Filter, name string) error {
+	switch filter.Type {
+	case filterTypeID, filterTypeGroup, filterTypeName, filterTypeURL, filterTypeHost:
+	case filterTypeTag:
+		if filter.Tag == "" {
+			return fmt.Errorf("missing tag in %s", name)
+		}
+	default:
+		return fmt.Errorf("invalid type %q in %s", filter.Type, name)
+	}
+
+	if filter.regexp == nil {
 		re, err := regexp.Compile(filter.Value)
 		if err != nil {
-			return fmt.Errorf("invalid regular expression in filter %d: %w", i, err)
+			return fmt.Errorf("invalid regular expression in %s: %w", name, err)
+		}
+		filter.regexp = re
+	}
+
+	conditions := []struct {
+		kind  string
+		conds []*Filter
+	}{{"and", filter.And}, {"except", filter.Except}}
+	for _, c := range conditions {
+		for i, cond := range c.conds {
+			condName := fmt.Sprintf("%s %s condition %d", name, c.kind, i)
+			if cond.Exclude || cond.StartNumber != 0 || len(cond.And) > 0 || len(cond.Except) > 0 {
+				return fmt.Errorf("only filter, type and tag can be set in %s", condName)
+			}
+			if err := compileFilter(cond, condName); err != nil {
+				return err
+			}
 		}
-		c.Filters[i].regexp = re
 	}
 	return nil
 }
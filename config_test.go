@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestLoadConfig(t *testing.T) {
@@ -23,9 +24,18 @@ ffmpeg: true
 maxStreams: 10
 filters:
   - filter: sports.*
-    type: include
+    type: group
+    startNumber: 100
+    except:
+      - filter: (?i)\bSD\b
+        type: name
   - filter: news|weather
-    type: exclude
+    type: tag
+    tag: tvg-country
+    exclude: true
+    and:
+      - filter: example\.com$
+        type: host
 `)
 
 		tmpfile, err := os.CreateTemp("", "config*.yaml")
@@ -54,12 +64,27 @@ filters:
 		assert.Equal(t, 10, config.MaxStreams)
 		assert.Len(t, config.Filters, 2)
 		assert.Equal(t, "sports.*", config.Filters[0].Value)
-		assert.Equal(t, "include", config.Filters[0].Type)
+		assert.Equal(t, "group", config.Filters[0].Type)
 		assert.NotNil(t, config.Filters[0].GetRegexp())
+		assert.Equal(t, 100, config.Filters[0].StartNumber)
+		require.Len(t, config.Filters[0].Except, 1)
+		assert.NotNil(t, config.Filters[0].Except[0].GetRegexp())
 		assert.Equal(t, "news|weather", config.Filters[1].Value)
-		assert.Equal(t, "exclude", config.Filters[1].Type)
+		assert.Equal(t, "tag", config.Filters[1].Type)
+		assert.Equal(t, "tvg-country", config.Filters[1].Tag)
+		assert.True(t, config.Filters[1].Exclude)
+		require.Len(t, config.Filters[1].And, 1)
+		assert.Equal(t, "host", config.Filters[1].And[0].Type)
 		assert.NotNil(t, config.Filters[1].GetRegexp())
 		assert.Equal(t, 2*time.Hour, config.RefreshInterval)
+		assert.Equal(t, 720*time.Hour, config.LegacyChannelWindow)
+		assert.Equal(t, 10*time.Second, config.Fetch.ConnectTimeout)
+		assert.Equal(t, 30*time.Second, config.Fetch.ReadTimeout)
+		assert.Equal(t, 3, config.Fetch.Attempts)
+		assert.Equal(t, time.Second, config.Fetch.Backoff)
+		assert.Equal(t, 30*time.Second, config.Fetch.MaxBackoff)
+		assert.Empty(t, config.Quality.Rules)
+		assert.Equal(t, "first", config.Quality.TieBreak)
 	})
 
 	// Test with invalid regular expression
@@ -71,9 +96,10 @@ epgUrl: http://example.com/iptv
 serverAddress: iptvserver:8080
 filters:
   - filter: sports.*
-    type: include
+    type: group
   - filter: news[
-    type: exclude
+    type: name
+    exclude: true
 `)
 
 		tmpfile, err := os.CreateTemp("", "config*.yaml")
@@ -182,4 +208,581 @@ serverAddress: iptvserver:8080
 		assert.Equal(t, iptvFile.Name(), config.IPTVUrl)
 		assert.Equal(t, epgFile.Name(), config.EPGUrl)
 	})
+
+	t.Run("Multiple sources", func(t *testing.T) {
+		content := []byte(`
+serverAddress: iptvserver:8080
+userAgent: global-agent
+epgSources:
+  - name: provider
+    url: http://primary.com/xmltv.php
+  - url: http://community.com/guide.xml
+    userAgent: epg-agent
+filters:
+  - filter: sports.*
+    type: group
+sources:
+  - name: primary
+    url: http://primary.com/get.php
+    userAgent: primary-agent
+  - url: http://secondary.com/get.php
+    filters:
+      - filter: news
+        type: group
+`)
+
+		tmpfile, err := os.CreateTemp("", "config*.yaml")
+		if err != nil {
+			t.Fatalf("Failed to create temp file: %v", err)
+		}
+		defer os.Remove(tmpfile.Name())
+
+		if err := os.WriteFile(tmpfile.Name(), content, 0644); err != nil {
+			t.Fatalf("Failed to write to temp file: %v", err)
+		}
+
+		config, err := LoadConfig(tmpfile.Name())
+		assert.NoError(t, err)
+		assert.Len(t, config.Sources, 2)
+
+		assert.Equal(t, "primary", config.Sources[0].Name)
+		assert.Equal(t, "primary-agent", config.Sources[0].UserAgent)
+		assert.Equal(t, config.Filters, config.Sources[0].Filters)
+
+		assert.Equal(t, "source1", config.Sources[1].Name)
+		assert.Equal(t, "global-agent", config.Sources[1].UserAgent)
+		assert.Len(t, config.Sources[1].Filters, 1)
+		assert.NotNil(t, config.Sources[1].Filters[0].GetRegexp())
+
+		assert.Len(t, config.EPGSources, 2)
+		assert.Equal(t, "provider", config.EPGSources[0].Name)
+		assert.Equal(t, "global-agent", config.EPGSources[0].UserAgent)
+		assert.Equal(t, "epg1", config.EPGSources[1].Name)
+		assert.Equal(t, "epg-agent", config.EPGSources[1].UserAgent)
+
+		// Invalid source URL
+		content = []byte(`
+epgUrl: http://example.com/epg
+serverAddress: iptvserver:8080
+sources:
+  - name: broken
+    url: not_a_valid_url
+`)
+		if err := os.WriteFile(tmpfile.Name(), content, 0644); err != nil {
+			t.Fatalf("Failed to write to temp file: %v", err)
+		}
+
+		config, err = LoadConfig(tmpfile.Name())
+		assert.Error(t, err)
+		assert.Nil(t, config)
+		assert.Contains(t, err.Error(), `invalid url for source "broken"`)
+	})
+	t.Run("EPG window", func(t *testing.T) {
+		content := []byte(`
+iptvUrl: http://example.com/iptv
+epgUrl: http://example.com/epg
+serverAddress: iptvserver:8080
+epgPastDays: 1
+epgFutureDays: 7
+`)
+
+		tmpfile, err := os.CreateTemp("", "config*.yaml")
+		if err != nil {
+			t.Fatalf("Failed to create temp file: %v", err)
+		}
+		defer os.Remove(tmpfile.Name())
+
+		if err := os.WriteFile(tmpfile.Name(), content, 0644); err != nil {
+			t.Fatalf("Failed to write to temp file: %v", err)
+		}
+
+		config, err := LoadConfig(tmpfile.Name())
+		assert.NoError(t, err)
+		assert.Equal(t, 1, config.EPGPastDays)
+		assert.Equal(t, 7, config.EPGFutureDays)
+
+		content = []byte(`
+iptvUrl: http://example.com/iptv
+epgUrl: http://example.com/epg
+serverAddress: iptvserver:8080
+epgPastDays: -1
+`)
+		if err := os.WriteFile(tmpfile.Name(), content, 0644); err != nil {
+			t.Fatalf("Failed to write to temp file: %v", err)
+		}
+
+		config, err = LoadConfig(tmpfile.Name())
+		assert.Error(t, err)
+		assert.Nil(t, config)
+	})
+	t.Run("EPG offsets", func(t *testing.T) {
+		content := []byte(`
+iptvUrl: http://example.com/iptv
+serverAddress: iptvserver:8080
+epgSources:
+  - url: http://example.com/epg
+    offset: -1h
+epgOffsets:
+  bbc1.uk: 30m
+epgTimezone: Europe/London
+`)
+
+		tmpfile, err := os.CreateTemp("", "config*.yaml")
+		if err != nil {
+			t.Fatalf("Failed to create temp file: %v", err)
+		}
+		defer os.Remove(tmpfile.Name())
+
+		if err := os.WriteFile(tmpfile.Name(), content, 0644); err != nil {
+			t.Fatalf("Failed to write to temp file: %v", err)
+		}
+
+		config, err := LoadConfig(tmpfile.Name())
+		require.NoError(t, err)
+		assert.Equal(t, -time.Hour, config.EPGSources[0].Offset)
+		assert.Equal(t, 30*time.Minute, config.EPGOffsets["bbc1.uk"])
+		assert.Equal(t, "Europe/London", config.EPGLocation.String())
+
+		content = []byte(`
+iptvUrl: http://example.com/iptv
+epgUrl: http://example.com/epg
+serverAddress: iptvserver:8080
+epgTimezone: Nowhere/Invalid
+`)
+		if err := os.WriteFile(tmpfile.Name(), content, 0644); err != nil {
+			t.Fatalf("Failed to write to temp file: %v", err)
+		}
+
+		config, err = LoadConfig(tmpfile.Name())
+		assert.Error(t, err)
+		assert.Nil(t, config)
+	})
+	t.Run("EPG mappings", func(t *testing.T) {
+		content := []byte(`
+iptvUrl: http://example.com/iptv
+epgUrl: http://example.com/epg
+serverAddress: iptvserver:8080
+epgMappings:
+  - name: BBC One HD
+    epgId: bbc1.uk
+  - regex: "^Sky Sports?"
+    epgId: skysports.uk
+epgMatch:
+  mode: suggest
+`)
+
+		tmpfile, err := os.CreateTemp("", "config*.yaml")
+		if err != nil {
+			t.Fatalf("Failed to create temp file: %v", err)
+		}
+		defer os.Remove(tmpfile.Name())
+
+		if err := os.WriteFile(tmpfile.Name(), content, 0644); err != nil {
+			t.Fatalf("Failed to write to temp file: %v", err)
+		}
+
+		config, err := LoadConfig(tmpfile.Name())
+		require.NoError(t, err)
+		require.Len(t, config.EPGMappings, 2)
+		assert.True(t, config.EPGMappings[0].matches("bbc one hd"))
+		assert.True(t, config.EPGMappings[1].matches("Sky Sport Main Event"))
+		assert.Equal(t, epgMatchSuggest, config.EPGMatch.Mode)
+		assert.Equal(t, 0.8, config.EPGMatch.Threshold)
+
+		invalid := []string{
+			"epgMappings:\n  - name: BBC One\n",
+			"epgMappings:\n  - name: BBC One\n    regex: BBC\n    epgId: bbc1.uk\n",
+			"epgMappings:\n  - regex: \"[\"\n    epgId: bbc1.uk\n",
+			"epgMatch:\n  mode: always\n",
+		}
+		for _, extra := range invalid {
+			content := "iptvUrl: http://example.com/iptv\nepgUrl: http://example.com/epg\nserverAddress: iptvserver:8080\n" + extra
+			if err := os.WriteFile(tmpfile.Name(), []byte(content), 0644); err != nil {
+				t.Fatalf("Failed to write to temp file: %v", err)
+			}
+			config, err = LoadConfig(tmpfile.Name())
+			assert.Error(t, err, extra)
+			assert.Nil(t, config)
+		}
+	})
+	t.Run("Placeholder EPG", func(t *testing.T) {
+		content := []byte(`
+iptvUrl: http://example.com/iptv
+epgUrl: http://example.com/epg
+serverAddress: iptvserver:8080
+placeholderEpg:
+  enabled: true
+  blockLength: 30m
+`)
+
+		tmpfile, err := os.CreateTemp("", "config*.yaml")
+		if err != nil {
+			t.Fatalf("Failed to create temp file: %v", err)
+		}
+		defer os.Remove(tmpfile.Name())
+
+		if err := os.WriteFile(tmpfile.Name(), content, 0644); err != nil {
+			t.Fatalf("Failed to write to temp file: %v", err)
+		}
+
+		config, err := LoadConfig(tmpfile.Name())
+		require.NoError(t, err)
+		assert.True(t, config.PlaceholderEPG.Enabled)
+		assert.Equal(t, 30*time.Minute, config.PlaceholderEPG.BlockLength)
+		assert.Equal(t, 2, config.PlaceholderEPG.Days)
+		assert.Equal(t, "{{.Name}}", config.PlaceholderEPG.Title)
+
+		invalid := []string{
+			"placeholderEpg:\n  blockLength: 10s\n",
+			"placeholderEpg:\n  days: -1\n",
+			"placeholderEpg:\n  title: \"{{.Name\"\n",
+		}
+		for _, extra := range invalid {
+			content := "iptvUrl: http://example.com/iptv\nepgUrl: http://example.com/epg\nserverAddress: iptvserver:8080\n" + extra
+			if err := os.WriteFile(tmpfile.Name(), []byte(content), 0644); err != nil {
+				t.Fatalf("Failed to write to temp file: %v", err)
+			}
+			config, err = LoadConfig(tmpfile.Name())
+			assert.Error(t, err, extra)
+			assert.Nil(t, config)
+		}
+	})
+	t.Run("Overrides", func(t *testing.T) {
+		content := []byte(`
+iptvUrl: http://example.com/iptv
+epgUrl: http://example.com/epg
+serverAddress: iptvserver:8080
+overrides:
+  - tvgId: bbc1
+    name: BBC One
+    chno: 101
+  - regex: "^UK: "
+    group: UK
+`)
+
+		tmpfile, err := os.CreateTemp("", "config*.yaml")
+		if err != nil {
+			t.Fatalf("Failed to create temp file: %v", err)
+		}
+		defer os.Remove(tmpfile.Name())
+
+		if err := os.WriteFile(tmpfile.Name(), content, 0644); err != nil {
+			t.Fatalf("Failed to write to temp file: %v", err)
+		}
+
+		config, err := LoadConfig(tmpfile.Name())
+		require.NoError(t, err)
+		require.Len(t, config.Overrides, 2)
+		assert.Equal(t, "101", config.Overrides[0].Chno)
+		assert.True(t, config.Overrides[0].matches("bbc1", "Anything"))
+		assert.True(t, config.Overrides[1].matches("", "UK: ITV"))
+		assert.False(t, config.Overrides[1].matches("", "US: CNN"))
+
+		invalid := []string{
+			"overrides:\n  - name: BBC One\n",
+			"overrides:\n  - tvgId: bbc1\n",
+			"overrides:\n  - tvgId: bbc1\n    regex: BBC\n    name: BBC One\n",
+			"overrides:\n  - regex: \"[\"\n    name: BBC One\n",
+		}
+		for _, extra := range invalid {
+			content := "iptvUrl: http://example.com/iptv\nepgUrl: http://example.com/epg\nserverAddress: iptvserver:8080\n" + extra
+			if err := os.WriteFile(tmpfile.Name(), []byte(content), 0644); err != nil {
+				t.Fatalf("Failed to write to temp file: %v", err)
+			}
+			config, err = LoadConfig(tmpfile.Name())
+			assert.Error(t, err, extra)
+			assert.Nil(t, config)
+		}
+	})
+	t.Run("Invalid filters", func(t *testing.T) {
+		tests := []struct {
+			filters string
+			err     string
+		}{
+			{"  - filter: sports\n    type: include\n", `invalid type "include" in filter 0`},
+			{"  - filter: sports\n    type: tag\n", "missing tag in filter 0"},
+			{"  - filter: sports\n    type: group\n    and:\n      - filter: x\n        type: country\n", `invalid type "country" in filter 0 and condition 0`},
+			{"  - filter: sports\n    type: group\n    except:\n      - filter: \"[\"\n        type: name\n", "invalid regular expression in filter 0 except condition 0"},
+			{"  - filter: sports\n    type: group\n    except:\n      - filter: x\n        type: name\n        exclude: true\n", "only filter, type and tag can be set in filter 0 except condition 0"},
+		}
+
+		tmpfile, err := os.CreateTemp("", "config*.yaml")
+		if err != nil {
+			t.Fatalf("Failed to create temp file: %v", err)
+		}
+		defer os.Remove(tmpfile.Name())
+
+		for _, tt := range tests {
+			content := "iptvUrl: http://example.com/iptv\nepgUrl: http://example.com/epg\nserverAddress: iptvserver:8080\nfilters:\n" + tt.filters
+			if err := os.WriteFile(tmpfile.Name(), []byte(content), 0644); err != nil {
+				t.Fatalf("Failed to write to temp file: %v", err)
+			}
+			config, err := LoadConfig(tmpfile.Name())
+			assert.Nil(t, config)
+			if assert.Error(t, err) {
+				assert.Contains(t, err.Error(), tt.err)
+			}
+		}
+	})
+
+	t.Run("Quality", func(t *testing.T) {
+		content := []byte(`
+iptvUrl: http://example.com/iptv
+epgUrl: http://example.com/epg
+serverAddress: iptvserver:8080
+quality:
+  rules:
+    - regex: (?i)\b4K\b
+      score: 10
+    - regex: HEVC
+      tag: tvg-codec
+      score: 5
+  tieBreak: last
+`)
+
+		tmpfile, err := os.CreateTemp("", "config*.yaml")
+		if err != nil {
+			t.Fatalf("Failed to create temp file: %v", err)
+		}
+		defer os.Remove(tmpfile.Name())
+
+		if err := os.WriteFile(tmpfile.Name(), content, 0644); err != nil {
+			t.Fatalf("Failed to write to temp file: %v", err)
+		}
+
+		config, err := LoadConfig(tmpfile.Name())
+		require.NoError(t, err)
+		require.Len(t, config.Quality.Rules, 2)
+		assert.Equal(t, 10, config.Quality.Rules[0].Score)
+		assert.Equal(t, "tvg-codec", config.Quality.Rules[1].Tag)
+		assert.Equal(t, "last", config.Quality.TieBreak)
+		assert.Equal(t, 15, newQualityRanking(config.Quality).score(&Track{Name: "Movies 4K", Tags: map[string]string{"tvg-codec": "HEVC"}}))
+
+		invalid := []string{
+			"quality:\n  tieBreak: random\n",
+			"quality:\n  rules:\n    - regex: \"[\"\n      score: 1\n",
+		}
+		for _, extra := range invalid {
+			content := "iptvUrl: http://example.com/iptv\nepgUrl: http://example.com/epg\nserverAddress: iptvserver:8080\n" + extra
+			if err := os.WriteFile(tmpfile.Name(), []byte(content), 0644); err != nil {
+				t.Fatalf("Failed to write to temp file: %v", err)
+			}
+			config, err = LoadConfig(tmpfile.Name())
+			assert.Error(t, err, extra)
+			assert.Nil(t, config)
+		}
+	})
+
+	t.Run("Stream", func(t *testing.T) {
+		content := []byte(`
+iptvUrl: http://example.com/iptv
+epgUrl: http://example.com/epg
+serverAddress: iptvserver:8080
+stream:
+  startTimeout: 5s
+`)
+
+		tmpfile, err := os.CreateTemp("", "config*.yaml")
+		if err != nil {
+			t.Fatalf("Failed to create temp file: %v", err)
+		}
+		defer os.Remove(tmpfile.Name())
+
+		if err := os.WriteFile(tmpfile.Name(), content, 0644); err != nil {
+			t.Fatalf("Failed to write to temp file: %v", err)
+		}
+
+		config, err := LoadConfig(tmpfile.Name())
+		require.NoError(t, err)
+		assert.Equal(t, 5*time.Second, config.Stream.StartTimeout)
+		assert.Equal(t, 30*time.Second, config.Stream.StallTimeout)
+
+		content = append(content, []byte("  stallTimeout: soon\n")...)
+		if err := os.WriteFile(tmpfile.Name(), content, 0644); err != nil {
+			t.Fatalf("Failed to write to temp file: %v", err)
+		}
+		config, err = LoadConfig(tmpfile.Name())
+		assert.Error(t, err)
+		assert.Nil(t, config)
+	})
+
+	t.Run("Relay", func(t *testing.T) {
+		content := []byte(`
+iptvUrl: http://example.com/iptv
+epgUrl: http://example.com/epg
+serverAddress: iptvserver:8080
+ffmpeg: false
+relay: true
+`)
+
+		tmpfile, err := os.CreateTemp("", "config*.yaml")
+		require.NoError(t, err)
+		defer os.Remove(tmpfile.Name())
+		require.NoError(t, os.WriteFile(tmpfile.Name(), content, 0644))
+
+		config, err := LoadConfig(tmpfile.Name())
+		require.NoError(t, err)
+		assert.False(t, config.UseFFMPEG)
+		assert.True(t, config.Relay)
+		assert.True(t, config.proxiesStreams())
+		assert.False(t, (&Config{}).proxiesStreams())
+	})
+
+	t.Run("HLS", func(t *testing.T) {
+		content := []byte(`
+iptvUrl: http://example.com/iptv
+epgUrl: http://example.com/epg
+serverAddress: iptvserver:8080
+hls:
+  enabled: true
+  variant: highest
+`)
+
+		tmpfile, err := os.CreateTemp("", "config*.yaml")
+		require.NoError(t, err)
+		defer os.Remove(tmpfile.Name())
+		require.NoError(t, os.WriteFile(tmpfile.Name(), content, 0644))
+
+		config, err := LoadConfig(tmpfile.Name())
+		require.NoError(t, err)
+		assert.True(t, config.HLS.Enabled)
+		assert.Equal(t, hlsVariantHighest, config.HLS.Variant)
+		assert.Equal(t, 30*time.Second, config.HLS.SessionTimeout)
+
+		for _, invalid := range []string{"  variant: best\n", "  sessionTimeout: soon\n"} {
+			require.NoError(t, os.WriteFile(tmpfile.Name(), append(content, invalid...), 0644))
+			config, err = LoadConfig(tmpfile.Name())
+			assert.Error(t, err, invalid)
+			assert.Nil(t, config)
+		}
+	})
+
+	t.Run("Profiles", func(t *testing.T) {
+		content := []byte(`
+iptvUrl: http://example.com/iptv
+epgUrl: http://example.com/epg
+serverAddress: iptvserver:8080
+profiles:
+  - name: kids
+    filters:
+      - type: group
+        filter: Kids
+    overrides:
+      - tvgId: cartoons
+        name: Cartoon Club
+`)
+
+		tmpfile, err := os.CreateTemp("", "config*.yaml")
+		if err != nil {
+			t.Fatalf("Failed to create temp file: %v", err)
+		}
+		defer os.Remove(tmpfile.Name())
+
+		if err := os.WriteFile(tmpfile.Name(), content, 0644); err != nil {
+			t.Fatalf("Failed to write to temp file: %v", err)
+		}
+
+		config, err := LoadConfig(tmpfile.Name())
+		require.NoError(t, err)
+		require.Len(t, config.Profiles, 1)
+		assert.Equal(t, "kids", config.Profiles[0].Name)
+		assert.True(t, config.Profiles[0].Filters[0].matches(&Track{Tags: map[string]string{"group-title": "Kids"}}))
+		assert.True(t, config.Profiles[0].Overrides[0].matches("cartoons", ""))
+
+		tests := []struct {
+			extra string
+			err   string
+		}{
+			{"profiles:\n  - name: kids/tv\n    filters:\n      - type: group\n        filter: Kids\n", `profile 0: invalid name "kids/tv"`},
+			{"profiles:\n  - name: kids\n", `profile "kids": filters are required`},
+			{"profiles:\n  - name: kids\n    filters:\n      - type: group\n        filter: \"[\"\n", `profile "kids": invalid regular expression in filter 0`},
+			{"profiles:\n  - name: kids\n    filters:\n      - type: group\n        filter: Kids\n    overrides:\n      - tvgId: cartoons\n", `profile "kids": override 0: nothing to override`},
+			{"profiles:\n  - name: kids\n    filters:\n      - type: group\n        filter: Kids\n  - name: kids\n    filters:\n      - type: group\n        filter: Kids\n", `duplicate profile name "kids"`},
+		}
+		for _, tt := range tests {
+			content := "iptvUrl: http://example.com/iptv\nepgUrl: http://example.com/epg\nserverAddress: iptvserver:8080\n" + tt.extra
+			if err := os.WriteFile(tmpfile.Name(), []byte(content), 0644); err != nil {
+				t.Fatalf("Failed to write to temp file: %v", err)
+			}
+			config, err = LoadConfig(tmpfile.Name())
+			assert.Nil(t, config, tt.extra)
+			if assert.Error(t, err, tt.extra) {
+				assert.Contains(t, err.Error(), tt.err)
+			}
+		}
+	})
+
+	t.Run("HDHomeRun", func(t *testing.T) {
+		content := []byte(`
+iptvUrl: http://example.com/iptv
+epgUrl: http://example.com/epg
+serverAddress: iptvserver:8080
+hdhomerun:
+  enabled: true
+  ssdp: true
+`)
+
+		tmpfile, err := os.CreateTemp("", "config*.yaml")
+		if err != nil {
+			t.Fatalf("Failed to create temp file: %v", err)
+		}
+		defer os.Remove(tmpfile.Name())
+
+		if err := os.WriteFile(tmpfile.Name(), content, 0644); err != nil {
+			t.Fatalf("Failed to write to temp file: %v", err)
+		}
+
+		config, err := LoadConfig(tmpfile.Name())
+		require.NoError(t, err)
+		assert.True(t, config.HDHomeRun.Enabled)
+		assert.Equal(t, "ProxyTV", config.HDHomeRun.FriendlyName)
+		assert.True(t, config.HDHomeRun.SSDP)
+
+		content = append(content, []byte("  deviceId: proxytv1\n")...)
+		if err := os.WriteFile(tmpfile.Name(), content, 0644); err != nil {
+			t.Fatalf("Failed to write to temp file: %v", err)
+		}
+		config, err = LoadConfig(tmpfile.Name())
+		assert.Nil(t, config)
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), "invalid hdhomerun deviceId")
+		}
+	})
+}
+
+func TestFilterMatches(t *testing.T) {
+	track := &Track{
+		Name: "Sky Sports F1 SD",
+		URI:  mustParseURL("http://cdn.example.com/live/1.ts"),
+		Tags: map[string]string{
+			"tvg-id":       "skyf1.uk",
+			"tvg-name":     "Sky Sports F1 SD",
+			"group-title":  "UK Sports",
+			"tvg-country":  "GB",
+			"tvg-language": "English",
+		},
+	}
+
+	tests := []struct {
+		name     string
+		filter   *Filter
+		expected bool
+	}{
+		{"Group", &Filter{Type: "group", Value: "Sports"}, true},
+		{"Tag", &Filter{Type: "tag", Tag: "tvg-country", Value: "^GB$"}, true},
+		{"Missing tag", &Filter{Type: "tag", Tag: "catchup", Value: ".*"}, false},
+		{"URL", &Filter{Type: "url", Value: `/live/\d+\.ts$`}, true},
+		{"Host", &Filter{Type: "host", Value: `^cdn\.example\.com$`}, true},
+		{"And", &Filter{Type: "group", Value: "Sports", And: []*Filter{{Type: "tag", Tag: "tvg-language", Value: "English"}}}, true},
+		{"And fails", &Filter{Type: "group", Value: "Sports", And: []*Filter{{Type: "tag", Tag: "tvg-language", Value: "French"}}}, false},
+		{"Except", &Filter{Type: "group", Value: "Sports", Except: []*Filter{{Type: "name", Value: `(?i)\b(SD|backup)\b`}}}, false},
+		{"Except doesn't match", &Filter{Type: "group", Value: "Sports", Except: []*Filter{{Type: "name", Value: `(?i)\bbackup\b`}}}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.NoError(t, compileFilter(tt.filter, "filter"))
+			assert.Equal(t, tt.expected, tt.filter.matches(track))
+		})
+	}
 }
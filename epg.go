@@ -0,0 +1,356 @@
+package proxytv
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/csfrancis/proxytv/xmltv"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// mergeEPG combines guides given in priority order into a single guide.
+// Channels missing from earlier guides are taken from later ones, and a later
+// guide's programmes are only used where they don't overlap a programme that
+// is already scheduled for the same channel.
+func mergeEPG(guides []*xmltv.TV) *xmltv.TV {
+	if len(guides) == 0 {
+		return &xmltv.TV{}
+	}
+	if len(guides) == 1 {
+		return guides[0]
+	}
+
+	merged := &xmltv.TV{
+		Date:              guides[0].Date,
+		SourceInfoURL:     guides[0].SourceInfoURL,
+		SourceInfoName:    guides[0].SourceInfoName,
+		SourceDataURL:     guides[0].SourceDataURL,
+		GeneratorInfoName: guides[0].GeneratorInfoName,
+		GeneratorInfoURL:  guides[0].GeneratorInfoURL,
+	}
+
+	channels := make(map[string]bool)
+	schedules := make(map[string][]xmltv.Programme)
+	var order []string
+
+	for i, tv := range guides {
+		for _, channel := range tv.Channels {
+			if channels[channel.ID] {
+				continue
+			}
+			channels[channel.ID] = true
+			merged.Channels = append(merged.Channels, channel)
+		}
+
+		filled := 0
+		for id, programmes := range groupProgrammes(tv.Programmes) {
+			existing, ok := schedules[id]
+			if !ok {
+				order = append(order, id)
+			}
+			if i == 0 || len(existing) == 0 {
+				schedules[id] = programmes
+				continue
+			}
+			var n int
+			schedules[id], n = fillScheduleGaps(existing, programmes)
+			filled += n
+		}
+
+		if i > 0 {
+			log.WithFields(log.Fields{
+				"guide":          i,
+				"filledCount":    filled,
+				"programmeCount": len(tv.Programmes),
+			}).Debug("merged secondary EPG")
+		}
+	}
+
+	// Channels are emitted in the order they were declared, followed by
+	// programmes for channels that only appeared in <programme> elements.
+	index := make(map[string]int, len(merged.Channels))
+	for i, channel := range merged.Channels {
+		index[channel.ID] = i
+	}
+	position := func(id string) int {
+		if i, ok := index[id]; ok {
+			return i
+		}
+		return len(index)
+	}
+	sort.Slice(order, func(i, j int) bool {
+		pi, pj := position(order[i]), position(order[j])
+		if pi != pj {
+			return pi < pj
+		}
+		return order[i] < order[j]
+	})
+	for _, id := range order {
+		merged.Programmes = append(merged.Programmes, schedules[id]...)
+	}
+
+	return merged
+}
+
+// groupProgrammes splits programmes by channel, sorting each schedule by start time.
+func groupProgrammes(programmes []xmltv.Programme) map[string][]xmltv.Programme {
+	grouped := make(map[string][]xmltv.Programme)
+	for _, programme := range programmes {
+		grouped[programme.Channel] = append(grouped[programme.Channel], programme)
+	}
+	for _, schedule := range grouped {
+		sort.SliceStable(schedule, func(i, j int) bool {
+			return programmeStart(&schedule[i]).Before(programmeStart(&schedule[j]))
+		})
+	}
+	return grouped
+}
+
+// fillScheduleGaps inserts candidates into a sorted schedule wherever they
+// don't overlap an existing programme. It returns the new schedule and the
+// number of programmes added.
+func fillScheduleGaps(schedule []xmltv.Programme, candidates []xmltv.Programme) ([]xmltv.Programme, int) {
+	added := 0
+	for i := range candidates {
+		candidate := &candidates[i]
+		if candidate.Start == nil {
+			continue
+		}
+		start, stop := programmeStart(candidate), programmeStop(candidate)
+
+		// Index of the first scheduled programme starting at or after stop
+		idx := sort.Search(len(schedule), func(j int) bool {
+			return !programmeStart(&schedule[j]).Before(stop)
+		})
+		if idx < len(schedule) && programmeStart(&schedule[idx]).Equal(start) {
+			continue
+		}
+		if endsAfter(schedule[:idx], start) {
+			continue
+		}
+
+		schedule = append(schedule, xmltv.Programme{})
+		copy(schedule[idx+1:], schedule[idx:])
+		schedule[idx] = *candidate
+		added++
+	}
+	return schedule, added
+}
+
+// endsAfter reports whether any programme of a schedule ends after t. Earlier
+// programmes are checked too, since a long programme may be followed by
+// shorter ones that it overlaps.
+func endsAfter(schedule []xmltv.Programme, t time.Time) bool {
+	for i := range schedule {
+		if programmeStop(&schedule[i]).After(t) {
+			return true
+		}
+	}
+	return false
+}
+
+func programmeStart(p *xmltv.Programme) time.Time {
+	if p.Start == nil {
+		return time.Time{}
+	}
+	return p.Start.Time
+}
+
+// programmeStop returns the end of a programme. Programmes without a stop time
+// are treated as instantaneous so they never block another guide's entries.
+func programmeStop(p *xmltv.Programme) time.Time {
+	if p.Stop == nil || p.Stop.Before(programmeStart(p)) {
+		return programmeStart(p)
+	}
+	return p.Stop.Time
+}
+
+// epgWindow limits a guide to the programmes that overlap the range from past
+// before now to future after now. A zero bound is unlimited.
+type epgWindow struct {
+	past   time.Duration
+	future time.Duration
+}
+
+func newEPGWindow(pastDays int, futureDays int) epgWindow {
+	return epgWindow{
+		past:   time.Duration(pastDays) * 24 * time.Hour,
+		future: time.Duration(futureDays) * 24 * time.Hour,
+	}
+}
+
+func (w epgWindow) unlimited() bool {
+	return w.past == 0 && w.future == 0
+}
+
+// filter returns a function reporting whether a programme overlaps the window
+// at now. Programmes that straddle an edge of the window are kept whole.
+func (w epgWindow) filter(now time.Time) func(p *xmltv.Programme) bool {
+	return func(p *xmltv.Programme) bool {
+		if p.Start == nil {
+			return true
+		}
+		if w.past > 0 && programmeStop(p).Before(now.Add(-w.past)) {
+			return false
+		}
+		if w.future > 0 && !programmeStart(p).Before(now.Add(w.future)) {
+			return false
+		}
+		return true
+	}
+}
+
+// selectEPGChannels returns a copy of tv with only the given channels and
+// their programmes.
+func selectEPGChannels(tv *xmltv.TV, channels map[string]bool) *xmltv.TV {
+	out := *tv
+	out.Channels = nil
+	for i := range tv.Channels {
+		if channels[tv.Channels[i].ID] {
+			out.Channels = append(out.Channels, tv.Channels[i])
+		}
+	}
+	out.Programmes = nil
+	for i := range tv.Programmes {
+		if channels[tv.Programmes[i].Channel] {
+			out.Programmes = append(out.Programmes, tv.Programmes[i])
+		}
+	}
+	return &out
+}
+
+// trimEPG drops the programmes outside the window.
+func trimEPG(tv *xmltv.TV, w epgWindow, now time.Time) *xmltv.TV {
+	if w.unlimited() {
+		return tv
+	}
+
+	keep := w.filter(now)
+	var programmes []xmltv.Programme
+	for i := range tv.Programmes {
+		if keep(&tv.Programmes[i]) {
+			if programmes != nil {
+				programmes = append(programmes, tv.Programmes[i])
+			}
+			continue
+		}
+		if programmes == nil {
+			programmes = make([]xmltv.Programme, i, len(tv.Programmes))
+			copy(programmes, tv.Programmes[:i])
+		}
+	}
+	if programmes == nil {
+		return tv
+	}
+
+	log.WithFields(log.Fields{
+		"programmeCount": len(programmes),
+		"trimmedCount":   len(tv.Programmes) - len(programmes),
+	}).Debug("trimmed EPG to window")
+
+	trimmed := *tv
+	trimmed.Programmes = programmes
+	return &trimmed
+}
+
+// shiftEPG moves the programmes of a guide by offset, plus the offset of their
+// channel, and converts their times to loc when it is set.
+func shiftEPG(tv *xmltv.TV, offset time.Duration, channelOffsets map[string]time.Duration, loc *time.Location) *xmltv.TV {
+	if offset == 0 && len(channelOffsets) == 0 && loc == nil {
+		return tv
+	}
+
+	shift := func(t *xmltv.Time, d time.Duration) *xmltv.Time {
+		if t == nil {
+			return nil
+		}
+		shifted := t.Add(d)
+		if loc != nil {
+			shifted = shifted.In(loc)
+		}
+		return &xmltv.Time{Time: shifted}
+	}
+
+	shifted := *tv
+	shifted.Programmes = make([]xmltv.Programme, len(tv.Programmes))
+	for i, programme := range tv.Programmes {
+		d := offset + channelOffsets[programme.Channel]
+		programme.Start = shift(programme.Start, d)
+		programme.Stop = shift(programme.Stop, d)
+		programme.PDCStart = shift(programme.PDCStart, d)
+		programme.VPSStart = shift(programme.VPSStart, d)
+		shifted.Programmes[i] = programme
+	}
+	return &shifted
+}
+
+// parseTvgShift parses an M3U tvg-shift attribute, which is a number of hours
+// that may be fractional or signed.
+func parseTvgShift(value string) (time.Duration, error) {
+	hours, err := strconv.ParseFloat(strings.TrimPrefix(strings.TrimSpace(value), "+"), 64)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(hours * float64(time.Hour)), nil
+}
+
+// channelOffsets returns the offset of each channel's programmes, taken from
+// the tvg-shift attribute of its tracks unless the channel's tvg-id has an
+// offset in the config.
+func channelOffsets(tracks []Track, configured map[string]time.Duration) map[string]time.Duration {
+	offsets := make(map[string]time.Duration)
+	for i := range tracks {
+		id, value := tracks[i].Tags["tvg-id"], tracks[i].Tags["tvg-shift"]
+		if id == "" || value == "" {
+			continue
+		}
+		shift, err := parseTvgShift(value)
+		if err != nil {
+			log.WithFields(log.Fields{"channel": tracks[i].Name, "tvg-shift": value}).Warn("invalid tvg-shift")
+			continue
+		}
+		if shift != 0 {
+			offsets[id] = shift
+		}
+	}
+	for id, offset := range configured {
+		offsets[id] = offset
+	}
+	return offsets
+}
+
+// numberEPGChannels sets the lcn of the guide channels of tracks with a
+// tvg-chno, and adds the number as a display name for clients that don't read
+// the lcn.
+func numberEPGChannels(tv *xmltv.TV, tracks []Track) *xmltv.TV {
+	numbers := make(map[string]string)
+	for i := range tracks {
+		id, number := tracks[i].Tags["tvg-id"], tracks[i].Tags["tvg-chno"]
+		if _, ok := numbers[id]; !ok && id != "" && number != "" {
+			numbers[id] = number
+		}
+	}
+	if len(numbers) == 0 {
+		return tv
+	}
+
+	out := *tv
+	out.Channels = make([]xmltv.Channel, len(tv.Channels))
+	for i, channel := range tv.Channels {
+		if number, ok := numbers[channel.ID]; ok {
+			channel.LCN = number
+			names := make([]xmltv.CommonElement, 0, len(channel.DisplayNames)+1)
+			for _, name := range channel.DisplayNames {
+				if name.Value != number {
+					names = append(names, name)
+				}
+			}
+			channel.DisplayNames = append(names, xmltv.CommonElement{Value: number})
+		}
+		out.Channels[i] = channel
+	}
+	return &out
+}
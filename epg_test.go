@@ -0,0 +1,270 @@
+package proxytv
+
+import (
+	"encoding/xml"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/csfrancis/proxytv/xmltv"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testProgramme(channel string, title string, start string, stop string) xmltv.Programme {
+	parse := func(s string) *xmltv.Time {
+		t, err := time.Parse("15:04", s)
+		if err != nil {
+			panic(err)
+		}
+		return &xmltv.Time{Time: t}
+	}
+	return xmltv.Programme{
+		Channel: channel,
+		Titles:  []xmltv.CommonElement{{Value: title}},
+		Start:   parse(start),
+		Stop:    parse(stop),
+	}
+}
+
+func programmeTitles(programmes []xmltv.Programme) []string {
+	titles := make([]string, 0, len(programmes))
+	for _, p := range programmes {
+		titles = append(titles, p.Channel+":"+p.Titles[0].Value)
+	}
+	return titles
+}
+
+func TestMergeEPG(t *testing.T) {
+	primary := &xmltv.TV{
+		GeneratorInfoName: "primary",
+		Channels: []xmltv.Channel{
+			{ID: "id1", DisplayNames: []xmltv.CommonElement{{Value: "Primary 1"}}},
+		},
+		Programmes: []xmltv.Programme{
+			testProgramme("id1", "p-news", "10:00", "11:00"),
+			testProgramme("id1", "p-movie", "13:00", "15:00"),
+		},
+	}
+	secondary := &xmltv.TV{
+		GeneratorInfoName: "secondary",
+		Channels: []xmltv.Channel{
+			{ID: "id2", DisplayNames: []xmltv.CommonElement{{Value: "Secondary 2"}}},
+			{ID: "id1", DisplayNames: []xmltv.CommonElement{{Value: "Secondary 1"}}},
+		},
+		Programmes: []xmltv.Programme{
+			testProgramme("id1", "s-early", "09:00", "10:00"),
+			testProgramme("id1", "s-overlap", "10:30", "11:30"),
+			testProgramme("id1", "s-gap", "11:00", "13:00"),
+			testProgramme("id1", "s-straddle", "14:30", "16:00"),
+			testProgramme("id1", "s-late", "15:00", "16:00"),
+			testProgramme("id2", "s-only", "10:00", "11:00"),
+		},
+	}
+
+	t.Run("Single guide", func(t *testing.T) {
+		assert.Same(t, primary, mergeEPG([]*xmltv.TV{primary}))
+	})
+
+	t.Run("Fills channels and gaps", func(t *testing.T) {
+		merged := mergeEPG([]*xmltv.TV{primary, secondary})
+
+		assert.Equal(t, "primary", merged.GeneratorInfoName)
+		assert.Len(t, merged.Channels, 2)
+		assert.Equal(t, "Primary 1", merged.Channels[0].DisplayNames[0].Value)
+		assert.Equal(t, "id2", merged.Channels[1].ID)
+
+		assert.Equal(t, []string{
+			"id1:s-early",
+			"id1:p-news",
+			"id1:s-gap",
+			"id1:p-movie",
+			"id1:s-late",
+			"id2:s-only",
+		}, programmeTitles(merged.Programmes))
+	})
+
+	t.Run("Overlap with an earlier programme", func(t *testing.T) {
+		primary := &xmltv.TV{Programmes: []xmltv.Programme{
+			testProgramme("id1", "p-marathon", "18:00", "22:00"),
+			testProgramme("id1", "p-break", "19:00", "19:00"),
+			testProgramme("id1", "p-short", "19:30", "20:00"),
+		}}
+		secondary := &xmltv.TV{Programmes: []xmltv.Programme{
+			testProgramme("id1", "s-hidden", "20:30", "21:00"),
+			testProgramme("id1", "s-after", "22:00", "23:00"),
+		}}
+
+		merged := mergeEPG([]*xmltv.TV{primary, secondary})
+		assert.Equal(t, []string{
+			"id1:p-marathon",
+			"id1:p-break",
+			"id1:p-short",
+			"id1:s-after",
+		}, programmeTitles(merged.Programmes))
+	})
+}
+
+func TestEPGWindow(t *testing.T) {
+	now := time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)
+	programme := func(title string, start time.Time, length time.Duration) xmltv.Programme {
+		p := xmltv.Programme{
+			Channel: "id1",
+			Titles:  []xmltv.CommonElement{{Value: title}},
+			Start:   &xmltv.Time{Time: start},
+		}
+		if length > 0 {
+			p.Stop = &xmltv.Time{Time: start.Add(length)}
+		}
+		return p
+	}
+
+	day := 24 * time.Hour
+	tv := &xmltv.TV{
+		Programmes: []xmltv.Programme{
+			programme("ended", now.Add(-2*day), time.Hour),
+			programme("straddles past", now.Add(-day-30*time.Minute), time.Hour),
+			programme("current", now.Add(-30*time.Minute), time.Hour),
+			programme("no stop", now.Add(time.Hour), 0),
+			programme("straddles future", now.Add(2*day-30*time.Minute), time.Hour),
+			programme("too far", now.Add(3*day), time.Hour),
+		},
+	}
+
+	t.Run("Trim", func(t *testing.T) {
+		trimmed := trimEPG(tv, newEPGWindow(1, 2), now)
+		assert.Equal(t, []string{
+			"id1:straddles past",
+			"id1:current",
+			"id1:no stop",
+			"id1:straddles future",
+		}, programmeTitles(trimmed.Programmes))
+
+		// The original guide is left untouched
+		assert.Len(t, tv.Programmes, 6)
+	})
+
+	t.Run("Future only", func(t *testing.T) {
+		trimmed := trimEPG(tv, newEPGWindow(0, 1), now)
+		assert.Equal(t, []string{
+			"id1:ended",
+			"id1:straddles past",
+			"id1:current",
+			"id1:no stop",
+		}, programmeTitles(trimmed.Programmes))
+	})
+
+	t.Run("Unlimited", func(t *testing.T) {
+		assert.Same(t, tv, trimEPG(tv, newEPGWindow(0, 0), now))
+	})
+
+	t.Run("Nothing to trim", func(t *testing.T) {
+		assert.Same(t, tv, trimEPG(tv, newEPGWindow(7, 7), now))
+	})
+}
+
+func TestProviderEPGWindow(t *testing.T) {
+	now := time.Now()
+	format := func(t time.Time) string {
+		return t.UTC().Format("20060102150405 -0700")
+	}
+	epg := `<?xml version="1.0" encoding="UTF-8"?>
+<tv>
+<channel id="id1"><display-name>Channel 1</display-name></channel>
+<programme channel="id1" start="` + format(now.Add(-72*time.Hour)) + `" stop="` + format(now.Add(-71*time.Hour)) + `"><title>Old</title></programme>
+<programme channel="id1" start="` + format(now.Add(-25*time.Hour)) + `" stop="` + format(now.Add(-23*time.Hour)) + `"><title>Straddles</title></programme>
+<programme channel="id1" start="` + format(now) + `" stop="` + format(now.Add(time.Hour)) + `"><title>Now</title></programme>
+<programme channel="id1" start="` + format(now.Add(72*time.Hour)) + `" stop="` + format(now.Add(73*time.Hour)) + `"><title>Later</title></programme>
+</tv>`
+
+	provider := &Provider{epgWindow: newEPGWindow(1, 2)}
+	tv, err := provider.loadXMLTv(strings.NewReader(epg), map[string]bool{"id1": true})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"id1:Straddles", "id1:Now"}, programmeTitles(tv.Programmes))
+}
+
+func TestShiftEPG(t *testing.T) {
+	start := time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)
+	tv := &xmltv.TV{
+		Programmes: []xmltv.Programme{
+			{Channel: "id1", Start: &xmltv.Time{Time: start}, Stop: &xmltv.Time{Time: start.Add(time.Hour)}},
+			{Channel: "id2", Start: &xmltv.Time{Time: start}},
+		},
+	}
+
+	t.Run("Unchanged", func(t *testing.T) {
+		assert.Same(t, tv, shiftEPG(tv, 0, nil, nil))
+	})
+
+	t.Run("Source and channel offsets", func(t *testing.T) {
+		shifted := shiftEPG(tv, time.Hour, map[string]time.Duration{"id1": -30 * time.Minute}, nil)
+		assert.Equal(t, start.Add(30*time.Minute), shifted.Programmes[0].Start.Time)
+		assert.Equal(t, start.Add(90*time.Minute), shifted.Programmes[0].Stop.Time)
+		assert.Equal(t, start.Add(time.Hour), shifted.Programmes[1].Start.Time)
+		assert.Nil(t, shifted.Programmes[1].Stop)
+
+		// The original guide is left untouched
+		assert.Equal(t, start, tv.Programmes[0].Start.Time)
+	})
+
+	t.Run("Timezone", func(t *testing.T) {
+		loc := time.FixedZone("EST", -5*60*60)
+		shifted := shiftEPG(tv, 0, nil, loc)
+		attr, err := shifted.Programmes[0].Start.MarshalXMLAttr(xml.Name{Local: "start"})
+		require.NoError(t, err)
+		assert.Equal(t, "20240110070000 -0500", attr.Value)
+		assert.True(t, start.Equal(shifted.Programmes[0].Start.Time))
+	})
+}
+
+func TestChannelOffsets(t *testing.T) {
+	tracks := []Track{
+		{Name: "One", Tags: map[string]string{"tvg-id": "id1", "tvg-shift": "+1"}},
+		{Name: "Two", Tags: map[string]string{"tvg-id": "id2", "tvg-shift": "-1.5"}},
+		{Name: "Three", Tags: map[string]string{"tvg-id": "id3", "tvg-shift": "invalid"}},
+		{Name: "Four", Tags: map[string]string{"tvg-id": "id4", "tvg-shift": "0"}},
+		{Name: "Five", Tags: map[string]string{"tvg-shift": "2"}},
+	}
+
+	offsets := channelOffsets(tracks, map[string]time.Duration{"id2": 2 * time.Hour, "id5": time.Hour})
+	assert.Equal(t, map[string]time.Duration{
+		"id1": time.Hour,
+		"id2": 2 * time.Hour,
+		"id5": time.Hour,
+	}, offsets)
+}
+
+func TestProviderEPGOffsets(t *testing.T) {
+	dir := t.TempDir()
+	m3uPath := filepath.Join(dir, "iptv.m3u")
+	require.NoError(t, os.WriteFile(m3uPath, []byte(`#EXTM3U
+#EXTINF:-1 tvg-id="id1" tvg-shift="-1",Channel 1
+http://example.com/channel1
+#EXTINF:-1 tvg-id="id2",Channel 2
+http://example.com/channel2`), 0644))
+	epgPath := filepath.Join(dir, "epg.xml")
+	require.NoError(t, os.WriteFile(epgPath, []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<tv>
+<programme channel="id1" start="20240110120000 +0000" stop="20240110130000 +0000"><title>One</title></programme>
+<programme channel="id2" start="20240110120000 +0000" stop="20240110130000 +0000"><title>Two</title></programme>
+</tv>`), 0644))
+
+	config := &Config{
+		IPTVUrl:     m3uPath,
+		EPGSources:  []*EPGSource{{Name: "guide", URL: epgPath, Offset: 2 * time.Hour}},
+		EPGOffsets:  map[string]time.Duration{"id2": 30 * time.Minute},
+		EPGLocation: time.FixedZone("CET", 60*60),
+		Filters:     []*Filter{{Type: "id", Value: ".*"}},
+	}
+	require.NoError(t, config.compileFilterRegexps())
+
+	provider, err := NewProvider(config)
+	require.NoError(t, err)
+	require.NoError(t, provider.Refresh())
+
+	epg := readEPG(t, provider)
+	assert.Contains(t, epg, `start="20240110140000 +0100" stop="20240110150000 +0100"`)
+	assert.Contains(t, epg, `start="20240110153000 +0100" stop="20240110163000 +0100"`)
+}
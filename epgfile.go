@@ -0,0 +1,182 @@
+package proxytv
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/csfrancis/proxytv/xmltv"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const epgXMLHeader = "<?xml version=\"1.0\" encoding=\"UTF-8\"?><!DOCTYPE tv SYSTEM \"xmltv.dtd\">"
+
+// epgFile is a guide encoded once per refresh and written to disk, along with
+// a gzip variant, so that requests stream it with http.ServeContent instead
+// of each holding a copy of the document in memory.
+//
+// The snapshot that refers to the files holds a reference to them, as does
+// each request reading them. The files are closed and removed when the last
+// reference is released, once the snapshot has been replaced and its last
+// request has finished.
+type epgFile struct {
+	plain     *os.File
+	plainSize int64
+	gzip      *os.File
+	gzipSize  int64
+	etag      string
+	modTime   time.Time
+	refs      atomic.Int64
+}
+
+// countingWriter counts the bytes written to the underlying writer.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// writeEPGFile encodes tv to XML in a single pass, writing the plain and gzip
+// variants to temporary files in dir, or the default temporary directory when
+// dir is empty.
+func writeEPGFile(dir string, tv *xmltv.TV) (*epgFile, error) {
+	plain, err := os.CreateTemp(dir, "proxytv-epg-*.xml")
+	if err != nil {
+		return nil, err
+	}
+	compressed, err := os.CreateTemp(dir, "proxytv-epg-*.xml.gz")
+	if err != nil {
+		removeFile(plain)
+		return nil, err
+	}
+
+	file := &epgFile{plain: plain, gzip: compressed, modTime: time.Now()}
+	if err := file.write(tv); err != nil {
+		file.remove()
+		return nil, err
+	}
+	file.refs.Store(1)
+	return file, nil
+}
+
+// acquire takes a reference to the files, unless the last one has already
+// been released.
+func (f *epgFile) acquire() bool {
+	for {
+		refs := f.refs.Load()
+		if refs == 0 {
+			return false
+		}
+		if f.refs.CompareAndSwap(refs, refs+1) {
+			return true
+		}
+	}
+}
+
+// release drops a reference, removing the files when it was the last one.
+func (f *epgFile) release() {
+	if f.refs.Add(-1) == 0 {
+		f.remove()
+	}
+}
+
+func (f *epgFile) remove() {
+	removeFile(f.plain)
+	removeFile(f.gzip)
+}
+
+func removeFile(file *os.File) {
+	file.Close()
+	if err := os.Remove(file.Name()); err != nil {
+		log.WithError(err).WithField("path", file.Name()).Warn("unable to remove epg file")
+	}
+}
+
+func (f *epgFile) write(tv *xmltv.TV) error {
+	plainOut := &countingWriter{w: f.plain}
+	plainBuf := bufio.NewWriterSize(plainOut, 64*1024)
+	gzipOut := &countingWriter{w: f.gzip}
+	gzipBuf := bufio.NewWriterSize(gzipOut, 64*1024)
+	gz := gzip.NewWriter(gzipBuf)
+	hash := sha1.New()
+
+	w := io.MultiWriter(plainBuf, gz, hash)
+	if _, err := io.WriteString(w, epgXMLHeader); err != nil {
+		return err
+	}
+	if err := xml.NewEncoder(w).Encode(tv); err != nil {
+		return err
+	}
+
+	if err := plainBuf.Flush(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	if err := gzipBuf.Flush(); err != nil {
+		return err
+	}
+
+	f.plainSize = plainOut.n
+	f.gzipSize = gzipOut.n
+	f.etag = hex.EncodeToString(hash.Sum(nil)[:8])
+	return nil
+}
+
+// reader returns a new reader over the plain XML. Readers use ReadAt, so any
+// number of them can be used concurrently.
+func (f *epgFile) reader() *io.SectionReader {
+	return io.NewSectionReader(f.plain, 0, f.plainSize)
+}
+
+// acceptsGzip reports whether the request's Accept-Encoding allows gzip.
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if !strings.EqualFold(strings.TrimSpace(coding), "gzip") {
+			continue
+		}
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if v, err := strconv.ParseFloat(q, 64); err == nil && v == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// serve writes the guide to the response, using the gzip variant when the
+// client accepts it. Range and conditional requests are handled by
+// http.ServeContent.
+func (f *epgFile) serve(w http.ResponseWriter, r *http.Request) {
+	header := w.Header()
+	header.Set("Content-Type", "application/xml")
+	header.Add("Vary", "Accept-Encoding")
+
+	if acceptsGzip(r) {
+		header.Set("Content-Encoding", "gzip")
+		header.Set("ETag", `"`+f.etag+`-gzip"`)
+		http.ServeContent(w, r, "epg.xml", f.modTime, io.NewSectionReader(f.gzip, 0, f.gzipSize))
+		return
+	}
+
+	header.Set("ETag", `"`+f.etag+`"`)
+	http.ServeContent(w, r, "epg.xml", f.modTime, f.reader())
+}
@@ -0,0 +1,257 @@
+package proxytv
+
+import (
+	"compress/gzip"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/csfrancis/proxytv/xmltv"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// readEPG returns the guide file served for the main lineup.
+func readEPG(t testing.TB, provider *Provider) string {
+	t.Helper()
+	f, _ := provider.GetProfileEpgFile("")
+	if f == nil {
+		return ""
+	}
+	defer f.release()
+	var b strings.Builder
+	_, err := io.Copy(&b, f.reader())
+	assert.NoError(t, err)
+	return b.String()
+}
+
+// syntheticEPG builds a guide with a week of half-hour programmes for each
+// channel.
+func syntheticEPG(channels int) *xmltv.TV {
+	tv := &xmltv.TV{}
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for c := 0; c < channels; c++ {
+		id := fmt.Sprintf("channel%d", c)
+		tv.Channels = append(tv.Channels, xmltv.Channel{
+			ID:           id,
+			DisplayNames: []xmltv.CommonElement{{Value: fmt.Sprintf("Channel %d", c)}},
+		})
+		for p := 0; p < 7*48; p++ {
+			t := start.Add(time.Duration(p) * 30 * time.Minute)
+			tv.Programmes = append(tv.Programmes, xmltv.Programme{
+				Channel:      id,
+				Titles:       []xmltv.CommonElement{{Value: fmt.Sprintf("Programme %d", p)}},
+				Descriptions: []xmltv.CommonElement{{Value: "A description of the programme that is long enough to be realistic."}},
+				Start:        &xmltv.Time{Time: t},
+				Stop:         &xmltv.Time{Time: t.Add(30 * time.Minute)},
+			})
+		}
+	}
+	return tv
+}
+
+func TestEPGFileServe(t *testing.T) {
+	tv := syntheticEPG(2)
+	expected, err := xml.Marshal(tv)
+	require.NoError(t, err)
+	expected = append([]byte(epgXMLHeader), expected...)
+
+	f, err := writeEPGFile(t.TempDir(), tv)
+	require.NoError(t, err)
+	defer f.release()
+
+	serve := func(header http.Header) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/epg.xml", nil)
+		r.Header = header
+		f.serve(w, r)
+		return w
+	}
+
+	t.Run("Plain", func(t *testing.T) {
+		w := serve(http.Header{})
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "application/xml", w.Header().Get("Content-Type"))
+		assert.Empty(t, w.Header().Get("Content-Encoding"))
+		assert.Equal(t, fmt.Sprint(len(expected)), w.Header().Get("Content-Length"))
+		assert.Equal(t, string(expected), w.Body.String())
+	})
+
+	t.Run("Gzip", func(t *testing.T) {
+		w := serve(http.Header{"Accept-Encoding": {"deflate, gzip;q=0.8"}})
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+		assert.Equal(t, "Accept-Encoding", w.Header().Get("Vary"))
+		assert.Less(t, w.Body.Len(), len(expected))
+
+		reader, err := gzip.NewReader(w.Body)
+		require.NoError(t, err)
+		data, err := io.ReadAll(reader)
+		require.NoError(t, err)
+		assert.Equal(t, string(expected), string(data))
+	})
+
+	t.Run("Gzip refused", func(t *testing.T) {
+		w := serve(http.Header{"Accept-Encoding": {"gzip;q=0"}})
+		assert.Empty(t, w.Header().Get("Content-Encoding"))
+		assert.Equal(t, string(expected), w.Body.String())
+	})
+
+	t.Run("Conditional", func(t *testing.T) {
+		etag := serve(http.Header{}).Header().Get("ETag")
+		require.NotEmpty(t, etag)
+		w := serve(http.Header{"If-None-Match": {etag}})
+		assert.Equal(t, http.StatusNotModified, w.Code)
+	})
+
+	t.Run("Range", func(t *testing.T) {
+		w := serve(http.Header{"Range": {"bytes=0-4"}})
+		assert.Equal(t, http.StatusPartialContent, w.Code)
+		assert.Equal(t, "<?xml", w.Body.String())
+	})
+}
+
+func TestServerEPGNotLoaded(t *testing.T) {
+	provider := &Provider{}
+	server, err := NewServer(&Config{}, provider, "test")
+	require.NoError(t, err)
+	server.setupRoutes()
+
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/epg.xml", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+}
+
+// The benchmarks compare marshaling the guide into memory and copying it for
+// each request, as was done before guides were written to disk, with writing
+// the guide file once and streaming it to each request.
+
+const benchmarkEPGChannels = 500
+
+func BenchmarkEPGMarshal(b *testing.B) {
+	tv := syntheticEPG(benchmarkEPGChannels)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		data, err := xml.Marshal(tv)
+		if err != nil {
+			b.Fatal(err)
+		}
+		_ = append([]byte(epgXMLHeader), data...)
+	}
+}
+
+func BenchmarkEPGWriteFile(b *testing.B) {
+	tv := syntheticEPG(benchmarkEPGChannels)
+	dir := b.TempDir()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		f, err := writeEPGFile(dir, tv)
+		if err != nil {
+			b.Fatal(err)
+		}
+		f.release()
+	}
+}
+
+func BenchmarkEPGServeMemory(b *testing.B) {
+	data, err := xml.Marshal(syntheticEPG(benchmarkEPGChannels))
+	if err != nil {
+		b.Fatal(err)
+	}
+	epg := string(append([]byte(epgXMLHeader), data...))
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w := httptest.NewRecorder()
+		w.Body = nil
+		w.Header().Set("Content-Type", "application/xml")
+		w.Write([]byte(epg))
+	}
+}
+
+func BenchmarkEPGServeFile(b *testing.B) {
+	f, err := writeEPGFile(b.TempDir(), syntheticEPG(benchmarkEPGChannels))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer f.release()
+	r := httptest.NewRequest(http.MethodGet, "/epg.xml", nil)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w := httptest.NewRecorder()
+		w.Body = nil
+		f.serve(w, r)
+	}
+}
+
+func TestEPGFileRelease(t *testing.T) {
+	dir := t.TempDir()
+	files := func() []string {
+		matches, err := filepath.Glob(filepath.Join(dir, "proxytv-epg-*"))
+		require.NoError(t, err)
+		return matches
+	}
+
+	f, err := writeEPGFile(dir, syntheticEPG(1))
+	require.NoError(t, err)
+	assert.Len(t, files(), 2)
+
+	// A reader keeps the files after the snapshot's reference is released
+	require.True(t, f.acquire())
+	f.release()
+	assert.Len(t, files(), 2)
+	_, err = io.ReadAll(f.reader())
+	require.NoError(t, err)
+
+	f.release()
+	assert.Empty(t, files())
+	assert.False(t, f.acquire())
+}
+
+func TestProviderEPGFileRelease(t *testing.T) {
+	dir := t.TempDir()
+	m3uPath := filepath.Join(dir, "iptv.m3u")
+	require.NoError(t, os.WriteFile(m3uPath, []byte(testM3uContent), 0644))
+	epgPath := filepath.Join(dir, "epg.xml")
+	require.NoError(t, os.WriteFile(epgPath, []byte(testEpgContent), 0644))
+
+	config := &Config{
+		IPTVUrl:  m3uPath,
+		EPGUrl:   epgPath,
+		CacheDir: filepath.Join(dir, "cache"),
+		Filters:  []*Filter{{Type: "id", Value: ".*"}},
+	}
+	require.NoError(t, config.compileFilterRegexps())
+
+	provider, err := NewProvider(config)
+	require.NoError(t, err)
+	require.NoError(t, provider.Refresh())
+
+	f, ok := provider.GetProfileEpgFile("")
+	require.True(t, ok)
+	require.NotNil(t, f)
+
+	// Replacing the snapshot only removes its guide once it has been read
+	require.NoError(t, provider.Refresh())
+	files, err := filepath.Glob(filepath.Join(config.CacheDir, "proxytv-epg-*"))
+	require.NoError(t, err)
+	assert.Len(t, files, 4)
+
+	f.release()
+	files, err = filepath.Glob(filepath.Join(config.CacheDir, "proxytv-epg-*"))
+	require.NoError(t, err)
+	assert.Len(t, files, 2)
+	assert.Contains(t, readEPG(t, provider), `<channel id="id1">`)
+}
@@ -0,0 +1,374 @@
+package proxytv
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/csfrancis/proxytv/xmltv"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Tokens that describe the quality or encoding of a stream rather than the
+// channel, and are ignored when comparing names.
+var qualityTokens = map[string]bool{
+	"hd": true, "fhd": true, "uhd": true, "sd": true, "4k": true, "hq": true,
+	"hevc": true, "h264": true, "h265": true, "raw": true, "backup": true,
+}
+
+// Country or provider prefixes such as "UK:" or "US |".
+var namePrefixRegex = regexp.MustCompile(`^[A-Za-z]{2,3}\s*[:|]\s*`)
+var nameSeparatorRegex = regexp.MustCompile(`[^\p{L}\p{N}]+`)
+
+// normalizeChannelName lowercases a channel name and strips punctuation,
+// country prefixes and quality suffixes, so "UK: BBC One HD" and "BBC One"
+// compare equal.
+func normalizeChannelName(name string) string {
+	name = namePrefixRegex.ReplaceAllString(strings.TrimSpace(name), "")
+	tokens := strings.Fields(nameSeparatorRegex.ReplaceAllString(strings.ToLower(name), " "))
+	kept := tokens[:0]
+	for _, token := range tokens {
+		if !qualityTokens[token] {
+			kept = append(kept, token)
+		}
+	}
+	return strings.Join(kept, " ")
+}
+
+func bigrams(s string) map[string]int {
+	s = strings.ReplaceAll(s, " ", "")
+	grams := make(map[string]int)
+	runes := []rune(s)
+	for i := 0; i+1 < len(runes); i++ {
+		grams[string(runes[i:i+2])]++
+	}
+	return grams
+}
+
+// nameSimilarity returns the Dice coefficient of the character bigrams of
+// two normalized names, from 0 for nothing in common to 1 for equal names.
+func nameSimilarity(a string, b string) float64 {
+	if a == b {
+		return 1
+	}
+	ga, gb := bigrams(a), bigrams(b)
+	total := 0
+	for _, n := range ga {
+		total += n
+	}
+	for _, n := range gb {
+		total += n
+	}
+	if total == 0 {
+		return 0
+	}
+	shared := 0
+	for gram, n := range ga {
+		shared += min(n, gb[gram])
+	}
+	return float64(2*shared) / float64(total)
+}
+
+type epgSuggestion struct {
+	ID    string  `json:"id"`
+	Name  string  `json:"name"`
+	Score float64 `json:"score"`
+}
+
+// Percent returns the score as a whole percentage.
+func (s epgSuggestion) Percent() int {
+	return int(s.Score*100 + 0.5)
+}
+
+type unmatchedChannel struct {
+	ID          string          `json:"id"`
+	Name        string          `json:"name"`
+	TvgID       string          `json:"tvgId,omitempty"`
+	Group       string          `json:"group,omitempty"`
+	Suggestions []epgSuggestion `json:"suggestions,omitempty"`
+}
+
+type matchedChannel struct {
+	ID     string  `json:"id"`
+	Name   string  `json:"name"`
+	OldID  string  `json:"oldTvgId,omitempty"`
+	EPGID  string  `json:"epgId"`
+	Source string  `json:"source"`
+	Score  float64 `json:"score,omitempty"`
+}
+
+// epgMatchReport lists the channels that were assigned an EPG id by a mapping
+// or the fuzzy matcher, and the channels that still have no guide data.
+type epgMatchReport struct {
+	Mode      string             `json:"mode"`
+	Matched   []matchedChannel   `json:"matched"`
+	Unmatched []unmatchedChannel `json:"unmatched"`
+}
+
+// applyEPGMappings sets the tvg-id of the tracks matching a configured
+// mapping. The first mapping that matches a track wins.
+func applyEPGMappings(tracks []Track, mappings []*EPGMapping) []matchedChannel {
+	var matched []matchedChannel
+	for i := range tracks {
+		track := &tracks[i]
+		for _, mapping := range mappings {
+			if !mapping.matches(track.Name) {
+				continue
+			}
+			oldID := track.Tags["tvg-id"]
+			if oldID != mapping.EPGID {
+				track.setTag("tvg-id", mapping.EPGID)
+			}
+			matched = append(matched, matchedChannel{
+				ID: track.ID, Name: track.Name, OldID: oldID, EPGID: mapping.EPGID, Source: "mapping",
+			})
+			break
+		}
+	}
+	return matched
+}
+
+// applyEPGMatches gives the tracks of a profile the tvg-ids the fuzzy matcher
+// found for the same channels in the main playlist, unless an override or
+// mapping has since given them another one.
+func applyEPGMatches(tracks []Track, matched []matchedChannel) {
+	byID := make(map[string]*matchedChannel)
+	for i := range matched {
+		if matched[i].Source == "fuzzy" {
+			byID[matched[i].ID] = &matched[i]
+		}
+	}
+	if len(byID) == 0 {
+		return
+	}
+	for i := range tracks {
+		if m, ok := byID[tracks[i].ID]; ok && tracks[i].Tags["tvg-id"] == m.OldID {
+			tracks[i].setTag("tvg-id", m.EPGID)
+		}
+	}
+}
+
+// epgIndexEntry is the id and normalized display names of a guide channel.
+type epgIndexEntry struct {
+	ID    string
+	Name  string
+	Names []string
+}
+
+func newEPGIndexEntry(channel *xmltv.Channel) epgIndexEntry {
+	entry := epgIndexEntry{ID: channel.ID}
+	for _, name := range channel.DisplayNames {
+		if normalized := normalizeChannelName(name.Value); normalized != "" {
+			entry.Names = append(entry.Names, normalized)
+			if entry.Name == "" {
+				entry.Name = name.Value
+			}
+		}
+	}
+	return entry
+}
+
+// epgMatcher finds EPG channels for tracks whose tvg-id isn't in any guide,
+// by comparing the normalized track name with the channels' display names.
+// Channels are observed as guides are parsed, so that in apply mode the
+// programmes of a matching channel are kept even though its id isn't in the
+// lineup yet. The channels seen in each guide are kept as an index, so that
+// matches can be made again when an unchanged guide is reused.
+type epgMatcher struct {
+	mode      string
+	threshold float64
+
+	known     map[string]bool  // ids of the channels in the last parsed guides
+	unmatched map[int]string   // track index to normalized name
+	tokens    map[string][]int // name token to unmatched track indices
+	index     []epgIndexEntry  // channels observed by the current parse
+}
+
+func newEPGMatcher(mode string, threshold float64, tracks []Track, indexes [][]epgIndexEntry) *epgMatcher {
+	m := &epgMatcher{
+		mode:      mode,
+		threshold: threshold,
+		known:     make(map[string]bool),
+		unmatched: make(map[int]string),
+		tokens:    make(map[string][]int),
+	}
+	for _, index := range indexes {
+		for _, entry := range index {
+			m.known[entry.ID] = true
+		}
+	}
+	// Before any guide has been seen, every track is a candidate, since its
+	// tvg-id may not be in the guide either.
+	for i := range tracks {
+		id := tracks[i].Tags["tvg-id"]
+		if id != "" && m.known[id] {
+			continue
+		}
+		name := normalizeChannelName(tracks[i].Name)
+		if name == "" {
+			continue
+		}
+		m.unmatched[i] = name
+		for _, token := range strings.Fields(name) {
+			m.tokens[token] = append(m.tokens[token], i)
+		}
+	}
+	return m
+}
+
+// observe records a channel of the guide being parsed. In apply mode, a
+// channel that matches an unmatched track is added to channels so that its
+// programmes are kept.
+func (m *epgMatcher) observe(channel *xmltv.Channel, channels map[string]bool) {
+	if m == nil {
+		return
+	}
+	entry := newEPGIndexEntry(channel)
+	m.index = append(m.index, entry)
+
+	if m.mode != epgMatchApply || channels[channel.ID] {
+		return
+	}
+	for _, name := range entry.Names {
+		for _, token := range strings.Fields(name) {
+			for _, i := range m.tokens[token] {
+				if entry.score(m.unmatched[i]) >= m.threshold {
+					channels[channel.ID] = true
+					return
+				}
+			}
+		}
+	}
+}
+
+// takeIndex returns the channels observed since the last call.
+func (m *epgMatcher) takeIndex() []epgIndexEntry {
+	if m == nil {
+		return nil
+	}
+	index := m.index
+	m.index = nil
+	return index
+}
+
+// apply sets the tvg-id of each unmatched track whose most similar channel
+// scores at least the threshold.
+func (m *epgMatcher) apply(tracks []Track, names *epgNameIndex) []matchedChannel {
+	if m.mode != epgMatchApply {
+		return nil
+	}
+
+	var matched []matchedChannel
+	for i, name := range m.unmatched {
+		if id := tracks[i].Tags["tvg-id"]; id != "" && names.ids[id] {
+			continue
+		}
+		suggestions := names.suggest(name, m.threshold, 1)
+		if len(suggestions) == 0 {
+			continue
+		}
+		track := &tracks[i]
+		oldID := track.Tags["tvg-id"]
+		track.setTag("tvg-id", suggestions[0].ID)
+		matched = append(matched, matchedChannel{
+			ID: track.ID, Name: track.Name, OldID: oldID, EPGID: suggestions[0].ID, Source: "fuzzy", Score: suggestions[0].Score,
+		})
+		log.WithFields(log.Fields{
+			"channel": track.Name,
+			"epgId":   suggestions[0].ID,
+			"score":   suggestions[0].Score,
+		}).Debug("matched channel to EPG by name")
+	}
+	return matched
+}
+
+func (e *epgIndexEntry) score(name string) float64 {
+	best := 0.0
+	for _, n := range e.Names {
+		best = max(best, nameSimilarity(name, n))
+	}
+	return best
+}
+
+// epgNameIndex looks up guide channels by the tokens of their names.
+type epgNameIndex struct {
+	entries []epgIndexEntry
+	ids     map[string]bool
+	tokens  map[string][]int
+}
+
+func newEPGNameIndex(indexes [][]epgIndexEntry) *epgNameIndex {
+	x := &epgNameIndex{ids: make(map[string]bool), tokens: make(map[string][]int)}
+	for _, index := range indexes {
+		for _, entry := range index {
+			if x.ids[entry.ID] {
+				continue
+			}
+			x.ids[entry.ID] = true
+			x.entries = append(x.entries, entry)
+			n := len(x.entries) - 1
+			for _, name := range entry.Names {
+				for _, token := range strings.Fields(name) {
+					x.tokens[token] = append(x.tokens[token], n)
+				}
+			}
+		}
+	}
+	return x
+}
+
+// suggest returns up to limit channels with a name sharing a token with the
+// normalized name and scoring at least minScore, best first.
+func (x *epgNameIndex) suggest(name string, minScore float64, limit int) []epgSuggestion {
+	var suggestions []epgSuggestion
+	scored := make(map[int]bool)
+	for _, token := range strings.Fields(name) {
+		for _, n := range x.tokens[token] {
+			if scored[n] {
+				continue
+			}
+			scored[n] = true
+			entry := &x.entries[n]
+			if score := entry.score(name); score >= minScore {
+				suggestions = append(suggestions, epgSuggestion{ID: entry.ID, Name: entry.Name, Score: score})
+			}
+		}
+	}
+	sort.SliceStable(suggestions, func(i, j int) bool {
+		if suggestions[i].Score != suggestions[j].Score {
+			return suggestions[i].Score > suggestions[j].Score
+		}
+		return suggestions[i].ID < suggestions[j].ID
+	})
+	if len(suggestions) > limit {
+		suggestions = suggestions[:limit]
+	}
+	return suggestions
+}
+
+// buildEPGMatchReport lists the tracks without programmes in the guide. When
+// names is set, each is given the channels with the most similar names.
+func buildEPGMatchReport(mode string, tracks []Track, covered map[string]bool, matched []matchedChannel,
+	names *epgNameIndex, threshold float64) *epgMatchReport {
+	report := &epgMatchReport{Mode: mode, Matched: matched}
+	for i := range tracks {
+		track := &tracks[i]
+		id := track.Tags["tvg-id"]
+		if id != "" && covered[id] {
+			continue
+		}
+		channel := unmatchedChannel{
+			ID:    track.ID,
+			Name:  track.Name,
+			TvgID: id,
+			Group: track.Tags["group-title"],
+		}
+		if names != nil {
+			channel.Suggestions = names.suggest(normalizeChannelName(track.Name), threshold/2, 3)
+		}
+		report.Unmatched = append(report.Unmatched, channel)
+	}
+	sort.Slice(report.Matched, func(i, j int) bool { return report.Matched[i].Name < report.Matched[j].Name })
+	return report
+}
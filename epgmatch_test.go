@@ -0,0 +1,200 @@
+package proxytv
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalizeChannelName(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{"BBC One", "bbc one"},
+		{"UK: BBC One HD", "bbc one"},
+		{"US | CNN (FHD)", "cnn"},
+		{"Sky Sports F1 4K", "sky sports f1"},
+		{"Canal+ Séries", "canal séries"},
+		{"HD", ""},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, normalizeChannelName(tt.name), tt.name)
+	}
+}
+
+func TestNameSimilarity(t *testing.T) {
+	assert.Equal(t, 1.0, nameSimilarity("bbc one", "bbc one"))
+	assert.Greater(t, nameSimilarity("sky sport main event", "sky sports main event"), 0.9)
+	assert.Less(t, nameSimilarity("bbc one", "itv"), 0.2)
+	assert.Equal(t, 0.0, nameSimilarity("", "a"))
+}
+
+const testMatchEpgContent = `<?xml version="1.0" encoding="UTF-8"?>
+<tv>
+<channel id="bbc1.uk"><display-name>BBC One</display-name></channel>
+<channel id="skynews.uk"><display-name>Sky News</display-name></channel>
+<channel id="skysports.uk"><display-name>Sky Sports Main Event</display-name></channel>
+<programme channel="bbc1.uk" start="20240110120000 +0000" stop="20240110130000 +0000"><title>News</title></programme>
+<programme channel="skynews.uk" start="20240110120000 +0000" stop="20240110130000 +0000"><title>Headlines</title></programme>
+<programme channel="skysports.uk" start="20240110120000 +0000" stop="20240110130000 +0000"><title>Football</title></programme>
+</tv>`
+
+const testMatchM3uContent = `#EXTM3U
+#EXTINF:-1 tvg-name="BBC One HD" group-title="UK",UK: BBC One HD
+http://example.com/bbc1
+#EXTINF:-1 tvg-id="SkyNews" tvg-name="Sky News" group-title="UK",UK: Sky News
+http://example.com/skynews
+#EXTINF:-1 tvg-name="Sky Sports" group-title="UK",UK: Sky Sport Main Event
+http://example.com/skysports
+#EXTINF:-1 tvg-name="Local" group-title="UK",Local Channel
+http://example.com/local`
+
+func newMatchConfig(t *testing.T, epgURL string, mode string) *Config {
+	dir := t.TempDir()
+	m3uPath := filepath.Join(dir, "iptv.m3u")
+	require.NoError(t, os.WriteFile(m3uPath, []byte(testMatchM3uContent), 0644))
+
+	config := &Config{
+		IPTVUrl:  m3uPath,
+		EPGUrl:   epgURL,
+		EPGMatch: EPGMatchConfig{Mode: mode, Threshold: 0.8},
+		Filters:  []*Filter{{Type: "group", Value: "UK"}},
+	}
+	require.NoError(t, config.compileFilterRegexps())
+	return config
+}
+
+func TestProviderEPGMappings(t *testing.T) {
+	dir := t.TempDir()
+	epgPath := filepath.Join(dir, "epg.xml")
+	require.NoError(t, os.WriteFile(epgPath, []byte(testMatchEpgContent), 0644))
+
+	config := newMatchConfig(t, epgPath, epgMatchOff)
+	config.EPGMappings = []*EPGMapping{
+		{Name: "uk: bbc one hd", EPGID: "bbc1.uk"},
+		{Regex: "^UK: Sky News", EPGID: "skynews.uk"},
+	}
+	require.NoError(t, config.validateEPGMatching())
+
+	provider, err := NewProvider(config)
+	require.NoError(t, err)
+	require.NoError(t, provider.Refresh())
+
+	m3u := provider.GetM3u()
+	assert.Contains(t, m3u, `#EXTINF:-1 tvg-name="BBC One HD" group-title="UK" tvg-id="bbc1.uk",UK: BBC One HD`)
+	assert.Contains(t, m3u, `#EXTINF:-1 tvg-id="skynews.uk" tvg-name="Sky News" group-title="UK",UK: Sky News`)
+
+	epg := readEPG(t, provider)
+	assert.Contains(t, epg, `<channel id="bbc1.uk">`)
+	assert.Contains(t, epg, `<title>Headlines</title>`)
+	assert.NotContains(t, epg, `<title>Football</title>`)
+
+	report := provider.GetEPGMatchReport()
+	require.NotNil(t, report)
+	require.Len(t, report.Matched, 2)
+	assert.Equal(t, "mapping", report.Matched[0].Source)
+	assert.Equal(t, "SkyNews", report.Matched[1].OldID)
+	require.Len(t, report.Unmatched, 2)
+	assert.Empty(t, report.Unmatched[0].Suggestions)
+
+	// The channel ids are derived from the tracks before they are mapped
+	assert.Equal(t, hashChannelKey("name:default/UK: BBC One HD"), provider.snapshot().tracks[0].ID)
+}
+
+func TestProviderEPGFuzzyMatch(t *testing.T) {
+	t.Run("Apply", func(t *testing.T) {
+		epg := newConditionalServer(testMatchEpgContent, `"epg-v1"`)
+		defer epg.Close()
+
+		provider, err := NewProvider(newMatchConfig(t, epg.URL+"/epg.xml", epgMatchApply))
+		require.NoError(t, err)
+
+		for i := 0; i < 2; i++ {
+			require.NoError(t, provider.Refresh())
+
+			m3u := provider.GetM3u()
+			assert.Contains(t, m3u, `tvg-id="bbc1.uk",UK: BBC One HD`)
+			assert.Contains(t, m3u, `tvg-id="skynews.uk" tvg-name="Sky News"`)
+			assert.Regexp(t, regexp.MustCompile(`tvg-id="skysports.uk",UK: Sky Sport Main Event`), m3u)
+
+			epgXML := readEPG(t, provider)
+			assert.Contains(t, epgXML, `<title>News</title>`)
+			assert.Contains(t, epgXML, `<title>Headlines</title>`)
+			assert.Contains(t, epgXML, `<title>Football</title>`)
+
+			report := provider.GetEPGMatchReport()
+			assert.Len(t, report.Matched, 3)
+			require.Len(t, report.Unmatched, 1)
+			assert.Equal(t, "Local Channel", report.Unmatched[0].Name)
+		}
+
+		// The unchanged guide was reused on the second refresh
+		assert.Equal(t, int64(1), atomic.LoadInt64(&epg.notModified))
+	})
+
+	t.Run("Suggest", func(t *testing.T) {
+		dir := t.TempDir()
+		epgPath := filepath.Join(dir, "epg.xml")
+		require.NoError(t, os.WriteFile(epgPath, []byte(testMatchEpgContent), 0644))
+
+		provider, err := NewProvider(newMatchConfig(t, epgPath, epgMatchSuggest))
+		require.NoError(t, err)
+		require.NoError(t, provider.Refresh())
+
+		assert.NotContains(t, provider.GetM3u(), `bbc1.uk`)
+		assert.NotContains(t, readEPG(t, provider), `<title>News</title>`)
+
+		report := provider.GetEPGMatchReport()
+		assert.Empty(t, report.Matched)
+		require.Len(t, report.Unmatched, 4)
+		require.NotEmpty(t, report.Unmatched[0].Suggestions)
+		assert.Equal(t, "bbc1.uk", report.Unmatched[0].Suggestions[0].ID)
+		assert.Equal(t, 100, report.Unmatched[0].Suggestions[0].Percent())
+		assert.Equal(t, "skynews.uk", report.Unmatched[1].Suggestions[0].ID)
+	})
+}
+
+func TestServerEPGMatchReport(t *testing.T) {
+	dir := t.TempDir()
+	epgPath := filepath.Join(dir, "epg.xml")
+	require.NoError(t, os.WriteFile(epgPath, []byte(testMatchEpgContent), 0644))
+
+	config := newMatchConfig(t, epgPath, epgMatchSuggest)
+	provider, err := NewProvider(config)
+	require.NoError(t, err)
+
+	server, err := NewServer(config, provider, "test")
+	require.NoError(t, err)
+	server.setupRoutes()
+
+	request := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		server.router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+
+	assert.Equal(t, http.StatusNotFound, request("/api/epg/unmatched").Code)
+	require.NoError(t, provider.Refresh())
+
+	w := request("/api/epg/unmatched")
+	require.Equal(t, http.StatusOK, w.Code)
+	var report epgMatchReport
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+	assert.Equal(t, epgMatchSuggest, report.Mode)
+	assert.Len(t, report.Unmatched, 4)
+
+	w = request("/epg-report")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "UK: BBC One HD")
+	assert.Contains(t, w.Body.String(), "bbc1.uk")
+}
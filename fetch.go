@@ -0,0 +1,475 @@
+package proxytv
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/csfrancis/proxytv/xmltv"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var errNotModified = errors.New("not modified")
+
+const (
+	fetchStatusFetched     = "fetched"
+	fetchStatusNotModified = "not modified"
+	fetchStatusError       = "error"
+	fetchStatusCached      = "cached"
+)
+
+// sourceState remembers the ETag and Last-Modified validators of a source's
+// last successful fetch, along with the data that was parsed from it, so an
+// unchanged source can be skipped on the next refresh.
+type sourceState struct {
+	lock sync.Mutex
+
+	name         string
+	kind         string
+	etag         string
+	lastModified string
+	lastFetch    time.Time
+	lastCheck    time.Time
+	lastStatus   string
+	lastError    string
+	attempts     int
+	notModified  int
+
+	pendingETag         string
+	pendingLastModified string
+
+	// The parsed playlist and guide are shared by every snapshot built from
+	// them, so they are never changed in place: the functions that transform
+	// a guide return a copy of the parts they change.
+	playlist    *playlistLoader
+	epg         *xmltv.TV
+	epgChannels string
+	epgIndex    []epgIndexEntry
+}
+
+type sourceStatus struct {
+	Name             string    `json:"name"`
+	Kind             string    `json:"kind"`
+	LastStatus       string    `json:"lastStatus"`
+	LastFetch        time.Time `json:"lastFetch"`
+	LastCheck        time.Time `json:"lastCheck"`
+	NotModifiedCount int       `json:"notModifiedCount"`
+	Attempts         int       `json:"attempts"`
+	LastError        string    `json:"lastError,omitempty"`
+	ETag             string    `json:"etag,omitempty"`
+	LastModified     string    `json:"lastModified,omitempty"`
+}
+
+func newSourceState(kind string, name string) *sourceState {
+	return &sourceState{kind: kind, name: name}
+}
+
+func (s *sourceState) setPending(etag string, lastModified string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.pendingETag = etag
+	s.pendingLastModified = lastModified
+}
+
+func (s *sourceState) validators() (string, string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.etag, s.lastModified
+}
+
+// fetched records a successful fetch, promoting the validators of the response
+// that was just parsed.
+func (s *sourceState) fetched() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.etag = s.pendingETag
+	s.lastModified = s.pendingLastModified
+	s.lastFetch = time.Now()
+	s.lastCheck = s.lastFetch
+	s.lastStatus = fetchStatusFetched
+	s.lastError = ""
+}
+
+// restore sets the validators and fetch time of data loaded from the cache.
+func (s *sourceState) restore(etag string, lastModified string, fetchedAt time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.etag = etag
+	s.lastModified = lastModified
+	s.lastFetch = fetchedAt
+	s.lastStatus = fetchStatusCached
+}
+
+func (s *sourceState) skipped() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.lastCheck = time.Now()
+	s.lastStatus = fetchStatusNotModified
+	s.lastError = ""
+	s.notModified++
+}
+
+// attempted records the number of attempts made by the latest fetch.
+func (s *sourceState) attempted(attempts int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.attempts = attempts
+}
+
+func (s *sourceState) failed(err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.lastCheck = time.Now()
+	s.lastStatus = fetchStatusError
+	s.lastError = err.Error()
+}
+
+func (s *sourceState) status() sourceStatus {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return sourceStatus{
+		Name:             s.name,
+		Kind:             s.kind,
+		LastStatus:       s.lastStatus,
+		LastFetch:        s.lastFetch,
+		LastCheck:        s.lastCheck,
+		NotModifiedCount: s.notModified,
+		Attempts:         s.attempts,
+		LastError:        s.lastError,
+		ETag:             s.etag,
+		LastModified:     s.lastModified,
+	}
+}
+
+// channelSetKey returns a digest of a set of channel ids, used to tell whether
+// a cached EPG was filtered with the same channels.
+func channelSetKey(channels map[string]bool) string {
+	ids := make([]string, 0, len(channels))
+	for id := range channels {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	h := sha1.New()
+	for _, id := range ids {
+		io.WriteString(h, id)
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// fetchMetrics counts fetch attempts and their outcomes across all sources.
+type fetchMetrics struct {
+	Requests    int64 `json:"requests"`
+	Attempts    int64 `json:"attempts"`
+	Retries     int64 `json:"retries"`
+	Fetched     int64 `json:"fetched"`
+	NotModified int64 `json:"notModified"`
+	Failures    int64 `json:"failures"`
+	Timeouts    int64 `json:"timeouts"`
+}
+
+var errReadTimeout = errors.New("read timeout")
+
+type httpStatusError struct {
+	code int
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("invalid url response code: %d", e.code)
+}
+
+// fetcher loads playlists and guides from URLs and files. HTTP requests are
+// bounded by connect and read timeouts, and transient failures are retried
+// with exponential backoff and jitter.
+type fetcher struct {
+	config  FetchConfig
+	client  *http.Client
+	metrics fetchMetrics
+}
+
+func newFetcher(config FetchConfig) *fetcher {
+	if config.Attempts < 1 {
+		config.Attempts = 1
+	}
+
+	return &fetcher{
+		config: config,
+		client: &http.Client{Transport: newTransport(config.ConnectTimeout, config.ReadTimeout)},
+	}
+}
+
+// newTransport returns a transport that gives up connecting after
+// connectTimeout, and waiting for the response headers after headerTimeout.
+func newTransport(connectTimeout time.Duration, headerTimeout time.Duration) *http.Transport {
+	dialer := &net.Dialer{Timeout: connectTimeout, KeepAlive: 30 * time.Second}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	transport.TLSHandshakeTimeout = connectTimeout
+	transport.ResponseHeaderTimeout = headerTimeout
+	return transport
+}
+
+func (f *fetcher) getMetrics() fetchMetrics {
+	return fetchMetrics{
+		Requests:    atomic.LoadInt64(&f.metrics.Requests),
+		Attempts:    atomic.LoadInt64(&f.metrics.Attempts),
+		Retries:     atomic.LoadInt64(&f.metrics.Retries),
+		Fetched:     atomic.LoadInt64(&f.metrics.Fetched),
+		NotModified: atomic.LoadInt64(&f.metrics.NotModified),
+		Failures:    atomic.LoadInt64(&f.metrics.Failures),
+		Timeouts:    atomic.LoadInt64(&f.metrics.Timeouts),
+	}
+}
+
+// backoff returns the delay before the given retry, doubling the configured
+// backoff for each retry up to the maximum. Half of the delay is randomized
+// so that sources failing together don't retry in lockstep.
+func (f *fetcher) backoff(retry int) time.Duration {
+	delay := f.config.Backoff
+	if delay <= 0 {
+		return 0
+	}
+	for i := 1; i < retry; i++ {
+		delay *= 2
+		if f.config.MaxBackoff > 0 && delay >= f.config.MaxBackoff {
+			delay = f.config.MaxBackoff
+			break
+		}
+	}
+	half := delay / 2
+	return half + rand.N(half+1)
+}
+
+// isRetryable reports whether a failed attempt may succeed if repeated:
+// connection errors, timeouts, truncated responses, 429 and 5xx responses.
+// Errors such as a malformed URL fail straight away.
+func isRetryable(err error) bool {
+	var statusErr *httpStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.code == http.StatusTooManyRequests || statusErr.code >= 500
+	}
+	var opErr *net.OpError
+	var dnsErr *net.DNSError
+	return os.IsTimeout(err) || errors.Is(err, errReadTimeout) || errors.As(err, &opErr) ||
+		errors.As(err, &dnsErr) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF)
+}
+
+func (f *fetcher) load(uri string, userAgent string) (io.ReadCloser, error) {
+	return f.loadConditional(uri, userAgent, nil, false)
+}
+
+// loadConditional opens a URL or file. The validators of the response
+// are recorded as pending on state, and when conditional is set the previous
+// validators are sent so an unchanged source returns errNotModified. Files
+// use their modification time as a validator.
+func (f *fetcher) loadConditional(uri string, userAgent string, state *sourceState, conditional bool) (io.ReadCloser, error) {
+	var etag, lastModified string
+	if state != nil && conditional {
+		etag, lastModified = state.validators()
+	}
+
+	if !isURL(uri) {
+		info, err := os.Stat(uri)
+		if err != nil {
+			return nil, err
+		}
+		modified := info.ModTime().UTC().Format(time.RFC3339Nano)
+		if lastModified != "" && lastModified == modified {
+			return nil, errNotModified
+		}
+		if state != nil {
+			state.setPending("", modified)
+		}
+
+		reader, err := os.Open(uri)
+		if err != nil {
+			return nil, err
+		}
+		return decompressReader(reader, uri, "")
+	}
+
+	atomic.AddInt64(&f.metrics.Requests, 1)
+	logger := log.WithField("uri", redactURL(uri))
+
+	var resp *http.Response
+	var err error
+	for attempt := 1; ; attempt++ {
+		start := time.Now()
+		atomic.AddInt64(&f.metrics.Attempts, 1)
+		resp, err = f.do(uri, userAgent, etag, lastModified)
+		fields := log.Fields{"attempt": attempt, "duration": time.Since(start)}
+		if state != nil {
+			state.attempted(attempt)
+		}
+		if err == nil {
+			logger.WithFields(fields).WithField("status", resp.StatusCode).Debug("fetch attempt succeeded")
+			break
+		}
+
+		if errors.Is(err, errReadTimeout) || os.IsTimeout(err) {
+			atomic.AddInt64(&f.metrics.Timeouts, 1)
+		}
+		if attempt >= f.config.Attempts || !isRetryable(err) {
+			atomic.AddInt64(&f.metrics.Failures, 1)
+			logger.WithFields(fields).WithError(err).Warn("fetch failed")
+			return nil, err
+		}
+
+		delay := f.backoff(attempt)
+		atomic.AddInt64(&f.metrics.Retries, 1)
+		logger.WithFields(fields).WithError(err).WithField("backoff", delay).Warn("fetch attempt failed, retrying")
+		time.Sleep(delay)
+	}
+
+	if resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+		atomic.AddInt64(&f.metrics.NotModified, 1)
+		return nil, errNotModified
+	}
+	atomic.AddInt64(&f.metrics.Fetched, 1)
+
+	if state != nil {
+		state.setPending(resp.Header.Get("ETag"), resp.Header.Get("Last-Modified"))
+	}
+
+	return decompressReader(resp.Body, uri, resp.Header.Get("Content-Encoding"))
+}
+
+// do makes a single request. The response body is closed if no data is read
+// from it for the read timeout.
+func (f *fetcher) do(uri string, userAgent string, etag string, lastModified string) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("unable to create request: %w", err)
+	}
+	if userAgent != "" {
+		req.Header.Set("User-Agent", userAgent)
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if lastModified != "" {
+		req.Header.Set("If-Modified-Since", lastModified)
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		cancel()
+		return nil, redactError(err)
+	}
+
+	notModified := resp.StatusCode == http.StatusNotModified && (etag != "" || lastModified != "")
+	if resp.StatusCode != http.StatusOK && !notModified {
+		resp.Body.Close()
+		cancel()
+		return nil, &httpStatusError{code: resp.StatusCode}
+	}
+
+	if f.config.ReadTimeout > 0 && !notModified {
+		resp.Body = newTimeoutBody(resp.Body, f.config.ReadTimeout, cancel)
+	} else {
+		resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+	}
+	return resp, nil
+}
+
+// xtreamPathRegexp matches the credentials in the path of an Xtream stream URL.
+var xtreamPathRegexp = regexp.MustCompile(`^(/(?:live|movie|series|timeshift))/[^/]+/[^/]+/`)
+
+// redactURL hides the password, query parameter values and Xtream stream
+// credentials of a URL for logging, since providers such as Xtream panels take
+// credentials in them.
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		raw, _, _ = strings.Cut(raw, "?")
+		return raw
+	}
+	if path := u.EscapedPath(); xtreamPathRegexp.MatchString(path) {
+		u.RawPath = xtreamPathRegexp.ReplaceAllString(path, "$1/xxxxx/xxxxx/")
+		u.Path, _ = url.PathUnescape(u.RawPath)
+	}
+	if u.RawQuery != "" {
+		query := u.Query()
+		for key := range query {
+			query[key] = []string{"xxxxx"}
+		}
+		u.RawQuery = query.Encode()
+	}
+	return u.Redacted()
+}
+
+// redactError redacts the URL of a request error, which is logged and shown in
+// the source status.
+func redactError(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		urlErr.URL = redactURL(urlErr.URL)
+	}
+	return err
+}
+
+// cancelBody releases the request context when the body is closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// timeoutBody cancels its request when a read doesn't return within the
+// timeout, so a stalled download fails instead of hanging the refresh.
+type timeoutBody struct {
+	body     io.ReadCloser
+	timeout  time.Duration
+	timer    *time.Timer
+	cancel   context.CancelFunc
+	timedOut atomic.Bool
+}
+
+func newTimeoutBody(body io.ReadCloser, timeout time.Duration, cancel context.CancelFunc) *timeoutBody {
+	b := &timeoutBody{body: body, timeout: timeout, cancel: cancel}
+	b.timer = time.AfterFunc(timeout, func() {
+		b.timedOut.Store(true)
+		cancel()
+	})
+	return b
+}
+
+func (b *timeoutBody) Read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+	if err != nil && b.timedOut.Load() {
+		return n, errReadTimeout
+	}
+	b.timer.Reset(b.timeout)
+	return n, err
+}
+
+func (b *timeoutBody) Close() error {
+	b.timer.Stop()
+	err := b.body.Close()
+	b.cancel()
+	return err
+}
@@ -0,0 +1,170 @@
+package proxytv
+
+import (
+	"encoding/xml"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The device is reported as an HDHomeRun CONNECT, which Plex, Jellyfin and
+// Emby all accept as a network tuner.
+const (
+	hdhrManufacturer    = "Silicondust"
+	hdhrModelNumber     = "HDTC-2US"
+	hdhrFirmwareName    = "hdhomeruntc_atsc"
+	hdhrFirmwareVersion = "20200101"
+	hdhrDeviceAuth      = "proxytv"
+)
+
+// hdhomerun emulates an HDHomeRun tuner whose channels are the tracks of the
+// main lineup, so that clients that can't read an M3U playlist can use it.
+type hdhomerun struct {
+	deviceID     string
+	friendlyName string
+	baseURL      string
+	tunerCount   int
+
+	// streamAddress and hlsOnly are those of the playlist, so that channels
+	// the server doesn't serve are played from the upstream
+	streamAddress string
+	hlsOnly       bool
+}
+
+func newHDHomeRun(config *Config) *hdhomerun {
+	if !config.HDHomeRun.Enabled {
+		return nil
+	}
+	deviceID := config.HDHomeRun.DeviceID
+	if deviceID == "" {
+		deviceID = strings.ToUpper(hashChannelKey(config.ServerAddress)[:8])
+	}
+	h := &hdhomerun{
+		deviceID:     deviceID,
+		friendlyName: config.HDHomeRun.FriendlyName,
+		baseURL:      "http://" + config.ServerAddress,
+		tunerCount:   config.MaxStreams,
+	}
+	if config.proxiesStreams() {
+		h.streamAddress = config.ServerAddress
+		h.hlsOnly = !config.UseFFMPEG && !config.Relay
+	}
+	return h
+}
+
+type hdhrDiscover struct {
+	FriendlyName    string
+	Manufacturer    string
+	ModelNumber     string
+	FirmwareName    string
+	FirmwareVersion string
+	DeviceID        string
+	DeviceAuth      string
+	BaseURL         string
+	LineupURL       string
+	TunerCount      int
+}
+
+func (h *hdhomerun) discover() hdhrDiscover {
+	return hdhrDiscover{
+		FriendlyName:    h.friendlyName,
+		Manufacturer:    hdhrManufacturer,
+		ModelNumber:     hdhrModelNumber,
+		FirmwareName:    hdhrFirmwareName,
+		FirmwareVersion: hdhrFirmwareVersion,
+		DeviceID:        h.deviceID,
+		DeviceAuth:      hdhrDeviceAuth,
+		BaseURL:         h.baseURL,
+		LineupURL:       h.baseURL + "/lineup.json",
+		TunerCount:      h.tunerCount,
+	}
+}
+
+type hdhrLineupStatus struct {
+	ScanInProgress int
+	ScanPossible   int
+	Source         string
+	SourceList     []string
+}
+
+type hdhrLineupEntry struct {
+	GuideNumber string
+	GuideName   string
+	URL         string
+}
+
+// lineup lists the tracks as channels, at the same URLs as the playlist.
+// Tracks without a tvg-chno are numbered by their position in the playlist.
+func (h *hdhomerun) lineup(tracks []Track) []hdhrLineupEntry {
+	entries := make([]hdhrLineupEntry, 0, len(tracks))
+	for i := range tracks {
+		number := tracks[i].Tags["tvg-chno"]
+		if number == "" {
+			number = strconv.Itoa(i + 1)
+		}
+		entries = append(entries, hdhrLineupEntry{
+			GuideNumber: number,
+			GuideName:   tracks[i].Name,
+			URL:         streamURL(&tracks[i], h.streamAddress, h.hlsOnly),
+		})
+	}
+	return entries
+}
+
+type hdhrDeviceXML struct {
+	XMLName     xml.Name `xml:"urn:schemas-upnp-org:device-1-0 root"`
+	SpecVersion struct {
+		Major int `xml:"major"`
+		Minor int `xml:"minor"`
+	} `xml:"specVersion"`
+	URLBase string `xml:"URLBase"`
+	Device  struct {
+		DeviceType   string `xml:"deviceType"`
+		FriendlyName string `xml:"friendlyName"`
+		Manufacturer string `xml:"manufacturer"`
+		ModelName    string `xml:"modelName"`
+		ModelNumber  string `xml:"modelNumber"`
+		SerialNumber string `xml:"serialNumber"`
+		UDN          string `xml:"UDN"`
+	} `xml:"device"`
+}
+
+func (h *hdhomerun) deviceXML() hdhrDeviceXML {
+	var d hdhrDeviceXML
+	d.SpecVersion.Major = 1
+	d.URLBase = h.baseURL
+	d.Device.DeviceType = "urn:schemas-upnp-org:device:MediaServer:1"
+	d.Device.FriendlyName = h.friendlyName
+	d.Device.Manufacturer = hdhrManufacturer
+	d.Device.ModelName = hdhrModelNumber
+	d.Device.ModelNumber = hdhrModelNumber
+	d.Device.SerialNumber = h.deviceID
+	d.Device.UDN = "uuid:" + h.deviceID
+	return d
+}
+
+func (s *Server) setupHDHomeRunRoutes() {
+	h := s.hdhr
+	s.router.GET("/discover.json", func(c *gin.Context) {
+		c.JSON(http.StatusOK, h.discover())
+	})
+	s.router.GET("/lineup_status.json", func(c *gin.Context) {
+		c.JSON(http.StatusOK, hdhrLineupStatus{
+			ScanPossible: 1,
+			Source:       "Cable",
+			SourceList:   []string{"Cable"},
+		})
+	})
+	s.router.GET("/lineup.json", func(c *gin.Context) {
+		c.JSON(http.StatusOK, h.lineup(s.provider.GetTracks()))
+	})
+	// Clients ask the tuner to rescan its channels, which is done by refreshes
+	s.router.POST("/lineup.post", func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+	s.router.GET("/device.xml", func(c *gin.Context) {
+		c.XML(http.StatusOK, h.deviceXML())
+	})
+}
@@ -0,0 +1,182 @@
+package proxytv
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHDHomeRun(t *testing.T) {
+	m3uFile, err := createTempFile(testM3uContent, "test*.m3u")
+	require.NoError(t, err)
+	defer os.Remove(m3uFile.Name())
+	epgFile, err := createTempFile(testEpgContent, "test*.xml")
+	require.NoError(t, err)
+	defer os.Remove(epgFile.Name())
+
+	config := &Config{
+		IPTVUrl:       m3uFile.Name(),
+		EPGUrl:        epgFile.Name(),
+		ServerAddress: "proxytv:6078",
+		MaxStreams:    2,
+		Filters:       []*Filter{{Type: "id", Value: ".*"}},
+		HDHomeRun:     HDHomeRunConfig{Enabled: true, DeviceID: "1234ABCD", FriendlyName: "ProxyTV"},
+	}
+	require.NoError(t, config.compileFilterRegexps())
+
+	provider, err := NewProvider(config)
+	require.NoError(t, err)
+	require.NoError(t, provider.Refresh())
+
+	server, err := NewServer(config, provider, "test")
+	require.NoError(t, err)
+	server.setupRoutes()
+
+	request := func(method string, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		server.router.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+		return w
+	}
+
+	t.Run("Discover", func(t *testing.T) {
+		w := request(http.MethodGet, "/discover.json")
+		require.Equal(t, http.StatusOK, w.Code)
+		var discover hdhrDiscover
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &discover))
+		assert.Equal(t, "1234ABCD", discover.DeviceID)
+		assert.Equal(t, "ProxyTV", discover.FriendlyName)
+		assert.Equal(t, "http://proxytv:6078", discover.BaseURL)
+		assert.Equal(t, "http://proxytv:6078/lineup.json", discover.LineupURL)
+		assert.Equal(t, 2, discover.TunerCount)
+	})
+
+	t.Run("Lineup status", func(t *testing.T) {
+		w := request(http.MethodGet, "/lineup_status.json")
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.JSONEq(t, `{"ScanInProgress":0,"ScanPossible":1,"Source":"Cable","SourceList":["Cable"]}`, w.Body.String())
+		assert.Equal(t, http.StatusOK, request(http.MethodPost, "/lineup.post?scan=start").Code)
+	})
+
+	t.Run("Lineup", func(t *testing.T) {
+		w := request(http.MethodGet, "/lineup.json")
+		require.Equal(t, http.StatusOK, w.Code)
+		var lineup []hdhrLineupEntry
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &lineup))
+		tracks := provider.GetTracks()
+		require.Len(t, lineup, len(tracks))
+		assert.Equal(t, hdhrLineupEntry{
+			GuideNumber: "1",
+			GuideName:   tracks[0].Name,
+			URL:         tracks[0].URI.String(),
+		}, lineup[0])
+		assert.Equal(t, "2", lineup[1].GuideNumber)
+	})
+
+	t.Run("Device", func(t *testing.T) {
+		w := request(http.MethodGet, "/device.xml")
+		require.Equal(t, http.StatusOK, w.Code)
+		var device hdhrDeviceXML
+		require.NoError(t, xml.Unmarshal(w.Body.Bytes(), &device))
+		assert.Equal(t, "uuid:1234ABCD", device.Device.UDN)
+		assert.Equal(t, "ProxyTV", device.Device.FriendlyName)
+		assert.Equal(t, "http://proxytv:6078", device.URLBase)
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		server, err := NewServer(&Config{}, provider, "test")
+		require.NoError(t, err)
+		server.setupRoutes()
+		w := httptest.NewRecorder()
+		server.router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/discover.json", nil))
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+}
+
+func TestHDHomeRunLineupNumbers(t *testing.T) {
+	h := newHDHomeRun(&Config{ServerAddress: "proxytv", Relay: true, HDHomeRun: HDHomeRunConfig{Enabled: true}})
+	assert.Regexp(t, `^[0-9A-F]{8}$`, h.deviceID)
+
+	lineup := h.lineup([]Track{
+		{ID: "a", Name: "A", Tags: map[string]string{"tvg-chno": "101"}},
+		{ID: "b", Name: "B", Tags: map[string]string{}},
+	})
+	assert.Equal(t, "101", lineup[0].GuideNumber)
+	assert.Equal(t, "2", lineup[1].GuideNumber)
+	assert.Equal(t, "http://proxytv/channel/b", lineup[1].URL)
+}
+
+func TestHDHomeRunLineupURLs(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("stream"))
+	}))
+	defer upstream.Close()
+
+	dir := t.TempDir()
+	m3uPath := filepath.Join(dir, "iptv.m3u")
+	require.NoError(t, os.WriteFile(m3uPath, []byte(fmt.Sprintf("#EXTM3U\n#EXTINF:-1 tvg-id=\"id1\",Channel 1\n%s/stream.ts", upstream.URL)), 0644))
+	epgPath := filepath.Join(dir, "epg.xml")
+	require.NoError(t, os.WriteFile(epgPath, []byte(testEpgContent), 0644))
+
+	tests := []struct {
+		name     string
+		relay    bool
+		upstream bool
+	}{
+		{name: "Relayed", relay: true},
+		{name: "Not proxied", upstream: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &Config{
+				IPTVUrl:       m3uPath,
+				EPGUrl:        epgPath,
+				ServerAddress: "proxytv:6078",
+				Relay:         tt.relay,
+				MaxStreams:    1,
+				Filters:       []*Filter{{Type: "id", Value: ".*"}},
+				Stream:        StreamConfig{StartTimeout: time.Second, StallTimeout: time.Second},
+				HDHomeRun:     HDHomeRunConfig{Enabled: true},
+			}
+			require.NoError(t, config.compileFilterRegexps())
+			provider, err := NewProvider(config)
+			require.NoError(t, err)
+			require.NoError(t, provider.Refresh())
+			server, err := NewServer(config, provider, "test")
+			require.NoError(t, err)
+			server.setupRoutes()
+			proxy := httptest.NewServer(server.router)
+			defer proxy.Close()
+
+			resp, err := http.Get(proxy.URL + "/lineup.json")
+			require.NoError(t, err)
+			var lineup []hdhrLineupEntry
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&lineup))
+			resp.Body.Close()
+			require.Len(t, lineup, 1)
+			if tt.upstream {
+				assert.Equal(t, upstream.URL+"/stream.ts", lineup[0].URL)
+			}
+
+			// Every advertised URL plays the channel
+			resp, err = http.Get(strings.Replace(lineup[0].URL, "http://proxytv:6078", proxy.URL, 1))
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			assert.Equal(t, "stream", string(body))
+		})
+	}
+}
@@ -0,0 +1,423 @@
+package proxytv
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	hlsURIPrefix       = "/hls/"
+	hlsContentType     = "application/vnd.apple.mpegurl"
+	hlsMaxPlaylistSize = 4 << 20
+
+	hlsVariantHighest = "highest"
+	hlsVariantLowest  = "lowest"
+)
+
+var (
+	hlsURIAttrRegexp   = regexp.MustCompile(`URI="([^"]*)"`)
+	hlsBandwidthRegexp = regexp.MustCompile(`[:,]BANDWIDTH=(\d+)`)
+)
+
+// isHLS reports whether u points at an HLS playlist.
+func isHLS(u *url.URL) bool {
+	return u != nil && strings.HasSuffix(strings.ToLower(u.Path), ".m3u8")
+}
+
+// hlsRelay serves HLS channels as HLS. Playlists are fetched from the upstream
+// and their URIs replaced with opaque tokens under /hls/, so that clients
+// fetch variants and segments through the server. Each request for a
+// channel's playlist starts a session, identified by the token in the URIs of
+// the playlist it's served. A session counts as a single stream and ends once
+// its client stops making requests.
+type hlsRelay struct {
+	opener  *httpOpener
+	variant string
+	timeout time.Duration
+
+	lock     sync.Mutex
+	sessions map[string]*hlsSession
+}
+
+type hlsSession struct {
+	id        string
+	channelID string
+	track     *Track
+	start     time.Time
+	lastSeen  time.Time
+	timer     *time.Timer
+	logger    *log.Entry
+
+	// tokens maps tokens to upstream URLs, and urls maps them back
+	tokens map[string]string
+	urls   map[string]string
+
+	// uris are the URLs in the latest version of each playlist, and refs
+	// counts the playlists each URL is in. A URL's token is dropped once no
+	// playlist has it, so that live playlists don't grow the maps forever.
+	uris map[string][]string
+	refs map[string]int
+}
+
+func newHLSRelay(config *Config) *hlsRelay {
+	if !config.HLS.Enabled {
+		return nil
+	}
+	return &hlsRelay{
+		opener:   newHTTPOpener(config),
+		variant:  config.HLS.Variant,
+		timeout:  config.HLS.SessionTimeout,
+		sessions: make(map[string]*hlsSession),
+	}
+}
+
+func randomToken(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func newHLSSession(client string, channelID string) *hlsSession {
+	session := &hlsSession{
+		id:        randomToken(16),
+		channelID: channelID,
+		start:     time.Now(),
+		lastSeen:  time.Now(),
+		tokens:    make(map[string]string),
+		urls:      make(map[string]string),
+		uris:      make(map[string][]string),
+		refs:      make(map[string]int),
+	}
+	session.logger = log.WithFields(log.Fields{
+		"channelId": channelID,
+		"clientIP":  client,
+		"session":   session.id,
+	})
+	return session
+}
+
+// add publishes a session, so that the URIs of its playlists are served.
+func (r *hlsRelay) add(session *hlsSession) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.sessions[session.id] = session
+}
+
+// remove ends a session. It returns false if the session was already ended.
+func (r *hlsRelay) remove(session *hlsSession) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.sessions[session.id] != session {
+		return false
+	}
+	delete(r.sessions, session.id)
+	return true
+}
+
+// expired reports whether a session has been idle for the timeout, and
+// otherwise returns how long is left until it will have been.
+func (r *hlsRelay) expired(session *hlsSession) (bool, time.Duration) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	idle := time.Since(session.lastSeen)
+	return idle >= r.timeout, r.timeout - idle
+}
+
+// resolve returns the session of a token, the variant the session streams
+// and the upstream URL of the token.
+func (r *hlsRelay) resolve(sessionID string, token string) (*hlsSession, *Track, string, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	session, ok := r.sessions[sessionID]
+	if !ok {
+		return nil, nil, "", false
+	}
+	rawURL, ok := session.tokens[strings.TrimSuffix(token, path.Ext(token))]
+	if !ok {
+		return nil, nil, "", false
+	}
+	session.lastSeen = time.Now()
+	return session, session.track, rawURL, true
+}
+
+// watch calls expire once the session has been idle for the timeout. The
+// timer is set under the lock, which expired takes before the timer is reset.
+func (r *hlsRelay) watch(session *hlsSession, expire func()) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	session.timer = time.AfterFunc(r.timeout, expire)
+}
+
+// setTrack sets the variant a session streams.
+func (r *hlsRelay) setTrack(session *hlsSession, track *Track) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	session.track = track
+}
+
+// uri returns the path that serves an upstream URL in the session. The path
+// keeps the extension of the URL, for clients that look at it. The relay's
+// lock must be held.
+func (session *hlsSession) uri(rawURL string) string {
+	token, ok := session.urls[rawURL]
+	if !ok {
+		token = randomToken(8)
+		session.urls[rawURL] = token
+		session.tokens[token] = rawURL
+	}
+	var ext string
+	if u, err := url.Parse(rawURL); err == nil {
+		ext = path.Ext(u.Path)
+	}
+	return hlsURIPrefix + session.id + "/" + token + ext
+}
+
+// retain records the URLs of the latest version of a playlist, and drops the
+// tokens of the URLs that no playlist has any more. The relay's lock must be
+// held.
+func (session *hlsSession) retain(playlistURL string, uris []string) {
+	for _, rawURL := range uris {
+		session.refs[rawURL]++
+	}
+	for _, rawURL := range session.uris[playlistURL] {
+		if session.refs[rawURL]--; session.refs[rawURL] > 0 {
+			continue
+		}
+		delete(session.refs, rawURL)
+		delete(session.tokens, session.urls[rawURL])
+		delete(session.urls, rawURL)
+	}
+	session.uris[playlistURL] = uris
+}
+
+// playlist reads a playlist fetched from playlistURL and rewrites it for a
+// session.
+func (r *hlsRelay) playlist(session *hlsSession, playlistURL string, resp *http.Response) ([]byte, error) {
+	body, err := io.ReadAll(io.LimitReader(resp.Body, hlsMaxPlaylistSize))
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(strings.TrimSpace(string(body)), "#EXTM3U") {
+		return nil, errors.New("not an hls playlist")
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var uris []string
+	playlist := rewriteHLSPlaylist(body, resp.Request.URL, r.variant, func(rawURL string) string {
+		uris = append(uris, rawURL)
+		return session.uri(rawURL)
+	})
+	session.retain(playlistURL, uris)
+	return playlist, nil
+}
+
+// isHLSResponse reports whether an upstream response is a playlist.
+func isHLSResponse(resp *http.Response) bool {
+	return strings.Contains(strings.ToLower(resp.Header.Get("Content-Type")), "mpegurl") || isHLS(resp.Request.URL)
+}
+
+// rewriteHLSPlaylist replaces the URIs of a playlist fetched from base with
+// the result of uri, called with the resolved URIs. When variant is set, a
+// master playlist is restricted to its highest or lowest bandwidth variant.
+func rewriteHLSPlaylist(playlist []byte, base *url.URL, variant string, uri func(string) string) []byte {
+	resolve := func(ref string) string {
+		u, err := base.Parse(ref)
+		if err != nil {
+			return ref
+		}
+		return uri(u.String())
+	}
+
+	lines := strings.Split(string(playlist), "\n")
+	for i := range lines {
+		lines[i] = strings.TrimSpace(lines[i])
+	}
+	keep := selectHLSVariant(lines, variant)
+
+	var b strings.Builder
+	skipURI := false
+	for i, line := range lines {
+		switch {
+		case keep >= 0 && strings.HasPrefix(line, "#EXT-X-STREAM-INF:") && i != keep:
+			skipURI = true
+			continue
+		case keep >= 0 && strings.HasPrefix(line, "#EXT-X-I-FRAME-STREAM-INF:"):
+			continue
+		case strings.HasPrefix(line, "#"):
+			line = hlsURIAttrRegexp.ReplaceAllStringFunc(line, func(attr string) string {
+				return `URI="` + resolve(hlsURIAttrRegexp.FindStringSubmatch(attr)[1]) + `"`
+			})
+		case line == "":
+			if i == len(lines)-1 {
+				continue
+			}
+		case skipURI:
+			skipURI = false
+			continue
+		default:
+			line = resolve(line)
+		}
+		b.WriteString(line + "\n")
+	}
+	return []byte(b.String())
+}
+
+// selectHLSVariant returns the index of the EXT-X-STREAM-INF line of the
+// variant to keep, or -1 to keep them all. The lines must be trimmed.
+func selectHLSVariant(lines []string, variant string) int {
+	if variant == "" {
+		return -1
+	}
+	keep, best := -1, 0
+	for i, line := range lines {
+		if !strings.HasPrefix(line, "#EXT-X-STREAM-INF:") {
+			continue
+		}
+		var bandwidth int
+		if m := hlsBandwidthRegexp.FindStringSubmatch(line); m != nil {
+			bandwidth, _ = strconv.Atoi(m[1])
+		}
+		if keep < 0 || (variant == hlsVariantHighest && bandwidth > best) || (variant == hlsVariantLowest && bandwidth < best) {
+			keep, best = i, bandwidth
+		}
+	}
+	return keep
+}
+
+// serveHLS serves the playlist of an HLS channel in a new session. The session
+// is only published once it holds a stream and its playlist has loaded, so
+// that its URIs are never served for a session that fails to start.
+func (s *Server) serveHLS(c *gin.Context, track *Track, channelID string) {
+	if !s.acquireStream(channelID) {
+		c.String(http.StatusTooManyRequests, "Too many requests")
+		return
+	}
+	session := newHLSSession(c.ClientIP(), channelID)
+
+	playlist, variant, err := s.loadHLSPlaylist(c, session, track)
+	if err != nil {
+		s.streamsSem.Release(1)
+		c.String(http.StatusBadGateway, "Unable to start stream")
+		return
+	}
+	s.hls.add(session)
+	s.startHLSSession(c, session, variant)
+
+	c.Header("Cache-Control", "no-cache")
+	c.Data(http.StatusOK, hlsContentType, playlist)
+}
+
+// loadHLSPlaylist loads the playlist of the first variant of a channel that
+// loads, and returns it with the variant.
+func (s *Server) loadHLSPlaylist(c *gin.Context, session *hlsSession, track *Track) ([]byte, *Track, error) {
+	var err error
+	for _, variant := range append([]Track{*track}, track.Alternates...) {
+		var resp *http.Response
+		resp, err = s.hls.opener.get(c.Request.Context(), &variant, variant.URI.String())
+		if err == nil {
+			s.hls.setTrack(session, &variant)
+			var playlist []byte
+			playlist, err = s.hls.playlist(session, variant.URI.String(), resp)
+			resp.Body.Close()
+			if err == nil {
+				return playlist, &variant, nil
+			}
+		}
+		log.WithError(err).WithFields(log.Fields{
+			"url":       redactURL(variant.URI.String()),
+			"channelId": session.channelID,
+		}).Warn("unable to load hls playlist")
+	}
+	return nil, nil, err
+}
+
+// startHLSSession counts a new session as an active stream until it expires.
+func (s *Server) startHLSSession(c *gin.Context, session *hlsSession, track *Track) {
+	info := newStreamInfo(c.Request, session.channelID)
+	info.Name = track.Name
+	info.LogoURL = track.Tags["tvg-logo"]
+
+	logger := session.logger.WithField("url", redactURL(track.URI.String()))
+	if track.Source != nil {
+		logger = logger.WithField("source", track.Source.Name)
+	}
+	logger.Info("relaying hls stream")
+
+	s.lock.Lock()
+	s.streams[session] = info
+	s.lock.Unlock()
+	atomic.AddInt64(&s.totalStreams, 1)
+
+	s.hls.watch(session, func() { s.expireHLSSession(session) })
+}
+
+// expireHLSSession ends a session that has been idle for the timeout, or
+// checks it again once it could have been.
+func (s *Server) expireHLSSession(session *hlsSession) {
+	if expired, left := s.hls.expired(session); !expired {
+		session.timer.Reset(left)
+		return
+	}
+	if !s.hls.remove(session) {
+		return
+	}
+
+	s.lock.Lock()
+	delete(s.streams, session)
+	s.lock.Unlock()
+	s.streamsSem.Release(1)
+
+	session.logger.WithField("duration", time.Since(session.start)).Info("stopped streaming")
+}
+
+// relayHLS serves the playlists and segments of HLS sessions.
+func (s *Server) relayHLS() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		session, track, rawURL, ok := s.hls.resolve(c.Param("session"), c.Param("token"))
+		if !ok {
+			c.String(http.StatusNotFound, "Stream not found")
+			return
+		}
+
+		resp, err := s.hls.opener.get(c.Request.Context(), track, rawURL)
+		if err != nil {
+			if c.Request.Context().Err() == nil {
+				session.logger.WithError(err).WithField("url", redactURL(rawURL)).Warn("unable to fetch hls uri")
+			}
+			c.String(http.StatusBadGateway, "Unable to fetch stream")
+			return
+		}
+		defer resp.Body.Close()
+
+		if !isHLSResponse(resp) {
+			c.DataFromReader(http.StatusOK, resp.ContentLength, resp.Header.Get("Content-Type"), resp.Body, nil)
+			return
+		}
+
+		playlist, err := s.hls.playlist(session, rawURL, resp)
+		if err != nil {
+			session.logger.WithError(err).WithField("url", redactURL(rawURL)).Warn("unable to load hls playlist")
+			c.String(http.StatusBadGateway, "Unable to fetch stream")
+			return
+		}
+		c.Header("Cache-Control", "no-cache")
+		c.Data(http.StatusOK, hlsContentType, playlist)
+	}
+}
@@ -0,0 +1,282 @@
+package proxytv
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testHLSMaster = `#EXTM3U
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aac",NAME="English",URI="audio/en.m3u8"
+#EXT-X-STREAM-INF:BANDWIDTH=800000,AVERAGE-BANDWIDTH=9000000,AUDIO="aac"
+low/index.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=5000000,AUDIO="aac"
+http://cdn.example.com/high/index.m3u8?token=secret
+#EXT-X-I-FRAME-STREAM-INF:BANDWIDTH=100000,URI="iframes.m3u8"
+`
+
+func TestRewriteHLSPlaylist(t *testing.T) {
+	base := mustParseURL("http://example.com/live/master.m3u8")
+	uri := func(rawURL string) string { return "<" + rawURL + ">" }
+
+	tests := []struct {
+		name     string
+		playlist string
+		variant  string
+		expected string
+	}{
+		{
+			name:     "Master playlist",
+			playlist: testHLSMaster,
+			expected: `#EXTM3U
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aac",NAME="English",URI="<http://example.com/live/audio/en.m3u8>"
+#EXT-X-STREAM-INF:BANDWIDTH=800000,AVERAGE-BANDWIDTH=9000000,AUDIO="aac"
+<http://example.com/live/low/index.m3u8>
+#EXT-X-STREAM-INF:BANDWIDTH=5000000,AUDIO="aac"
+<http://cdn.example.com/high/index.m3u8?token=secret>
+#EXT-X-I-FRAME-STREAM-INF:BANDWIDTH=100000,URI="<http://example.com/live/iframes.m3u8>"
+`,
+		},
+		{
+			name:     "Highest variant",
+			playlist: testHLSMaster,
+			variant:  hlsVariantHighest,
+			expected: `#EXTM3U
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aac",NAME="English",URI="<http://example.com/live/audio/en.m3u8>"
+#EXT-X-STREAM-INF:BANDWIDTH=5000000,AUDIO="aac"
+<http://cdn.example.com/high/index.m3u8?token=secret>
+`,
+		},
+		{
+			name:     "Lowest variant",
+			playlist: testHLSMaster,
+			variant:  hlsVariantLowest,
+			expected: `#EXTM3U
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aac",NAME="English",URI="<http://example.com/live/audio/en.m3u8>"
+#EXT-X-STREAM-INF:BANDWIDTH=800000,AVERAGE-BANDWIDTH=9000000,AUDIO="aac"
+<http://example.com/live/low/index.m3u8>
+`,
+		},
+		{
+			name:     "CRLF and trailing whitespace",
+			playlist: "#EXTM3U\r\n  #EXT-X-STREAM-INF:BANDWIDTH=800000  \r\nlow.m3u8 \r\n\t#EXT-X-STREAM-INF:BANDWIDTH=5000000\r\nhigh.m3u8\r\n",
+			variant:  hlsVariantHighest,
+			expected: `#EXTM3U
+#EXT-X-STREAM-INF:BANDWIDTH=5000000
+<http://example.com/live/high.m3u8>
+`,
+		},
+		{
+			name:     "Media playlist",
+			playlist: "#EXTM3U\r\n#EXT-X-TARGETDURATION:6\r\n#EXT-X-KEY:METHOD=AES-128,URI=\"/keys/1\"\r\n#EXTINF:6.0,\r\nseg1.ts\r\n\r\n#EXTINF:6.0,\r\n../seg2.ts\r\n",
+			variant:  hlsVariantHighest,
+			expected: `#EXTM3U
+#EXT-X-TARGETDURATION:6
+#EXT-X-KEY:METHOD=AES-128,URI="<http://example.com/keys/1>"
+#EXTINF:6.0,
+<http://example.com/live/seg1.ts>
+
+#EXTINF:6.0,
+<http://example.com/seg2.ts>
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, string(rewriteHLSPlaylist([]byte(tt.playlist), base, tt.variant, uri)))
+		})
+	}
+}
+
+// newFakeHLSUpstream serves a master playlist with two variants, and a live
+// media playlist that moves on to the next segment each time it's fetched, to
+// clients with the expected user agent.
+func newFakeHLSUpstream(t *testing.T) *httptest.Server {
+	var sequence atomic.Int64
+	mux := http.NewServeMux()
+	mux.HandleFunc("/live/master.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", hlsContentType)
+		io.WriteString(w, "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=800000\nlow.m3u8\n#EXT-X-STREAM-INF:BANDWIDTH=5000000\nhigh.m3u8\n")
+	})
+	mux.HandleFunc("/live/high.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", hlsContentType)
+		fmt.Fprintf(w, "#EXTM3U\n#EXT-X-TARGETDURATION:6\n#EXTINF:6.0,\nseg%d.ts\n", sequence.Add(1))
+	})
+	mux.HandleFunc("/live/{segment}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "video/mp2t")
+		io.WriteString(w, "segment")
+	})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("User-Agent") != "hls-agent" {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestServerHLS(t *testing.T) {
+	upstream := newFakeHLSUpstream(t)
+
+	dir := t.TempDir()
+	m3uPath := filepath.Join(dir, "iptv.m3u")
+	require.NoError(t, os.WriteFile(m3uPath, []byte(fmt.Sprintf(`#EXTM3U
+#EXTINF:-1 tvg-id="id1",HLS Channel
+%[1]s/live/master.m3u8
+#EXTINF:-1 tvg-id="id2",TS Channel
+%[1]s/live/stream.ts`, upstream.URL)), 0644))
+	epgPath := filepath.Join(dir, "epg.xml")
+	require.NoError(t, os.WriteFile(epgPath, []byte(testEpgContent), 0644))
+
+	config := &Config{
+		IPTVUrl:       m3uPath,
+		EPGUrl:        epgPath,
+		ServerAddress: "proxytv:6078",
+		UserAgent:     "hls-agent",
+		MaxStreams:    2,
+		Filters:       []*Filter{{Type: "id", Value: ".*"}},
+		HLS:           HLSConfig{Enabled: true, Variant: hlsVariantHighest, SessionTimeout: 200 * time.Millisecond},
+	}
+	require.NoError(t, config.compileFilterRegexps())
+
+	provider, err := NewProvider(config)
+	require.NoError(t, err)
+	require.NoError(t, provider.Refresh())
+
+	// Without ffmpeg or the relay, only HLS channels are served by the server
+	tracks := provider.GetTracks()
+	require.Len(t, tracks, 2)
+	m3u := provider.GetM3u()
+	assert.Contains(t, m3u, "http://proxytv:6078"+channelURIPrefix+tracks[0].ID)
+	assert.Contains(t, m3u, upstream.URL+"/live/stream.ts")
+
+	server, err := NewServer(config, provider, "test")
+	require.NoError(t, err)
+	server.setupRoutes()
+
+	proxy := httptest.NewServer(server.router)
+	defer proxy.Close()
+
+	get := func(t *testing.T, path string) (int, string) {
+		resp, err := http.Get(proxy.URL + path)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(body)
+	}
+	// uris returns the URI lines of a playlist
+	uris := func(playlist string) []string {
+		var uris []string
+		for _, line := range strings.Split(strings.TrimSpace(playlist), "\n") {
+			if !strings.HasPrefix(line, "#") {
+				uris = append(uris, line)
+			}
+		}
+		return uris
+	}
+
+	code, master := get(t, channelURIPrefix+tracks[0].ID)
+	require.Equal(t, http.StatusOK, code)
+	assert.NotContains(t, master, upstream.URL)
+	assert.NotContains(t, master, "low")
+	variants := uris(master)
+	require.Len(t, variants, 1)
+	assert.Regexp(t, `^/hls/[0-9a-f]{32}/[0-9a-f]{16}\.m3u8$`, variants[0])
+
+	code, media := get(t, variants[0])
+	require.Equal(t, http.StatusOK, code)
+	segments := uris(media)
+	require.Len(t, segments, 1)
+	assert.True(t, strings.HasSuffix(segments[0], ".ts"))
+
+	code, segment := get(t, segments[0])
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "segment", segment)
+
+	// Segments that have left the live playlist are no longer served
+	code, media = get(t, variants[0])
+	require.Equal(t, http.StatusOK, code)
+	segments = append(uris(media), segments...)
+	require.Len(t, segments, 2)
+	assert.NotEqual(t, segments[1], segments[0])
+	code, _ = get(t, segments[1])
+	assert.Equal(t, http.StatusNotFound, code)
+	code, _ = get(t, segments[0])
+	assert.Equal(t, http.StatusOK, code)
+
+	// The session counts as one stream, and another request for the channel
+	// from the same address starts a session of its own
+	active := server.getActiveStreams()
+	require.Len(t, active, 1)
+	assert.Equal(t, "HLS Channel", active[0].Name)
+	code, other := get(t, channelURIPrefix+tracks[0].ID)
+	require.Equal(t, http.StatusOK, code)
+	sessionOf := func(uri string) string { return strings.Split(uri, "/")[2] }
+	assert.NotEqual(t, sessionOf(variants[0]), sessionOf(uris(other)[0]))
+	assert.Len(t, server.getActiveStreams(), 2)
+	assert.False(t, server.streamsSem.TryAcquire(1))
+
+	code, _ = get(t, channelURIPrefix+tracks[1].ID)
+	assert.Equal(t, http.StatusNotFound, code)
+	code, _ = get(t, hlsURIPrefix+"unknown/token")
+	assert.Equal(t, http.StatusNotFound, code)
+
+	// The session ends once the client stops making requests
+	require.Eventually(t, func() bool { return len(server.getActiveStreams()) == 0 }, 2*time.Second, 20*time.Millisecond)
+	assert.True(t, server.streamsSem.TryAcquire(2))
+	server.streamsSem.Release(2)
+	code, _ = get(t, segments[0])
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
+func TestHLSRelaySessions(t *testing.T) {
+	relay := newHLSRelay(&Config{HLS: HLSConfig{Enabled: true}})
+
+	// Clients behind the same address get sessions of their own, whose URIs
+	// are only served once the session is added
+	first := newHLSSession("10.0.0.1", "channel")
+	second := newHLSSession("10.0.0.1", "channel")
+	relay.lock.Lock()
+	firstURI := first.uri("http://example.com/first.m3u8")
+	secondURI := second.uri("http://example.com/second.m3u8")
+	relay.lock.Unlock()
+	resolve := func(uri string) (*hlsSession, string, bool) {
+		parts := strings.Split(strings.TrimPrefix(uri, hlsURIPrefix), "/")
+		session, _, rawURL, ok := relay.resolve(parts[0], parts[1])
+		return session, rawURL, ok
+	}
+
+	_, _, ok := resolve(firstURI)
+	assert.False(t, ok)
+	relay.add(first)
+	relay.add(second)
+	session, rawURL, ok := resolve(firstURI)
+	require.True(t, ok)
+	assert.Same(t, first, session)
+	assert.Equal(t, "http://example.com/first.m3u8", rawURL)
+	session, rawURL, ok = resolve(secondURI)
+	require.True(t, ok)
+	assert.Same(t, second, session)
+	assert.Equal(t, "http://example.com/second.m3u8", rawURL)
+
+	assert.True(t, relay.remove(first))
+	assert.False(t, relay.remove(first))
+	_, _, ok = resolve(firstURI)
+	assert.False(t, ok)
+	_, _, ok = resolve(secondURI)
+	assert.True(t, ok)
+}
@@ -7,6 +7,7 @@ import (
 	"io"
 	"net/url"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -18,12 +19,18 @@ type m3uHandler interface {
 }
 
 type Track struct {
+	ID         string
 	Name       string
 	Length     float64
 	URI        *url.URL
 	Tags       map[string]string
 	Raw        string
 	LineNumber int
+	Source     *Source
+	Filter     *Filter
+
+	// Alternates are the other variants of the channel, best first
+	Alternates []Track
 }
 
 var errMalformedM3U = errors.New("malformed M3U provided")
@@ -116,3 +123,59 @@ func decodeInfoLine(line string) (float64, string, map[string]string, error) {
 
 	return durationFloat, title, keyMap, nil
 }
+
+// encodeInfoLine builds the EXTINF line of a track from its length, tags and
+// name. Attributes keep their order in the track's original line, and new
+// attributes are added after them in alphabetical order.
+func encodeInfoLine(t *Track) string {
+	var line strings.Builder
+	line.WriteString("#EXTINF:")
+	if t.Length > 0 {
+		line.WriteString(strconv.FormatFloat(t.Length, 'f', -1, 64))
+	} else {
+		line.WriteString("-1")
+	}
+
+	written := make(map[string]bool, len(t.Tags))
+	write := func(key string) {
+		value, ok := t.Tags[key]
+		if !ok || written[key] {
+			return
+		}
+		written[key] = true
+		fmt.Fprintf(&line, ` %s="%s"`, key, strings.ReplaceAll(value, `"`, "'"))
+	}
+
+	for _, match := range infoRegex.FindAllStringSubmatch(t.Raw, -1) {
+		if match[1] != "" {
+			write(strings.ToLower(match[1]))
+		}
+	}
+	keys := make([]string, 0, len(t.Tags))
+	for key := range t.Tags {
+		if !written[key] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		write(key)
+	}
+
+	line.WriteString(",")
+	line.WriteString(t.Name)
+	return line.String()
+}
+
+// setTag sets an attribute of the track and regenerates its EXTINF line to
+// match. The tags are copied first, since they are shared with the parsed
+// playlist.
+func (t *Track) setTag(key string, value string) {
+	tags := make(map[string]string, len(t.Tags)+1)
+	for k, v := range t.Tags {
+		tags[k] = v
+	}
+	tags[key] = value
+	t.Tags = tags
+	t.Raw = encodeInfoLine(t)
+}
@@ -105,3 +105,107 @@ func mustParseURL(s string) *url.URL {
 	u, _ := url.Parse(s)
 	return u
 }
+
+func TestTrackSetTag(t *testing.T) {
+	tests := []struct {
+		name     string
+		raw      string
+		key      string
+		value    string
+		expected string
+	}{
+		{
+			name:     "Replace",
+			raw:      `#EXTINF:-1 tvg-id="old" tvg-name="One",Channel One`,
+			key:      "tvg-id",
+			value:    "new",
+			expected: `#EXTINF:-1 tvg-id="new" tvg-name="One",Channel One`,
+		},
+		{
+			name:     "Insert",
+			raw:      `#EXTINF:-1 tvg-name="One, Two",Channel One`,
+			key:      "tvg-id",
+			value:    "new",
+			expected: `#EXTINF:-1 tvg-name="One, Two" tvg-id="new",Channel One`,
+		},
+		{
+			name:     "Similar attribute",
+			raw:      `#EXTINF:-1 xtvg-id="x",Channel One`,
+			key:      "tvg-id",
+			value:    "new",
+			expected: `#EXTINF:-1 xtvg-id="x" tvg-id="new",Channel One`,
+		},
+		{
+			name:     "Unquoted attribute",
+			raw:      `#EXTINF:-1 tvg-id="id1" tvg-chno=5,Channel One`,
+			key:      "tvg-chno",
+			value:    "7",
+			expected: `#EXTINF:-1 tvg-id="id1" tvg-chno="7",Channel One`,
+		},
+		{
+			name:     "Attribute in title",
+			raw:      `#EXTINF:-1 tvg-id="id1",Channel tvg-chno=5`,
+			key:      "tvg-chno",
+			value:    "7",
+			expected: `#EXTINF:-1 tvg-id="id1" tvg-chno="7",Channel tvg-chno=5`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			length, name, tags, err := decodeInfoLine(tt.raw)
+			assert.NoError(t, err)
+			track := &Track{Raw: tt.raw, Name: name, Length: length, Tags: tags}
+
+			track.setTag(tt.key, tt.value)
+			assert.Equal(t, tt.expected, track.Raw)
+			assert.Equal(t, tt.value, track.Tags[tt.key])
+
+			// The original tags are not modified
+			assert.NotEqual(t, tt.value, tags[tt.key])
+		})
+	}
+}
+
+func TestEncodeInfoLine(t *testing.T) {
+	tests := []struct {
+		name     string
+		raw      string
+		expected string
+	}{
+		{
+			name:     "Unchanged",
+			raw:      `#EXTINF:-1 tvg-id="id1" tvg-name="One" group-title="News",Channel One`,
+			expected: `#EXTINF:-1 tvg-id="id1" tvg-name="One" group-title="News",Channel One`,
+		},
+		{
+			name:     "Duration",
+			raw:      `#EXTINF:30 tvg-id="id1",Channel One`,
+			expected: `#EXTINF:30 tvg-id="id1",Channel One`,
+		},
+		{
+			name:     "Numeric attribute",
+			raw:      `#EXTINF:-1 tvg-id="id1" tvg-chno=5,Channel One`,
+			expected: `#EXTINF:-1 tvg-id="id1" tvg-chno="5",Channel One`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			track := &Track{Raw: tt.raw}
+			var err error
+			track.Length, track.Name, track.Tags, err = decodeInfoLine(tt.raw)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, encodeInfoLine(track))
+		})
+	}
+
+	t.Run("Changed tags", func(t *testing.T) {
+		track := &Track{
+			Name: "New Name",
+			Raw:  `#EXTINF:-1 tvg-id="id1" tvg-logo="old.png" group-title="News",Old Name`,
+			Tags: map[string]string{"tvg-id": "id1", "group-title": `"Top" News`, "tvg-logo": "new.png", "tvg-chno": "7", "catchup": "xc"},
+		}
+		assert.Equal(t, `#EXTINF:-1 tvg-id="id1" tvg-logo="new.png" group-title="'Top' News" catchup="xc" tvg-chno="7",New Name`, encodeInfoLine(track))
+	})
+}
@@ -0,0 +1,105 @@
+package proxytv
+
+import (
+	"github.com/csfrancis/proxytv/xmltv"
+)
+
+// trackOverride is a track that was changed by an override, with the name and
+// logo it was given, if any.
+type trackOverride struct {
+	index int
+	name  string
+	logo  string
+}
+
+// applyOverrides rewrites the tracks matching the configured overrides and
+// regenerates their EXTINF lines. Every override that matches the original
+// tvg-id or name of a track is applied, in order.
+func applyOverrides(tracks []Track, overrides []*Override) []trackOverride {
+	var changed []trackOverride
+	for i := range tracks {
+		track := &tracks[i]
+		tvgID, name := track.Tags["tvg-id"], track.Name
+
+		var tags map[string]string
+		result := trackOverride{index: i}
+		for _, override := range overrides {
+			if !override.matches(tvgID, name) {
+				continue
+			}
+			if tags == nil {
+				tags = make(map[string]string, len(track.Tags)+2)
+				for k, v := range track.Tags {
+					tags[k] = v
+				}
+			}
+
+			set := func(key string, value string) {
+				if value != "" {
+					tags[key] = value
+				}
+			}
+			if override.Name != "" {
+				track.Name = override.Name
+				result.name = override.Name
+				if _, ok := tags["tvg-name"]; ok {
+					tags["tvg-name"] = override.Name
+				}
+			}
+			if override.Logo != "" {
+				result.logo = override.Logo
+			}
+			set("tvg-logo", override.Logo)
+			set("group-title", override.Group)
+			set("tvg-chno", override.Chno)
+			set("tvg-id", override.EPGID)
+		}
+		if tags == nil {
+			continue
+		}
+
+		track.Tags = tags
+		track.Raw = encodeInfoLine(track)
+		changed = append(changed, result)
+	}
+	return changed
+}
+
+// overrideEPGChannels gives the guide channels of overridden tracks their new
+// name and logo.
+func overrideEPGChannels(tv *xmltv.TV, tracks []Track, changed []trackOverride) *xmltv.TV {
+	byID := make(map[string]trackOverride, len(changed))
+	for _, c := range changed {
+		if c.name == "" && c.logo == "" {
+			continue
+		}
+		id := tracks[c.index].Tags["tvg-id"]
+		if _, ok := byID[id]; !ok && id != "" {
+			byID[id] = c
+		}
+	}
+	if len(byID) == 0 {
+		return tv
+	}
+
+	out := *tv
+	out.Channels = make([]xmltv.Channel, len(tv.Channels))
+	for i, channel := range tv.Channels {
+		if c, ok := byID[channel.ID]; ok {
+			if c.name != "" {
+				names := []xmltv.CommonElement{{Value: c.name}}
+				for _, name := range channel.DisplayNames {
+					if name.Value != c.name {
+						names = append(names, name)
+					}
+				}
+				channel.DisplayNames = names
+			}
+			if c.logo != "" {
+				channel.Icons = []xmltv.Icon{{Source: c.logo}}
+			}
+		}
+		out.Channels[i] = channel
+	}
+	return &out
+}
@@ -0,0 +1,90 @@
+package proxytv
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/csfrancis/proxytv/xmltv"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApplyOverrides(t *testing.T) {
+	tags := map[string]string{"tvg-id": "bbc1", "tvg-name": "UK: BBC One HD", "group-title": "UK | Entertainment"}
+	tracks := []Track{
+		{Name: "UK: BBC One HD", Tags: tags, Raw: `#EXTINF:-1 tvg-id="bbc1" tvg-name="UK: BBC One HD" group-title="UK | Entertainment",UK: BBC One HD`},
+		{Name: "UK: ITV", Tags: map[string]string{"tvg-id": "itv"}, Raw: `#EXTINF:-1 tvg-id="itv",UK: ITV`},
+		{Name: "CNN", Tags: map[string]string{"tvg-id": "cnn"}, Raw: `#EXTINF:-1 tvg-id="cnn",CNN`},
+	}
+	overrides := []*Override{
+		{TvgID: "bbc1", Name: "BBC One", Logo: "http://logo/bbc1.png", Chno: "101", EPGID: "bbc1.uk"},
+		{Regex: "^UK: ", regexp: regexp.MustCompile("^UK: "), Group: "UK"},
+	}
+
+	changed := applyOverrides(tracks, overrides)
+	assert.Equal(t, []trackOverride{{index: 0, name: "BBC One", logo: "http://logo/bbc1.png"}, {index: 1}}, changed)
+
+	assert.Equal(t, "BBC One", tracks[0].Name)
+	assert.Equal(t, `#EXTINF:-1 tvg-id="bbc1.uk" tvg-name="BBC One" group-title="UK" tvg-chno="101" tvg-logo="http://logo/bbc1.png",BBC One`, tracks[0].Raw)
+	assert.Equal(t, `#EXTINF:-1 tvg-id="itv" group-title="UK",UK: ITV`, tracks[1].Raw)
+	assert.Equal(t, `#EXTINF:-1 tvg-id="cnn",CNN`, tracks[2].Raw)
+
+	// The parsed playlist's tags are left untouched
+	assert.Equal(t, "bbc1", tags["tvg-id"])
+
+	tv := &xmltv.TV{Channels: []xmltv.Channel{
+		{ID: "bbc1.uk", DisplayNames: []xmltv.CommonElement{{Value: "BBC 1"}, {Value: "BBC One"}}, Icons: []xmltv.Icon{{Source: "http://old.png"}}},
+		{ID: "itv", DisplayNames: []xmltv.CommonElement{{Value: "ITV"}}},
+	}}
+	out := overrideEPGChannels(tv, tracks, changed)
+	assert.Equal(t, []xmltv.CommonElement{{Value: "BBC One"}, {Value: "BBC 1"}}, out.Channels[0].DisplayNames)
+	assert.Equal(t, []xmltv.Icon{{Source: "http://logo/bbc1.png"}}, out.Channels[0].Icons)
+	assert.Equal(t, tv.Channels[1], out.Channels[1])
+	assert.Equal(t, "BBC 1", tv.Channels[0].DisplayNames[0].Value)
+
+	assert.Same(t, tv, overrideEPGChannels(tv, tracks, changed[1:]))
+}
+
+func TestProviderOverrides(t *testing.T) {
+	dir := t.TempDir()
+	m3uPath := filepath.Join(dir, "iptv.m3u")
+	require.NoError(t, os.WriteFile(m3uPath, []byte(`#EXTM3U
+#EXTINF:-1 tvg-id="id1" tvg-name="Channel 1" xui-id="{1}" group-title="Misc",Channel 1
+http://example.com/channel1
+#EXTINF:-1 tvg-id="id2" tvg-name="Channel 2",Channel 2
+http://example.com/channel2`), 0644))
+	epgPath := filepath.Join(dir, "epg.xml")
+	require.NoError(t, os.WriteFile(epgPath, []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<tv>
+<channel id="id1"><display-name>Channel 1</display-name><icon src="http://broken/1.png"></icon></channel>
+<channel id="id2"><display-name>Channel 2</display-name></channel>
+</tv>`), 0644))
+
+	config := &Config{
+		IPTVUrl:   m3uPath,
+		EPGUrl:    epgPath,
+		Filters:   []*Filter{{Type: "id", Value: ".*"}},
+		Overrides: []*Override{{TvgID: "id1", Name: "News", Logo: "http://logo/news.png", Group: "News"}},
+	}
+	require.NoError(t, config.compileFilterRegexps())
+	require.NoError(t, config.validateOverrides())
+
+	provider, err := NewProvider(config)
+	require.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		require.NoError(t, provider.Refresh())
+		assert.Equal(t, `#EXTM3U
+#EXTINF:-1 tvg-id="id1" tvg-name="News" group-title="News" tvg-logo="http://logo/news.png",News
+http://example.com/channel1
+#EXTINF:-1 tvg-id="id2" tvg-name="Channel 2",Channel 2
+http://example.com/channel2
+`, provider.GetM3u())
+		assert.Contains(t, readEPG(t, provider), `<channel id="id1"><display-name>News</display-name><display-name>Channel 1</display-name><icon src="http://logo/news.png"></icon></channel>`)
+	}
+
+	// Overrides don't change channel IDs
+	assert.Equal(t, hashChannelKey("id:id1"), provider.snapshot().tracks[0].ID)
+}
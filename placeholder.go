@@ -0,0 +1,136 @@
+package proxytv
+
+import (
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/csfrancis/proxytv/xmltv"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// placeholderData is the data the placeholder title template is executed with.
+type placeholderData struct {
+	Name   string
+	Group  string
+	TvgID  string
+	Number string
+}
+
+// placeholderEPG generates programme blocks for channels without guide data,
+// so that clients show them with a schedule instead of hiding them or showing
+// an empty row.
+type placeholderEPG struct {
+	blockLength time.Duration
+	days        int
+	title       *template.Template
+	location    *time.Location
+}
+
+func newPlaceholderEPG(config PlaceholderEPGConfig, loc *time.Location) *placeholderEPG {
+	if !config.Enabled {
+		return nil
+	}
+	if loc == nil {
+		loc = time.Local
+	}
+	return &placeholderEPG{
+		blockLength: config.BlockLength,
+		days:        config.Days,
+		title:       config.title,
+		location:    loc,
+	}
+}
+
+func (e *placeholderEPG) titleFor(track *Track) string {
+	if e.title == nil {
+		return track.Name
+	}
+	var title strings.Builder
+	err := e.title.Execute(&title, placeholderData{
+		Name:   track.Name,
+		Group:  track.Tags["group-title"],
+		TvgID:  track.Tags["tvg-id"],
+		Number: track.Tags["tvg-chno"],
+	})
+	if err != nil {
+		log.WithError(err).WithField("channel", track.Name).Warn("unable to execute placeholder title")
+		return track.Name
+	}
+	return title.String()
+}
+
+// blocks returns the start times of the blocks from midnight on the day of
+// now, followed by the end of the last block.
+func (e *placeholderEPG) blocks(now time.Time) []*xmltv.Time {
+	y, m, d := now.In(e.location).Date()
+	start := time.Date(y, m, d, 0, 0, 0, 0, e.location)
+	end := start.AddDate(0, 0, e.days)
+
+	var times []*xmltv.Time
+	for t := start; t.Before(end); t = t.Add(e.blockLength) {
+		times = append(times, &xmltv.Time{Time: t})
+	}
+	return append(times, &xmltv.Time{Time: end})
+}
+
+// add returns a copy of tv with a channel and programme blocks for each track
+// whose tvg-id has no programmes. Tracks without a tvg-id are given their
+// channel ID as one, so that the guide can refer to them. The ids of the
+// channels that were given placeholders are returned.
+func (e *placeholderEPG) add(tv *xmltv.TV, tracks []Track, covered map[string]bool, now time.Time) (*xmltv.TV, map[string]bool) {
+	placeholders := make(map[string]bool)
+	if e == nil {
+		return tv, placeholders
+	}
+
+	existing := make(map[string]bool, len(tv.Channels))
+	for i := range tv.Channels {
+		existing[tv.Channels[i].ID] = true
+	}
+
+	out := *tv
+	out.Channels = tv.Channels[:len(tv.Channels):len(tv.Channels)]
+	out.Programmes = tv.Programmes[:len(tv.Programmes):len(tv.Programmes)]
+
+	times := e.blocks(now)
+	for i := range tracks {
+		track := &tracks[i]
+		id := track.Tags["tvg-id"]
+		if id == "" {
+			id = track.ID
+			track.setTag("tvg-id", id)
+		}
+		if covered[id] || placeholders[id] {
+			continue
+		}
+		placeholders[id] = true
+
+		if !existing[id] {
+			channel := xmltv.Channel{
+				ID:           id,
+				DisplayNames: []xmltv.CommonElement{{Value: track.Name}},
+			}
+			if logo := track.Tags["tvg-logo"]; logo != "" {
+				channel.Icons = []xmltv.Icon{{Source: logo}}
+			}
+			out.Channels = append(out.Channels, channel)
+		}
+
+		title := []xmltv.CommonElement{{Value: e.titleFor(track)}}
+		for j := 0; j+1 < len(times); j++ {
+			out.Programmes = append(out.Programmes, xmltv.Programme{
+				Titles:  title,
+				Start:   times[j],
+				Stop:    times[j+1],
+				Channel: id,
+			})
+		}
+	}
+
+	if len(placeholders) > 0 {
+		log.WithField("channelCount", len(placeholders)).Debug("added placeholder EPG")
+	}
+	return &out, placeholders
+}
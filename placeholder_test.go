@@ -0,0 +1,107 @@
+package proxytv
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/csfrancis/proxytv/xmltv"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPlaceholderEPG(t *testing.T) {
+	config := PlaceholderEPGConfig{Enabled: true, BlockLengthStr: "6h", Days: 1, Title: "{{.Name}} ({{.Group}})"}
+	require.NoError(t, config.parse())
+
+	loc := time.FixedZone("EST", -5*60*60)
+	now := time.Date(2024, 1, 10, 15, 30, 0, 0, loc)
+	tv := &xmltv.TV{
+		Channels: []xmltv.Channel{{ID: "id1"}, {ID: "id2"}},
+		Programmes: []xmltv.Programme{
+			{Channel: "id1", Start: &xmltv.Time{Time: now}, Titles: []xmltv.CommonElement{{Value: "News"}}},
+		},
+	}
+	tracks := []Track{
+		{ID: "1", Name: "One", Tags: map[string]string{"tvg-id": "id1"}},
+		{ID: "2", Name: "Two", Tags: map[string]string{"tvg-id": "id2", "group-title": "Sports"}},
+		{ID: "3", Name: "Three", Tags: map[string]string{"tvg-id": "id3", "tvg-logo": "http://logo/3.png"}},
+		{ID: "4", Name: "Four", Tags: map[string]string{"group-title": "Movies"}, Raw: `#EXTINF:-1 group-title="Movies",Four`},
+		{ID: "5", Name: "Three Backup", Tags: map[string]string{"tvg-id": "id3"}},
+	}
+	covered := map[string]bool{"id1": true}
+
+	out, placeholders := newPlaceholderEPG(config, loc).add(tv, tracks, covered, now)
+	assert.Equal(t, map[string]bool{"id2": true, "id3": true, "4": true}, placeholders)
+
+	// Channels already in the guide are not added again
+	require.Len(t, out.Channels, 4)
+	assert.Equal(t, "id3", out.Channels[2].ID)
+	assert.Equal(t, "Three", out.Channels[2].DisplayNames[0].Value)
+	assert.Equal(t, "http://logo/3.png", out.Channels[2].Icons[0].Source)
+	assert.Equal(t, "4", out.Channels[3].ID)
+
+	// Tracks without a tvg-id use their channel ID
+	assert.Equal(t, "4", tracks[3].Tags["tvg-id"])
+	assert.Equal(t, `#EXTINF:-1 group-title="Movies" tvg-id="4",Four`, tracks[3].Raw)
+
+	require.Len(t, out.Programmes, 1+3*4)
+	first := out.Programmes[1]
+	assert.Equal(t, "id2", first.Channel)
+	assert.Equal(t, "Two (Sports)", first.Titles[0].Value)
+	assert.Equal(t, time.Date(2024, 1, 10, 0, 0, 0, 0, loc), first.Start.Time)
+	assert.Equal(t, time.Date(2024, 1, 10, 6, 0, 0, 0, loc), first.Stop.Time)
+	last := out.Programmes[len(out.Programmes)-1]
+	assert.Equal(t, "4", last.Channel)
+	assert.Equal(t, time.Date(2024, 1, 11, 0, 0, 0, 0, loc), last.Stop.Time)
+
+	// The original guide is left untouched
+	assert.Len(t, tv.Channels, 2)
+	assert.Len(t, tv.Programmes, 1)
+
+	t.Run("Disabled", func(t *testing.T) {
+		out, placeholders := newPlaceholderEPG(PlaceholderEPGConfig{}, nil).add(tv, tracks, covered, now)
+		assert.Same(t, tv, out)
+		assert.Empty(t, placeholders)
+	})
+}
+
+func TestProviderPlaceholderEPG(t *testing.T) {
+	dir := t.TempDir()
+	m3uPath := filepath.Join(dir, "iptv.m3u")
+	require.NoError(t, os.WriteFile(m3uPath, []byte(`#EXTM3U
+#EXTINF:-1 tvg-id="id1" tvg-name="Channel 1",Channel 1
+http://example.com/channel1
+#EXTINF:-1 tvg-name="Channel 2",Channel 2
+http://example.com/channel2`), 0644))
+	epgPath := filepath.Join(dir, "epg.xml")
+	require.NoError(t, os.WriteFile(epgPath, []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<tv>
+<channel id="id1"><display-name>Channel 1</display-name></channel>
+<programme channel="id1" start="20240110120000 +0000" stop="20240110130000 +0000"><title>News</title></programme>
+</tv>`), 0644))
+
+	config := &Config{
+		IPTVUrl:        m3uPath,
+		EPGUrl:         epgPath,
+		Filters:        []*Filter{{Type: "name", Value: ".*"}},
+		PlaceholderEPG: PlaceholderEPGConfig{Enabled: true, BlockLengthStr: "1h", Days: 1, Title: "Live: {{.Name}}"},
+	}
+	require.NoError(t, config.compileFilterRegexps())
+	require.NoError(t, config.PlaceholderEPG.parse())
+
+	provider, err := NewProvider(config)
+	require.NoError(t, err)
+	require.NoError(t, provider.Refresh())
+
+	track := provider.snapshot().tracks[1]
+	assert.Contains(t, provider.GetM3u(), `#EXTINF:-1 tvg-name="Channel 2" tvg-id="`+track.ID+`",Channel 2`)
+
+	epg := readEPG(t, provider)
+	assert.Contains(t, epg, `<channel id="`+track.ID+`"><display-name>Channel 2</display-name></channel>`)
+	assert.Contains(t, epg, `<title>Live: Channel 2</title>`)
+
+	// Placeholder programmes don't count as guide data
+	assert.Equal(t, 1, provider.GetRefreshReport().EPG.Covered)
+}
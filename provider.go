@@ -2,35 +2,51 @@ package proxytv
 
 import (
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
-	"net/http"
-	"os"
+	"path/filepath"
 	"regexp"
+	"slices"
 	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/csfrancis/proxytv/xmltv"
+	"golang.org/x/net/html/charset"
 
 	log "github.com/sirupsen/logrus"
 )
 
 type playlistLoader struct {
-	baseAddress string
-	filters     []*Filter
+	source  *Source
+	filters []*Filter
+	quality *qualityRanking
 
 	tracks     []Track
 	priorities map[string]int
-	m3u        strings.Builder
+
+	// profiles load the tracks of each profile, with the profile's filters
+	profiles []*playlistLoader
+}
+
+func newPlaylistLoader(source *Source, quality *qualityRanking, profiles []*Profile) *playlistLoader {
+	pl := newFilteredLoader(source, source.Filters, quality)
+	for _, profile := range profiles {
+		pl.profiles = append(pl.profiles, newFilteredLoader(source, profile.Filters, quality))
+	}
+	return pl
 }
 
-func newPlaylistLoader(baseAddress string, filters []*Filter) *playlistLoader {
+func newFilteredLoader(source *Source, filters []*Filter, quality *qualityRanking) *playlistLoader {
 	return &playlistLoader{
-		baseAddress: baseAddress,
-		filters:     filters,
-		tracks:      make([]Track, 0, len(filters)),
-		priorities:  make(map[string]int),
+		source:     source,
+		filters:    filters,
+		quality:    quality,
+		tracks:     make([]Track, 0, len(filters)),
+		priorities: make(map[string]int),
 	}
 }
 
@@ -49,31 +65,33 @@ func (pl *playlistLoader) findIndexWithID(track *Track) int {
 }
 
 func (pl *playlistLoader) OnPlaylistStart() {
-	pl.m3u.Reset()
-	pl.m3u.WriteString("#EXTM3U\n")
+	for _, profile := range pl.profiles {
+		profile.OnPlaylistStart()
+	}
 }
 
 func (pl *playlistLoader) OnTrack(track *Track) {
-	for i, filter := range pl.filters {
-		var field string
-		switch filter.Type {
-		case "id":
-			field = "tvg-id"
-		case "group":
-			field = "group-title"
-		case "name":
-			field = "tvg-name"
-		default:
-			log.WithField("type", filter.Type).Panic("invalid filter type")
+	for _, profile := range pl.profiles {
+		t := *track
+		profile.OnTrack(&t)
+	}
+
+	track.Source = pl.source
+	for _, filter := range pl.filters {
+		if filter.Exclude && filter.matches(track) {
+			log.WithFields(log.Fields{"channel": track.Name, "filter": filter.Value}).Debug("excluded track")
+			return
 		}
+	}
 
-		val := track.Tags[field]
-		if len(val) == 0 {
+	for i, filter := range pl.filters {
+		if filter.Exclude {
 			continue
 		}
 
-		if filter.regexp.Match([]byte(val)) {
+		if filter.matches(track) {
 			name := track.Name
+			track.Filter = filter
 
 			if len(track.Tags["tvg-id"]) == 0 {
 				log.WithField("track", track).Warn("missing tvg-id")
@@ -82,12 +100,13 @@ func (pl *playlistLoader) OnTrack(track *Track) {
 			if existingPriority, exists := pl.priorities[name]; !exists || i < existingPriority {
 				idx := pl.findIndexWithID(track)
 				if idx != -1 {
-					if strings.Contains(track.Name, "HD") {
-						delete(pl.priorities, pl.tracks[idx].Name)
-						pl.tracks[idx] = *track
-					} else {
-						continue
+					current := pl.tracks[idx]
+					var preferred bool
+					pl.tracks[idx], preferred = pl.quality.addVariant(current, *track)
+					if !preferred {
+						return
 					}
+					delete(pl.priorities, current.Name)
 				} else {
 					if !exists {
 						pl.tracks = append(pl.tracks, *track)
@@ -102,6 +121,10 @@ func (pl *playlistLoader) OnTrack(track *Track) {
 }
 
 func (pl *playlistLoader) OnPlaylistEnd() {
+	for _, profile := range pl.profiles {
+		profile.OnPlaylistEnd()
+	}
+
 	sort.SliceStable(pl.tracks, func(i, j int) bool {
 		priorityI, existsI := pl.priorities[pl.tracks[i].Name]
 		priorityJ, existsJ := pl.priorities[pl.tracks[j].Name]
@@ -117,113 +140,250 @@ func (pl *playlistLoader) OnPlaylistEnd() {
 		}
 		return priorityI < priorityJ
 	})
+}
 
-	rewriteURL := len(pl.baseAddress) > 0
+// parsedTracks returns every track kept by the main playlist or a profile,
+// including alternates, once each and in playlist order.
+func (pl *playlistLoader) parsedTracks() []Track {
+	var tracks []Track
+	seen := make(map[int]bool)
+	add := func(loader *playlistLoader) {
+		for _, track := range loader.tracks {
+			for _, t := range append([]Track{track}, track.Alternates...) {
+				if !seen[t.LineNumber] {
+					seen[t.LineNumber] = true
+					t.Alternates = nil
+					tracks = append(tracks, t)
+				}
+			}
+		}
+	}
+	add(pl)
+	for _, profile := range pl.profiles {
+		add(profile)
+	}
+	sort.SliceStable(tracks, func(i, j int) bool { return tracks[i].LineNumber < tracks[j].LineNumber })
+	return tracks
+}
 
-	reXuiid := regexp.MustCompile(`xui-id="\{[^"]*\}"\s*`)
+// mergeTracks combines the tracks of each source loader into a single lineup.
+// Loaders are given in priority order, so a track whose tvg-id was already
+// provided by an earlier source becomes an alternate of that source's track.
+func mergeTracks(loaders []*playlistLoader) []Track {
+	var tracks []Track
+	seen := make(map[string]int)
 
-	for i := range len(pl.tracks) {
-		track := pl.tracks[i]
-		uri := track.URI.String()
-		if rewriteURL {
-			uri = fmt.Sprintf("http://%s/channel/%d", pl.baseAddress, i)
+	for _, pl := range loaders {
+		for _, track := range pl.tracks {
+			id := track.Tags["tvg-id"]
+			if len(id) > 0 {
+				if idx, exists := seen[id]; exists {
+					log.WithFields(log.Fields{
+						"tvg-id":  id,
+						"source":  pl.source.Name,
+						"winner":  tracks[idx].Source.Name,
+						"channel": track.Name,
+					}).Debug("keeping duplicate track from lower priority source as an alternate")
+					winner := &tracks[idx]
+					alternates := track.Alternates
+					track.Alternates = nil
+					winner.Alternates = append(slices.Clip(winner.Alternates), track)
+					winner.Alternates = append(winner.Alternates, alternates...)
+					continue
+				}
+				seen[id] = len(tracks)
+			}
+			tracks = append(tracks, track)
 		}
-		// Remove xui-id from the tags
-		fixedRaw := reXuiid.ReplaceAllString(track.Raw, "")
-		pl.m3u.WriteString(fmt.Sprintf("%s\n%s\n", fixedRaw, uri))
 	}
+
+	return tracks
 }
 
-func loadReader(uri string, userAgent string) (io.ReadCloser, error) {
-	var err error
-	var reader io.ReadCloser
-	logger := log.WithField("uri", uri)
-	if isURL(uri) {
-		req, err := http.NewRequest(http.MethodGet, uri, nil)
-		if err != nil {
-			logger.WithError(err).Panic("unable to create request")
-		}
-		if userAgent != "" {
-			req.Header.Set("User-Agent", userAgent)
-		}
-		resp, err := http.DefaultClient.Do(req)
-		if err != nil {
-			logger.WithError(err).Panic("unable to load uri")
-		}
+// buildM3u writes the tracks as a playlist. With a baseAddress, stream URLs
+// point at the server, or only those of HLS channels when hlsOnly is set.
+func buildM3u(tracks []Track, baseAddress string, hlsOnly bool) string {
+	var m3u strings.Builder
+	m3u.WriteString("#EXTM3U\n")
 
-		if resp.StatusCode != http.StatusOK {
-			return nil, fmt.Errorf("invalid url response code: %d", resp.StatusCode)
-		}
+	reXuiid := regexp.MustCompile(`xui-id="\{[^"]*\}"\s*`)
 
-		reader = resp.Body
-	} else {
-		reader, err = os.Open(uri)
-		if err != nil {
-			return nil, err
-		}
+	for i := range tracks {
+		track := tracks[i]
+		uri := streamURL(&track, baseAddress, hlsOnly)
+		// Remove xui-id from the tags
+		fixedRaw := reXuiid.ReplaceAllString(track.Raw, "")
+		m3u.WriteString(fmt.Sprintf("%s\n%s\n", fixedRaw, uri))
 	}
 
-	return reader, nil
+	return m3u.String()
+}
+
+// streamURL returns the URL a track is played from: the server at baseAddress
+// when it serves the track, or the upstream otherwise.
+func streamURL(track *Track, baseAddress string, hlsOnly bool) string {
+	if baseAddress != "" && (!hlsOnly || isHLS(track.URI)) {
+		return fmt.Sprintf("http://%s%s%s", baseAddress, channelURIPrefix, track.ID)
+	}
+	return track.URI.String()
 }
 
 type Provider struct {
-	iptvURL     string
-	epgURL      string
+	sources     []*Source
+	epgSources  []*EPGSource
+	xtream      map[*Source]*xtreamSource
+	iptvStates  map[*Source]*sourceState
+	epgStates   map[*EPGSource]*sourceState
+	fetcher     *fetcher
 	baseAddress string
-	userAgent   string
-	filters     []*Filter
+	hlsOnly     bool
+	epgDir      string
+	epgWindow   epgWindow
+	epgOffsets  map[string]time.Duration
+	epgLocation *time.Location
+	epgMappings []*EPGMapping
+	epgMatch    EPGMatchConfig
+	placeholder *placeholderEPG
+	quality     *qualityRanking
+	overrides   []*Override
+	profiles    []*Profile
+	cache       *diskCache
+	channels    *channelMap
+
+	// refreshLock serializes refreshes, which own the source states and the
+	// EPG matcher of the refresh in progress
+	refreshLock sync.Mutex
+	matcher     *epgMatcher
+	current     atomic.Pointer[snapshot]
+	cachedAt    time.Time
+
+	errorLock sync.Mutex
+	lastError error
+}
+
+// snapshot is the provider data produced by a single refresh. Snapshots are
+// never modified once they are published, so a request that loads the
+// current snapshot sees a playlist, track table and EPG that belong together.
+type snapshot struct {
+	tracks    []Track
+	trackIDs  map[string]int
+	m3u       string
+	epg       *xmltv.TV
+	epgFile   *epgFile
+	refreshed time.Time
+	fromCache bool
+	report    *refreshReport
+
+	epgMatches *epgMatchReport
+
+	// placeholders are the ids of the channels given placeholder programmes
+	placeholders map[string]bool
+
+	// overridden are the overrides applied to the tracks, which the guide
+	// follows
+	overridden []trackOverride
 
-	playlist    *playlistLoader
-	epg         *xmltv.TV
-	epgData     []byte
-	lastRefresh time.Time
+	// profiles are the lineups of the configured profiles, by name. Only
+	// their tracks, playlist and guide are set.
+	profiles map[string]*snapshot
 }
 
+var emptySnapshot = &snapshot{epg: &xmltv.TV{}}
+
 func NewProvider(config *Config) (*Provider, error) {
 	provider := &Provider{
-		iptvURL: config.IPTVUrl,
-		epgURL:  config.EPGUrl,
-		filters: config.Filters,
+		quality:    newQualityRanking(config.Quality),
+		sources:    config.iptvSources(),
+		epgSources: config.epgSources(),
+		xtream:     make(map[*Source]*xtreamSource),
+		iptvStates: make(map[*Source]*sourceState),
+		epgStates:  make(map[*EPGSource]*sourceState),
+		fetcher:    newFetcher(config.Fetch),
 	}
 
-	if len(config.UserAgent) > 0 {
-		provider.userAgent = config.UserAgent
+	for _, src := range provider.sources {
+		if src.Type == sourceTypeXtream {
+			provider.xtream[src] = newXtreamSource(src, provider.fetcher)
+		}
+		provider.iptvStates[src] = newSourceState("iptv", src.Name)
+	}
+	for _, src := range provider.epgSources {
+		provider.epgStates[src] = newSourceState("epg", src.Name)
 	}
 
-	if config.UseFFMPEG {
+	if config.proxiesStreams() {
 		provider.baseAddress = config.ServerAddress
+		provider.hlsOnly = !config.UseFFMPEG && !config.Relay
+	}
+
+	provider.epgDir = config.CacheDir
+	provider.epgWindow = newEPGWindow(config.EPGPastDays, config.EPGFutureDays)
+	provider.epgOffsets = config.EPGOffsets
+	provider.epgLocation = config.EPGLocation
+	provider.epgMappings = config.EPGMappings
+	provider.epgMatch = config.EPGMatch
+	provider.placeholder = newPlaceholderEPG(config.PlaceholderEPG, config.EPGLocation)
+	provider.overrides = config.Overrides
+	provider.profiles = config.Profiles
+
+	if config.CacheDir != "" {
+		cache, err := newDiskCache(config.CacheDir)
+		if err != nil {
+			return nil, err
+		}
+		provider.cache = cache
+	}
+
+	mapPath := ""
+	if config.CacheDir != "" {
+		mapPath = filepath.Join(config.CacheDir, channelMapFile)
 	}
+	provider.channels = newChannelMap(mapPath, config.LegacyChannelWindow)
 
 	return provider, nil
 }
 
-func (p *Provider) loadXMLTv(reader io.Reader) (*xmltv.TV, error) {
-	start := time.Now()
-
+func epgChannels(tracks []Track) map[string]bool {
 	channels := make(map[string]bool)
-	for _, track := range p.playlist.tracks {
+	for _, track := range tracks {
 		id := track.Tags["tvg-id"]
 		if len(id) == 0 {
 			continue
 		}
 		channels[id] = true
 	}
+	return channels
+}
+
+var errIncompleteGuide = errors.New("guide ended before its closing </tv>")
+
+func (p *Provider) loadXMLTv(reader io.Reader, channels map[string]bool) (*xmltv.TV, error) {
+	start := time.Now()
 
 	decoder := xml.NewDecoder(reader)
+	decoder.CharsetReader = charset.NewReaderLabel
 	tvSetup := new(xmltv.TV)
+	inWindow := p.epgWindow.filter(start)
 
 	totalChannelCount := 0
 	totalProgrammeCount := 0
+	trimmedProgrammeCount := 0
+	closed := false
 
 	for {
 		// Decode the next XML token
 		tok, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
 		if err != nil {
-			break // Exit on EOF or error
+			return nil, err
 		}
 
 		// Process the start element
 		switch se := tok.(type) {
+		case xml.EndElement:
+			closed = closed || se.Name.Local == "tv"
 		case xml.StartElement:
 			switch se.Name.Local {
 			case "tv":
@@ -250,7 +410,11 @@ func (p *Provider) loadXMLTv(reader io.Reader) (*xmltv.TV, error) {
 					return nil, err
 				}
 				if channels[programme.Channel] {
-					tvSetup.Programmes = append(tvSetup.Programmes, programme)
+					if inWindow(&programme) {
+						tvSetup.Programmes = append(tvSetup.Programmes, programme)
+					} else {
+						trimmedProgrammeCount++
+					}
 				}
 				totalProgrammeCount++
 			case "channel":
@@ -259,6 +423,7 @@ func (p *Provider) loadXMLTv(reader io.Reader) (*xmltv.TV, error) {
 				if err != nil {
 					return nil, err
 				}
+				p.matcher.observe(&channel, channels)
 				if channels[channel.ID] {
 					tvSetup.Channels = append(tvSetup.Channels, channel)
 				}
@@ -267,83 +432,643 @@ func (p *Provider) loadXMLTv(reader io.Reader) (*xmltv.TV, error) {
 		}
 	}
 
+	// A guide that ends early may still be well-formed up to that point
+	if !closed {
+		return nil, errIncompleteGuide
+	}
+
 	log.WithFields(log.Fields{
 		"totalChannelCount":   totalChannelCount,
 		"channelCount":        len(tvSetup.Channels),
 		"totalProgrammeCount": totalProgrammeCount,
 		"programmeCount":      len(tvSetup.Programmes),
+		"trimmedCount":        trimmedProgrammeCount,
 		"duration":            time.Since(start),
 	}).Info("loaded xmltv")
 
 	return tvSetup, nil
 }
 
-func (p *Provider) Refresh() error {
-	var err error
-	log.WithField("url", p.iptvURL).Info("loading IPTV m3u")
+func (p *Provider) loadSource(src *Source) (*playlistLoader, error) {
+	state := p.iptvStates[src]
+	pl, err := p.fetchSource(src, state)
+	if err != nil {
+		state.failed(err)
+		return nil, err
+	}
+	return pl, nil
+}
+
+func (p *Provider) fetchSource(src *Source, state *sourceState) (*playlistLoader, error) {
+	if x, ok := p.xtream[src]; ok {
+		log.WithFields(log.Fields{"source": src.Name, "url": redactURL(src.URL)}).Info("loading IPTV xtream source")
+		pl := newPlaylistLoader(src, p.quality, p.profiles)
+		if err := x.load(pl); err != nil {
+			return nil, err
+		}
+		// The API responses are cached as the equivalent M3U playlist
+		tee := p.teeCache(strings.NewReader(buildM3u(pl.parsedTracks(), "", false)), "iptv", src.Name, src.URL)
+		if err := tee.complete(state); err != nil {
+			return nil, err
+		}
+		log.WithFields(log.Fields{"source": src.Name, "channelCount": len(pl.tracks)}).Info("parsed IPTV xtream source")
+		return pl, nil
+	}
+
+	logger := log.WithFields(log.Fields{"source": src.Name, "url": redactURL(src.URL)})
+	logger.Info("loading IPTV m3u")
 
 	start := time.Now()
-	iptvReader, err := loadReader(p.iptvURL, p.userAgent)
+	reader, err := p.fetcher.loadConditional(src.URL, src.UserAgent, state, state.playlist != nil)
+	if errors.Is(err, errNotModified) {
+		state.skipped()
+		logger.Info("IPTV m3u not modified, reusing previous playlist")
+		return state.playlist, nil
+	}
 	if err != nil {
-		return err
+		return nil, err
+	}
+	defer reader.Close()
+	logger.WithField("duration", time.Since(start)).Debug("loaded IPTV m3u")
+
+	tee := p.teeCache(reader, "iptv", src.Name, src.URL)
+	pl := newPlaylistLoader(src, p.quality, p.profiles)
+	if err = loadM3u(tee, pl); err != nil {
+		tee.abort()
+		return nil, err
+	}
+	if err = tee.complete(state); err != nil {
+		return nil, err
 	}
-	defer iptvReader.Close()
-	log.WithField("duration", time.Since(start)).Debug("loaded IPTV m3u")
+	state.playlist = pl
+
+	logger.WithField("channelCount", len(pl.tracks)).Info("parsed IPTV m3u")
+
+	return pl, nil
+}
 
-	pl := newPlaylistLoader(p.baseAddress, p.filters)
-	err = loadM3u(iptvReader, pl)
+func (p *Provider) loadEPGSource(src *EPGSource, channels map[string]bool) (*xmltv.TV, error) {
+	state := p.epgStates[src]
+	tv, err := p.fetchEPGSource(src, state, channels)
 	if err != nil {
-		return err
+		state.failed(err)
+		return nil, err
 	}
-	p.playlist = pl
+	return tv, nil
+}
 
-	log.WithField("channelCount", len(p.playlist.tracks)).Info("parsed IPTV m3u")
+// fetchEPGSource loads a guide, reusing the previously parsed guide if the
+// source hasn't changed and the playlist still has the same channels.
+func (p *Provider) fetchEPGSource(src *EPGSource, state *sourceState, channels map[string]bool) (*xmltv.TV, error) {
+	logger := log.WithFields(log.Fields{"source": src.Name, "url": redactURL(src.URL)})
+	logger.Info("loading EPG")
 
-	log.WithField("url", p.epgURL).Info("loading EPG")
+	key := channelSetKey(channels)
 
-	start = time.Now()
-	epgReader, err := loadReader(p.epgURL, p.userAgent)
+	start := time.Now()
+	reader, err := p.fetcher.loadConditional(src.URL, src.UserAgent, state, state.epg != nil && state.epgChannels == key)
+	if errors.Is(err, errNotModified) {
+		state.skipped()
+		logger.Info("EPG not modified, reusing previous guide")
+		return state.epg, nil
+	}
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer epgReader.Close()
-	log.WithField("duration", time.Since(start)).Debug("loaded EPG")
+	defer reader.Close()
+	logger.WithField("duration", time.Since(start)).Debug("loaded EPG")
 
-	p.epg, err = p.loadXMLTv(epgReader)
+	tee := p.teeCache(reader, "epg", src.Name, src.URL)
+	tv, err := p.loadXMLTv(tee, channels)
+	// The channels seen by a failed load are discarded along with the guide
+	index := p.matcher.takeIndex()
+	if err != nil {
+		tee.abort()
+		return nil, err
+	}
+	if err = tee.complete(state); err != nil {
+		return nil, err
+	}
+	state.epg = tv
+	state.epgChannels = key
+	state.epgIndex = index
+
+	return tv, nil
+}
+
+func (p *Provider) loadCachedSource(src *Source) (*playlistLoader, error) {
+	reader, meta, err := p.cache.open("iptv", src.Name, src.URL)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	pl := newPlaylistLoader(src, p.quality, p.profiles)
+	if err = loadM3u(reader, pl); err != nil {
+		return nil, err
+	}
+
+	state := p.iptvStates[src]
+	if _, ok := p.xtream[src]; !ok {
+		state.playlist = pl
+	}
+	state.restore(meta.ETag, meta.LastModified, meta.FetchedAt)
+	p.updateCachedAt(meta.FetchedAt)
+
+	log.WithFields(log.Fields{
+		"source":       src.Name,
+		"channelCount": len(pl.tracks),
+		"fetchedAt":    meta.FetchedAt,
+	}).Info("loaded cached IPTV m3u")
+
+	return pl, nil
+}
+
+func (p *Provider) loadCachedEPGSource(src *EPGSource, channels map[string]bool) (*xmltv.TV, error) {
+	reader, meta, err := p.cache.open("epg", src.Name, src.URL)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	tv, err := p.loadXMLTv(reader, channels)
+	if err != nil {
+		return nil, err
+	}
+
+	state := p.epgStates[src]
+	state.epg = tv
+	state.epgChannels = channelSetKey(channels)
+	state.epgIndex = p.matcher.takeIndex()
+	state.restore(meta.ETag, meta.LastModified, meta.FetchedAt)
+	p.updateCachedAt(meta.FetchedAt)
+
+	log.WithFields(log.Fields{
+		"source":    src.Name,
+		"fetchedAt": meta.FetchedAt,
+	}).Info("loaded cached EPG")
+
+	return tv, nil
+}
+
+// updateCachedAt tracks the fetch time of the oldest cached source, which is
+// reported as the time of the last refresh.
+func (p *Provider) updateCachedAt(fetchedAt time.Time) {
+	if p.cachedAt.IsZero() || fetchedAt.Before(p.cachedAt) {
+		p.cachedAt = fetchedAt
+	}
+}
+
+// Refresh loads all sources and publishes the result. If any source fails,
+// the previous data continues to be served.
+func (p *Provider) Refresh() error {
+	p.refreshLock.Lock()
+	defer p.refreshLock.Unlock()
+
+	snap, err := p.load(p.loadSource, p.loadEPGSource, true)
+	p.setLastError(err)
 	if err != nil {
 		return err
 	}
 
-	xmlData, err := xml.Marshal(p.epg)
+	snap.refreshed = time.Now()
+	snap.report = diffSnapshots(p.snapshot(), snap)
+	snap.report.log()
+	p.publish(snap)
+
+	return nil
+}
+
+// LoadCache loads the playlist and guide from the cache directory, so they can
+// be served before the first refresh has completed.
+func (p *Provider) LoadCache() error {
+	if p.cache == nil {
+		return errCacheMiss
+	}
+
+	p.refreshLock.Lock()
+	defer p.refreshLock.Unlock()
+
+	p.cachedAt = time.Time{}
+	snap, err := p.load(p.loadCachedSource, p.loadCachedEPGSource, false)
 	if err != nil {
 		return err
 	}
 
-	xmlHeader := []byte("<?xml version=\"1.0\" encoding=\"UTF-8\"?><!DOCTYPE tv SYSTEM \"xmltv.dtd\">")
-	p.epgData = append(xmlHeader, xmlData...)
+	snap.refreshed = p.cachedAt
+	snap.fromCache = true
+	p.publish(snap)
+
+	return nil
+}
 
-	p.lastRefresh = time.Now()
+func (p *Provider) load(
+	loadSource func(*Source) (*playlistLoader, error),
+	loadEPGSource func(*EPGSource, map[string]bool) (*xmltv.TV, error),
+	loadShortEPG bool,
+) (*snapshot, error) {
+	loaders, err := p.loadSources(loadSource)
+	if err != nil {
+		return nil, err
+	}
+
+	snap, matched := p.buildLineup(loaders, "", p.overrides)
+	log.WithField("channelCount", len(snap.tracks)).Info("merged IPTV sources")
+
+	// Tracks are first matched against the guides seen by the last refresh,
+	// so that the channels are the same as when an unchanged guide was parsed
+	// and the guide can be reused. The matcher then sees the channels of each
+	// guide that is parsed again.
+	matching := p.epgMatch.Mode == epgMatchSuggest || p.epgMatch.Mode == epgMatchApply
+	if matching {
+		pre := newEPGMatcher(p.epgMatch.Mode, p.epgMatch.Threshold, snap.tracks, p.epgIndexes())
+		matched = append(matched, pre.apply(snap.tracks, newEPGNameIndex(p.epgIndexes()))...)
+		p.matcher = newEPGMatcher(p.epgMatch.Mode, p.epgMatch.Threshold, snap.tracks, p.epgIndexes())
+		defer func() { p.matcher = nil }()
+	}
+
+	profiles := p.buildProfiles(loaders)
+	guides, err := p.loadGuides(snap, profiles, loadEPGSource)
+	if err != nil {
+		return nil, err
+	}
+
+	var names *epgNameIndex
+	if matching {
+		matched, names = p.matchEPGChannels(snap, profiles, matched)
+	}
+	if loadShortEPG {
+		guides = append(guides, p.loadShortEPGs(snap, profiles)...)
+	}
+
+	merged := mergeEPG(guides)
+	now := time.Now()
+	snap.epg = p.lineupEPG(merged, snap, len(profiles) > 0, now)
+	covered := coveredChannels(snap)
+	snap.epgMatches = buildEPGMatchReport(p.epgMatch.Mode, snap.tracks, covered, matched, names, p.epgMatch.Threshold)
+	if err := p.finishLineup(snap, covered, p.baseAddress, now); err != nil {
+		return nil, err
+	}
+	if err := p.finishProfiles(snap, profiles, merged, now); err != nil {
+		snap.release()
+		return nil, err
+	}
+	return snap, nil
+}
+
+// loadSources loads the playlist of each IPTV source.
+func (p *Provider) loadSources(loadSource func(*Source) (*playlistLoader, error)) ([]*playlistLoader, error) {
+	loaders := make([]*playlistLoader, 0, len(p.sources))
+	for _, src := range p.sources {
+		pl, err := loadSource(src)
+		if err != nil {
+			return nil, fmt.Errorf("source %q: %w", src.Name, err)
+		}
+		loaders = append(loaders, pl)
+	}
+	return loaders, nil
+}
+
+// buildLineup merges the tracks of a lineup and applies its overrides and EPG
+// mappings. It returns the channels matched by the mappings.
+func (p *Provider) buildLineup(loaders []*playlistLoader, profile string, overrides []*Override) (*snapshot, []matchedChannel) {
+	lineup := &snapshot{tracks: mergeTracks(loaders)}
+	p.channels.assign(lineup.tracks)
+	p.channels.number(lineup.tracks, profile)
+	lineup.trackIDs = trackIDs(lineup.tracks)
+	lineup.overridden = applyOverrides(lineup.tracks, overrides)
+	return lineup, applyEPGMappings(lineup.tracks, p.epgMappings)
+}
+
+// buildProfiles builds the lineup of each profile from its share of the
+// loaded playlists.
+func (p *Provider) buildProfiles(loaders []*playlistLoader) []*snapshot {
+	profiles := make([]*snapshot, len(p.profiles))
+	for i, profile := range p.profiles {
+		profileLoaders := make([]*playlistLoader, len(loaders))
+		for j, pl := range loaders {
+			profileLoaders[j] = pl.profiles[i]
+		}
+		profiles[i], _ = p.buildLineup(profileLoaders, profile.Name, append(slices.Clip(p.overrides), profile.Overrides...))
 
+		log.WithFields(log.Fields{"profile": profile.Name, "channelCount": len(profiles[i].tracks)}).Info("merged IPTV sources for profile")
+	}
+	return profiles
+}
+
+// lineupChannels returns the guide channels of the main lineup and every
+// profile, which the guides are parsed once for.
+func lineupChannels(snap *snapshot, profiles []*snapshot) map[string]bool {
+	channels := epgChannels(snap.tracks)
+	for _, lineup := range profiles {
+		for id := range epgChannels(lineup.tracks) {
+			channels[id] = true
+		}
+	}
+	return channels
+}
+
+// loadGuides loads the guide of each EPG source for the channels of the
+// lineups.
+func (p *Provider) loadGuides(
+	snap *snapshot,
+	profiles []*snapshot,
+	loadEPGSource func(*EPGSource, map[string]bool) (*xmltv.TV, error),
+) ([]*xmltv.TV, error) {
+	channels := lineupChannels(snap, profiles)
+	guides := make([]*xmltv.TV, 0, len(p.epgSources))
+	for _, src := range p.epgSources {
+		tv, err := loadEPGSource(src, channels)
+		if err != nil {
+			return nil, fmt.Errorf("epg source %q: %w", src.Name, err)
+		}
+		guides = append(guides, shiftEPG(tv, src.Offset, nil, nil))
+	}
+	return guides, nil
+}
+
+// matchEPGChannels matches the tracks against the channels of the parsed
+// guides. It returns matched with the new matches added, and the names the
+// tracks were matched against.
+func (p *Provider) matchEPGChannels(snap *snapshot, profiles []*snapshot, matched []matchedChannel) ([]matchedChannel, *epgNameIndex) {
+	names := newEPGNameIndex(p.epgIndexes())
+	matched = append(matched, p.matcher.apply(snap.tracks, names)...)
+	for _, lineup := range profiles {
+		applyEPGMatches(lineup.tracks, matched)
+	}
+
+	// The guides were parsed with every channel that could match, so they
+	// can be reused as long as the same channels are matched.
+	key := channelSetKey(lineupChannels(snap, profiles))
+	for _, src := range p.epgSources {
+		p.epgStates[src].epgChannels = key
+	}
+	return matched, names
+}
+
+// loadShortEPGs loads the short EPGs of the Xtream sources. Short EPGs only
+// cover a few hours, so they are used to fill whatever the XMLTV sources are
+// missing.
+func (p *Provider) loadShortEPGs(snap *snapshot, profiles []*snapshot) []*xmltv.TV {
+	epgTracks := snap.tracks
+	if len(profiles) > 0 {
+		seen := epgChannels(snap.tracks)
+		epgTracks = slices.Clip(snap.tracks)
+		for _, lineup := range profiles {
+			for _, track := range lineup.tracks {
+				if id := track.Tags["tvg-id"]; id != "" && !seen[id] {
+					seen[id] = true
+					epgTracks = append(epgTracks, track)
+				}
+			}
+		}
+	}
+
+	var guides []*xmltv.TV
+	for _, src := range p.sources {
+		if x, ok := p.xtream[src]; ok && src.ShortEPG {
+			guides = append(guides, x.loadShortEPG(epgTracks))
+		}
+	}
+	return guides
+}
+
+// finishProfiles builds the guide, playlist and guide file of each profile.
+func (p *Provider) finishProfiles(snap *snapshot, profiles []*snapshot, merged *xmltv.TV, now time.Time) error {
+	snap.profiles = make(map[string]*snapshot, len(profiles))
+	for i, profile := range p.profiles {
+		lineup := profiles[i]
+		lineup.epg = p.lineupEPG(merged, lineup, true, now)
+		baseAddress := p.baseAddress
+		if baseAddress != "" {
+			baseAddress += profileURIPrefix + profile.Name
+		}
+		if err := p.finishLineup(lineup, coveredChannels(lineup), baseAddress, now); err != nil {
+			return err
+		}
+		snap.profiles[profile.Name] = lineup
+	}
 	return nil
 }
 
+func trackIDs(tracks []Track) map[string]int {
+	ids := make(map[string]int, len(tracks))
+	for i := range tracks {
+		ids[tracks[i].ID] = i
+	}
+	return ids
+}
+
+// lineupEPG returns the guide of a lineup from the merged guides. When the
+// guides were parsed for other lineups as well, only the lineup's channels
+// are kept.
+func (p *Provider) lineupEPG(merged *xmltv.TV, lineup *snapshot, shared bool, now time.Time) *xmltv.TV {
+	tv := merged
+	if shared {
+		tv = selectEPGChannels(merged, epgChannels(lineup.tracks))
+	}
+
+	// Channel offsets apply to whichever guide filled the channel. The window
+	// is applied again since guides that were reused because their source
+	// hasn't changed may have programmes that have since moved out of it.
+	tv = shiftEPG(tv, 0, channelOffsets(lineup.tracks, p.epgOffsets), p.epgLocation)
+	return overrideEPGChannels(trimEPG(tv, p.epgWindow, now), lineup.tracks, lineup.overridden)
+}
+
+// finishLineup adds placeholders and channel numbers to the guide of a lineup,
+// and builds its playlist and guide file. Placeholders may give tracks without
+// a tvg-id one, so the playlist is built once they have been added.
+func (p *Provider) finishLineup(lineup *snapshot, covered map[string]bool, baseAddress string, now time.Time) error {
+	lineup.epg, lineup.placeholders = p.placeholder.add(lineup.epg, lineup.tracks, covered, now)
+	lineup.epg = numberEPGChannels(lineup.epg, lineup.tracks)
+	lineup.m3u = buildM3u(lineup.tracks, baseAddress, p.hlsOnly)
+
+	epgFile, err := writeEPGFile(p.epgDir, lineup.epg)
+	if err != nil {
+		return fmt.Errorf("unable to write epg: %w", err)
+	}
+	lineup.epgFile = epgFile
+	return nil
+}
+
+// epgIndexes returns the channels seen in each guide when it was last parsed.
+func (p *Provider) epgIndexes() [][]epgIndexEntry {
+	indexes := make([][]epgIndexEntry, 0, len(p.epgSources))
+	for _, src := range p.epgSources {
+		indexes = append(indexes, p.epgStates[src].epgIndex)
+	}
+	return indexes
+}
+
+// publish makes snap the current snapshot, releasing the guide files of the
+// snapshot it replaces.
+func (p *Provider) publish(snap *snapshot) {
+	if old := p.current.Swap(snap); old != nil {
+		old.release()
+	}
+}
+
+// release drops the references of a snapshot and its profile lineups to their
+// guide files.
+func (s *snapshot) release() {
+	if s.epgFile != nil {
+		s.epgFile.release()
+	}
+	for _, lineup := range s.profiles {
+		lineup.release()
+	}
+}
+
+func (p *Provider) snapshot() *snapshot {
+	if snap := p.current.Load(); snap != nil {
+		return snap
+	}
+	return emptySnapshot
+}
+
+func (p *Provider) setLastError(err error) {
+	p.errorLock.Lock()
+	defer p.errorLock.Unlock()
+	p.lastError = err
+}
+
+// lineup returns the lineup of a profile, or the main lineup when profile is
+// empty. It returns nil if there is no such profile.
+func (p *Provider) lineup(profile string) *snapshot {
+	snap := p.snapshot()
+	if profile == "" {
+		return snap
+	}
+	if !slices.ContainsFunc(p.profiles, func(pr *Profile) bool { return pr.Name == profile }) {
+		return nil
+	}
+	if lineup, ok := snap.profiles[profile]; ok {
+		return lineup
+	}
+	return emptySnapshot
+}
+
 func (p *Provider) GetM3u() string {
-	return p.playlist.m3u.String()
+	return p.snapshot().m3u
+}
+
+// GetProfileM3u returns the playlist of a profile, and false if there is no
+// such profile.
+func (p *Provider) GetProfileM3u(profile string) (string, bool) {
+	lineup := p.lineup(profile)
+	if lineup == nil {
+		return "", false
+	}
+	return lineup.m3u, true
+}
+
+// GetProfileEpgFile returns the guide of a profile, or of the main lineup when
+// profile is empty, with a reference that the caller releases once it has
+// finished reading. The guide is nil if none has been loaded. It returns false
+// if there is no such profile.
+func (p *Provider) GetProfileEpgFile(profile string) (*epgFile, bool) {
+	for {
+		lineup := p.lineup(profile)
+		if lineup == nil {
+			return nil, false
+		}
+		// The snapshot may be replaced and its files removed before the
+		// reference is taken, in which case the new one is used
+		if lineup.epgFile == nil || lineup.epgFile.acquire() {
+			return lineup.epgFile, true
+		}
+	}
 }
 
-func (p *Provider) GetEpgXML() string {
-	return string(p.epgData)
+// GetTracks returns the tracks of the main lineup, which must not be modified.
+func (p *Provider) GetTracks() []Track {
+	return p.snapshot().tracks
 }
 
 var trackNotFound = Track{}
 
-func (p *Provider) GetTrack(idx int) *Track {
-	if idx >= len(p.playlist.tracks) {
+// GetTrack returns the track with the given channel id. Numeric ids from
+// before stable ids were introduced are resolved during the migration window.
+func (p *Provider) GetTrack(id string) *Track {
+	snap := p.snapshot()
+	idx, ok := snap.trackIDs[id]
+	if !ok && p.channels != nil {
+		if stableID, found := p.channels.resolveLegacy(id); found {
+			log.WithFields(log.Fields{"channelId": id, "stableId": stableID}).Debug("resolved legacy channel id")
+			idx, ok = snap.trackIDs[stableID]
+		}
+	}
+	if !ok {
+		return &trackNotFound
+	}
+	return &snap.tracks[idx]
+}
+
+// GetProfileTrack returns the track with the given channel id in the lineup
+// of a profile, or in the main lineup when profile is empty.
+func (p *Provider) GetProfileTrack(profile string, id string) *Track {
+	if profile == "" {
+		return p.GetTrack(id)
+	}
+	lineup := p.lineup(profile)
+	if lineup == nil {
+		return &trackNotFound
+	}
+	idx, ok := lineup.trackIDs[id]
+	if !ok {
 		return &trackNotFound
 	}
-	return &p.playlist.tracks[idx]
+	return &lineup.tracks[idx]
+}
+
+// GetAccounts returns the Xtream account details for each Xtream source, keyed by source name.
+func (p *Provider) GetAccounts() map[string]*xtreamAccount {
+	accounts := make(map[string]*xtreamAccount)
+	for src, x := range p.xtream {
+		if account := x.GetAccount(); account != nil {
+			accounts[src.Name] = account
+		}
+	}
+	return accounts
+}
+
+// GetSourceStatus returns the fetch status of each IPTV and EPG source.
+func (p *Provider) GetSourceStatus() []sourceStatus {
+	status := make([]sourceStatus, 0, len(p.sources)+len(p.epgSources))
+	for _, src := range p.sources {
+		status = append(status, p.iptvStates[src].status())
+	}
+	for _, src := range p.epgSources {
+		status = append(status, p.epgStates[src].status())
+	}
+	return status
+}
+
+// GetFetchMetrics returns the attempt and outcome counts of source downloads.
+func (p *Provider) GetFetchMetrics() fetchMetrics {
+	return p.fetcher.getMetrics()
+}
+
+// GetEPGMatchReport returns the channels without guide data in the data being
+// served, and the channels that were matched to the guide by name.
+func (p *Provider) GetEPGMatchReport() *epgMatchReport {
+	return p.snapshot().epgMatches
+}
+
+// GetRefreshReport returns the changes made by the last refresh, or nil if
+// the data being served hasn't been refreshed yet.
+func (p *Provider) GetRefreshReport() *refreshReport {
+	return p.snapshot().report
 }
 
 func (p *Provider) GetLastRefresh() time.Time {
-	return p.lastRefresh
+	return p.snapshot().refreshed
+}
+
+// IsStale reports whether the data being served is from the cache, or the
+// most recent refresh failed.
+func (p *Provider) IsStale() bool {
+	p.errorLock.Lock()
+	defer p.errorLock.Unlock()
+	return p.snapshot().fromCache || p.lastError != nil
 }
@@ -1,11 +1,18 @@
 package proxytv
 
 import (
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func createTempFile(content string, pattern string) (*os.File, error) {
@@ -51,6 +58,7 @@ http://example.com/channel2
 `,
 			epgContent: `<?xml version="1.0" encoding="ISO-8859-1"?>
 <!DOCTYPE tv SYSTEM "xmltv.dtd">
+<tv></tv>
 `,
 			wantErr: false,
 		},
@@ -82,6 +90,39 @@ http://example.com/channel2
 `,
 			epgContent: `<?xml version="1.0" encoding="ISO-8859-1"?>
 <!DOCTYPE tv SYSTEM "xmltv.dtd">
+<tv></tv>
+`,
+			wantErr: false,
+		},
+		{
+			name: "Exclude filters and conditions",
+			config: &Config{
+				Filters: []*Filter{
+					{Type: "group", Value: "Sports", Except: []*Filter{{Type: "name", Value: `(?i)\b(SD|backup)\b`}}},
+					{Type: "tag", Tag: "tvg-country", Value: "GB", And: []*Filter{{Type: "host", Value: `^uk\.`}}},
+					{Type: "url", Value: `/blocked/`, Exclude: true},
+				},
+			},
+			m3uContent: `#EXTM3U
+#EXTINF:-1 tvg-id="id1" tvg-name="Sports 1" group-title="Sports",Sports 1
+http://example.com/channel1
+#EXTINF:-1 tvg-id="id2" tvg-name="Sports 2 SD" group-title="Sports",Sports 2 SD
+http://example.com/channel2
+#EXTINF:-1 tvg-id="id3" tvg-name="News" tvg-country="GB",News
+http://uk.example.com/channel3
+#EXTINF:-1 tvg-id="id4" tvg-name="Other News" tvg-country="GB",Other News
+http://us.example.com/channel4
+#EXTINF:-1 tvg-id="id5" tvg-name="Sports 5" group-title="Sports",Sports 5
+http://example.com/blocked/channel5`,
+			expectedM3u: `#EXTM3U
+#EXTINF:-1 tvg-id="id1" tvg-name="Sports 1" group-title="Sports",Sports 1
+http://example.com/channel1
+#EXTINF:-1 tvg-id="id3" tvg-name="News" tvg-country="GB",News
+http://uk.example.com/channel3
+`,
+			epgContent: `<?xml version="1.0" encoding="ISO-8859-1"?>
+<!DOCTYPE tv SYSTEM "xmltv.dtd">
+<tv></tv>
 `,
 			wantErr: false,
 		},
@@ -101,12 +142,13 @@ http://example.com/channel1
 http://example.com/channel2`,
 			expectedM3u: `#EXTM3U
 #EXTINF:-1 tvg-id="id1" tvg-name="name1",Channel 1
-http://test.com:6078/channel/0
+http://test.com:6078/channel/63a5811706
 #EXTINF:-1 tvg-id="id2" tvg-name="name2",Channel 2
-http://test.com:6078/channel/1
+http://test.com:6078/channel/9a31049e06
 `,
 			epgContent: `<?xml version="1.0" encoding="ISO-8859-1"?>
 <!DOCTYPE tv SYSTEM "xmltv.dtd">
+<tv></tv>
 `,
 			wantErr: false,
 		},
@@ -145,3 +187,245 @@ http://test.com:6078/channel/1
 		})
 	}
 }
+
+func TestProviderMultipleSources(t *testing.T) {
+	primary, err := createTempFile(`#EXTM3U
+#EXTINF:-1 tvg-id="id1" tvg-name="name1" group-title="News",Primary 1
+http://primary.com/channel1
+#EXTINF:-1 tvg-id="id2" tvg-name="name2" group-title="Sports",Primary 2
+http://primary.com/channel2`, "test_m3u_*.m3u")
+	if err != nil {
+		t.Fatalf("Failed to create temporary file: %v", err)
+	}
+	defer os.Remove(primary.Name())
+
+	secondary, err := createTempFile(`#EXTM3U
+#EXTINF:-1 tvg-id="id2" tvg-name="name2" group-title="Sports",Secondary 2
+http://secondary.com/channel2
+#EXTINF:-1 tvg-id="id3" tvg-name="name3" group-title="Movies",Secondary 3
+http://secondary.com/channel3`, "test_m3u_*.m3u")
+	if err != nil {
+		t.Fatalf("Failed to create temporary file: %v", err)
+	}
+	defer os.Remove(secondary.Name())
+
+	epg, err := createTempFile(`<?xml version="1.0" encoding="UTF-8"?>
+<tv></tv>`, "test_epg_*.xml")
+	if err != nil {
+		t.Fatalf("Failed to create temporary file: %v", err)
+	}
+	defer os.Remove(epg.Name())
+
+	config := &Config{
+		EPGUrl:    filepath.ToSlash(epg.Name()),
+		UserAgent: "global-agent",
+		Filters: []*Filter{
+			{Type: "id", Value: ".*"},
+		},
+		Sources: []*Source{
+			{Name: "primary", URL: filepath.ToSlash(primary.Name()), UserAgent: "primary-agent"},
+			{Name: "secondary", URL: filepath.ToSlash(secondary.Name()), Filters: []*Filter{
+				{Type: "group", Value: "Sports|Movies"},
+			}},
+		},
+	}
+	assert.NoError(t, config.compileFilterRegexps())
+
+	provider, err := NewProvider(config)
+	assert.NoError(t, err)
+	assert.NoError(t, provider.Refresh())
+
+	assert.Equal(t, `#EXTM3U
+#EXTINF:-1 tvg-id="id1" tvg-name="name1" group-title="News",Primary 1
+http://primary.com/channel1
+#EXTINF:-1 tvg-id="id2" tvg-name="name2" group-title="Sports",Primary 2
+http://primary.com/channel2
+#EXTINF:-1 tvg-id="id3" tvg-name="name3" group-title="Movies",Secondary 3
+http://secondary.com/channel3
+`, provider.GetM3u())
+
+	track := provider.GetTrack("1")
+	assert.Equal(t, "primary", track.Source.Name)
+	assert.Equal(t, "primary-agent", track.Source.UserAgent)
+
+	track = provider.GetTrack("2")
+	assert.Equal(t, "secondary", track.Source.Name)
+	assert.Equal(t, "global-agent", track.Source.UserAgent)
+	assert.Equal(t, []string{"-user_agent", "global-agent", "-i", "http://secondary.com/channel3", "-c:v", "copy", "-f", "mpegts", "pipe:1"}, ffmpegArgs(track))
+}
+
+func TestProviderConcurrentRefresh(t *testing.T) {
+	playlists := []string{
+		`#EXTM3U
+#EXTINF:-1 tvg-id="a1" tvg-name="a1",Channel A1
+http://example.com/a1
+#EXTINF:-1 tvg-id="a2" tvg-name="a2",Channel A2
+http://example.com/a2`,
+		`#EXTM3U
+#EXTINF:-1 tvg-id="b1" tvg-name="b1",Channel B1
+http://example.com/b1
+#EXTINF:-1 tvg-id="b2" tvg-name="b2",Channel B2
+http://example.com/b2
+#EXTINF:-1 tvg-id="b3" tvg-name="b3",Channel B3
+http://example.com/b3`,
+	}
+
+	var version int64
+	m3u := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(playlists[atomic.AddInt64(&version, 1)%2]))
+	}))
+	defer m3u.Close()
+
+	var failEpg int64
+	epg := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt64(&failEpg) == 1 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?><tv>
+<channel id="a1"><display-name>A1</display-name></channel>
+<channel id="a2"><display-name>A2</display-name></channel>
+<channel id="b1"><display-name>B1</display-name></channel>
+<channel id="b2"><display-name>B2</display-name></channel>
+<channel id="b3"><display-name>B3</display-name></channel>
+</tv>`))
+	}))
+	defer epg.Close()
+
+	config := &Config{
+		IPTVUrl: m3u.URL + "/iptv.m3u",
+		EPGUrl:  epg.URL + "/epg.xml",
+		Filters: []*Filter{{Type: "id", Value: ".*"}},
+	}
+	require.NoError(t, config.compileFilterRegexps())
+
+	provider, err := NewProvider(config)
+	require.NoError(t, err)
+	require.NoError(t, provider.Refresh())
+
+	checkSnapshot := func(snap *snapshot) {
+		assert.Equal(t, len(snap.tracks), strings.Count(snap.m3u, "#EXTINF"))
+		assert.Equal(t, len(snap.tracks), len(snap.epg.Channels))
+		for i, track := range snap.tracks {
+			assert.Equal(t, track.Tags["tvg-id"], snap.epg.Channels[i].ID)
+		}
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				checkSnapshot(provider.snapshot())
+				provider.GetM3u()
+				readEPG(t, provider)
+				provider.GetTrack("2")
+				provider.GetLastRefresh()
+				provider.IsStale()
+			}
+		}()
+	}
+
+	var refreshes sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		refreshes.Add(1)
+		go func() {
+			defer refreshes.Done()
+			for j := 0; j < 10; j++ {
+				assert.NoError(t, provider.Refresh())
+			}
+		}()
+	}
+	refreshes.Wait()
+
+	// A failed EPG load must not publish the new playlist
+	before := provider.snapshot()
+	atomic.StoreInt64(&failEpg, 1)
+	assert.Error(t, provider.Refresh())
+	assert.Same(t, before, provider.snapshot())
+	assert.True(t, provider.IsStale())
+
+	close(done)
+	wg.Wait()
+}
+
+func TestProviderProfiles(t *testing.T) {
+	dir := t.TempDir()
+	m3uPath := filepath.Join(dir, "iptv.m3u")
+	require.NoError(t, os.WriteFile(m3uPath, []byte(`#EXTM3U
+#EXTINF:-1 tvg-id="news" tvg-name="News" group-title="News",News
+http://example.com/news
+#EXTINF:-1 tvg-id="cartoons" tvg-name="Cartoons" group-title="Kids",Cartoons
+http://example.com/cartoons
+#EXTINF:-1 tvg-id="toons" tvg-name="Toons" group-title="Kids",Toons
+http://example.com/toons`), 0644))
+	epgPath := filepath.Join(dir, "epg.xml")
+	require.NoError(t, os.WriteFile(epgPath, []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<tv>
+<channel id="news"><display-name>News</display-name></channel>
+<channel id="cartoons"><display-name>Cartoons</display-name></channel>
+<programme channel="news" start="20240110120000 +0000" stop="20240110130000 +0000"><title>Headlines</title></programme>
+<programme channel="cartoons" start="20240110120000 +0000" stop="20240110130000 +0000"><title>Cartoon Hour</title></programme>
+</tv>`), 0644))
+
+	config := &Config{
+		IPTVUrl:       m3uPath,
+		EPGUrl:        epgPath,
+		ServerAddress: "proxytv:6078",
+		UseFFMPEG:     true,
+		Filters:       []*Filter{{Type: "group", Value: "News"}},
+		Profiles: []*Profile{{
+			Name:      "kids",
+			Filters:   []*Filter{{Type: "name", Value: "Toons"}, {Type: "group", Value: "Kids"}},
+			Overrides: []*Override{{TvgID: "cartoons", Name: "Cartoon Club"}},
+		}},
+	}
+	require.NoError(t, config.compileFilterRegexps())
+	require.NoError(t, config.validateProfiles())
+
+	provider, err := NewProvider(config)
+	require.NoError(t, err)
+	require.NoError(t, provider.Refresh())
+
+	// The main lineup is unchanged by the profile
+	assert.Equal(t, 1, strings.Count(provider.GetM3u(), "#EXTINF"))
+	epg := readEPG(t, provider)
+	assert.Contains(t, epg, "Headlines")
+	assert.NotContains(t, epg, "cartoons")
+
+	// The profile has its own channels, ordering and overrides, with stream
+	// URLs that resolve against its lineup
+	m3u, ok := provider.GetProfileM3u("kids")
+	require.True(t, ok)
+	toons, cartoons := hashChannelKey("id:toons"), hashChannelKey("id:cartoons")
+	assert.Equal(t, `#EXTM3U
+#EXTINF:-1 tvg-id="toons" tvg-name="Toons" group-title="Kids",Toons
+http://proxytv:6078/p/kids/channel/`+toons+`
+#EXTINF:-1 tvg-id="cartoons" tvg-name="Cartoon Club" group-title="Kids",Cartoon Club
+http://proxytv:6078/p/kids/channel/`+cartoons+`
+`, m3u)
+	assert.Equal(t, "Cartoon Club", provider.GetProfileTrack("kids", cartoons).Name)
+	assert.Nil(t, provider.GetProfileTrack("", cartoons).URI)
+	assert.Nil(t, provider.GetTrack(toons).URI)
+
+	// Only the profile's channels are in its guide
+	f, ok := provider.GetProfileEpgFile("kids")
+	require.True(t, ok)
+	defer f.release()
+	data, err := io.ReadAll(f.reader())
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `<channel id="cartoons"><display-name>Cartoon Club</display-name><display-name>Cartoons</display-name></channel>`)
+	assert.Contains(t, string(data), "Cartoon Hour")
+	assert.NotContains(t, string(data), "Headlines")
+
+	_, ok = provider.GetProfileM3u("unknown")
+	assert.False(t, ok)
+	assert.Nil(t, provider.GetProfileTrack("unknown", cartoons).URI)
+}
@@ -0,0 +1,72 @@
+package proxytv
+
+import (
+	"regexp"
+	"slices"
+	"sort"
+)
+
+// The ranking used when no quality rules are configured: UHD > FHD > HD > SD.
+var defaultQualityRules = []*QualityRule{
+	{Regex: `(?i)\b(UHD|4K)\b`, Score: 4, regexp: regexp.MustCompile(`(?i)\b(UHD|4K)\b`)},
+	{Regex: `(?i)\bFHD\b`, Score: 3, regexp: regexp.MustCompile(`(?i)\bFHD\b`)},
+	{Regex: `(?i)\bHD\b`, Score: 2, regexp: regexp.MustCompile(`(?i)\bHD\b`)},
+	{Regex: `(?i)\bSD\b`, Score: 1, regexp: regexp.MustCompile(`(?i)\bSD\b`)},
+}
+
+// qualityRanking picks between the variants of a channel, which are tracks of
+// the same source that share a tvg-id.
+type qualityRanking struct {
+	rules    []*QualityRule
+	lastWins bool
+}
+
+func newQualityRanking(config QualityConfig) *qualityRanking {
+	q := &qualityRanking{rules: config.Rules, lastWins: config.TieBreak == qualityTieBreakLast}
+	if len(q.rules) == 0 {
+		q.rules = defaultQualityRules
+	}
+	return q
+}
+
+// score returns the sum of the scores of the rules matching the track.
+func (q *qualityRanking) score(track *Track) int {
+	score := 0
+	for _, rule := range q.rules {
+		value := track.Name
+		if rule.Tag != "" {
+			value = track.Tags[rule.Tag]
+		}
+		if value != "" && rule.regexp.MatchString(value) {
+			score += rule.Score
+		}
+	}
+	return score
+}
+
+// better reports whether track a is preferred over track b. Tracks with the
+// same score are ordered by their position in the playlist.
+func (q *qualityRanking) better(a *Track, b *Track) bool {
+	if sa, sb := q.score(a), q.score(b); sa != sb {
+		return sa > sb
+	}
+	if q.lastWins {
+		return a.LineNumber > b.LineNumber
+	}
+	return a.LineNumber < b.LineNumber
+}
+
+// addVariant adds track as a variant of the channel whose preferred track is
+// current. It returns the channel's preferred track, with the variants that
+// lose kept as its alternates, best first, and whether track was preferred.
+func (q *qualityRanking) addVariant(current Track, track Track) (Track, bool) {
+	variants := append(slices.Clone(current.Alternates), current, track)
+	for i := range variants {
+		variants[i].Alternates = nil
+	}
+	sort.SliceStable(variants, func(i, j int) bool { return q.better(&variants[i], &variants[j]) })
+
+	winner := variants[0]
+	winner.Alternates = variants[1:]
+	return winner, q.better(&track, &current)
+}
@@ -0,0 +1,120 @@
+package proxytv
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQualityRanking(t *testing.T) {
+	variant := func(line int, name string, tags map[string]string) Track {
+		return Track{Name: name, LineNumber: line, Tags: tags}
+	}
+	names := func(tracks []Track) []string {
+		var n []string
+		for i := range tracks {
+			n = append(n, tracks[i].Name)
+		}
+		return n
+	}
+	rank := func(q *qualityRanking, variants ...Track) (Track, []bool) {
+		winner := variants[0]
+		var preferred []bool
+		for _, v := range variants[1:] {
+			var p bool
+			winner, p = q.addVariant(winner, v)
+			preferred = append(preferred, p)
+		}
+		return winner, preferred
+	}
+
+	t.Run("Default", func(t *testing.T) {
+		q := newQualityRanking(QualityConfig{})
+		winner, preferred := rank(q,
+			variant(1, "Sky Sports HD", nil),
+			variant(2, "Sky Sports", nil),
+			variant(3, "Sky Sports UHD", nil),
+			variant(4, "Sky Sports SD", nil),
+			variant(5, "Sky Sports FHD", nil),
+		)
+		assert.Equal(t, "Sky Sports UHD", winner.Name)
+		assert.Equal(t, []string{"Sky Sports FHD", "Sky Sports HD", "Sky Sports SD", "Sky Sports"}, names(winner.Alternates))
+		assert.Equal(t, []bool{false, true, false, false}, preferred)
+		for _, alternate := range winner.Alternates {
+			assert.Nil(t, alternate.Alternates)
+		}
+	})
+
+	t.Run("Rules and tie-break", func(t *testing.T) {
+		q := newQualityRanking(QualityConfig{
+			Rules: []*QualityRule{
+				{Regex: "HEVC", Tag: "tvg-codec", Score: 5, regexp: regexp.MustCompile("HEVC")},
+				{Regex: "(?i)backup", Score: -10, regexp: regexp.MustCompile("(?i)backup")},
+			},
+			TieBreak: qualityTieBreakLast,
+		})
+		winner, _ := rank(q,
+			variant(1, "News", nil),
+			variant(2, "News Backup", map[string]string{"tvg-codec": "HEVC"}),
+			variant(3, "News 2", nil),
+			variant(4, "News HEVC", map[string]string{"tvg-codec": "HEVC"}),
+		)
+		assert.Equal(t, "News HEVC", winner.Name)
+		assert.Equal(t, []string{"News 2", "News", "News Backup"}, names(winner.Alternates))
+	})
+}
+
+func TestProviderQualityVariants(t *testing.T) {
+	dir := t.TempDir()
+	primary := filepath.Join(dir, "primary.m3u")
+	require.NoError(t, os.WriteFile(primary, []byte(`#EXTM3U
+#EXTINF:-1 tvg-id="id1" tvg-name="Channel 1 HD",Channel 1 HD
+http://primary/1hd
+#EXTINF:-1 tvg-id="id1" tvg-name="Channel 1 UHD",Channel 1 UHD
+http://primary/1uhd
+#EXTINF:-1 tvg-id="id2" tvg-name="Channel 2",Channel 2
+http://primary/2`), 0644))
+	secondary := filepath.Join(dir, "secondary.m3u")
+	require.NoError(t, os.WriteFile(secondary, []byte(`#EXTM3U
+#EXTINF:-1 tvg-id="id1" tvg-name="Channel 1 FHD",Channel 1 FHD
+http://secondary/1fhd`), 0644))
+	epgPath := filepath.Join(dir, "epg.xml")
+	require.NoError(t, os.WriteFile(epgPath, []byte(testEpgContent), 0644))
+
+	config := &Config{
+		EPGUrl: epgPath,
+		Sources: []*Source{
+			{Name: "primary", URL: primary},
+			{Name: "secondary", URL: secondary},
+		},
+		Filters: []*Filter{{Type: "id", Value: ".*"}},
+	}
+	require.NoError(t, config.compileFilterRegexps())
+
+	provider, err := NewProvider(config)
+	require.NoError(t, err)
+	require.NoError(t, provider.Refresh())
+
+	assert.Equal(t, `#EXTM3U
+#EXTINF:-1 tvg-id="id1" tvg-name="Channel 1 UHD",Channel 1 UHD
+http://primary/1uhd
+#EXTINF:-1 tvg-id="id2" tvg-name="Channel 2",Channel 2
+http://primary/2
+`, provider.GetM3u())
+
+	// Variants from the same source come before lower priority sources
+	track := provider.GetTrack(hashChannelKey("id:id1"))
+	var alternates []string
+	for _, alternate := range track.Alternates {
+		alternates = append(alternates, alternate.URI.String())
+	}
+	assert.Equal(t, []string{"http://primary/1hd", "http://secondary/1fhd"}, alternates)
+
+	// The cached playlists are left untouched by the merge
+	require.NoError(t, provider.Refresh())
+	assert.Len(t, provider.GetTrack(hashChannelKey("id:id1")).Alternates, 2)
+}
@@ -0,0 +1,180 @@
+package proxytv
+
+import (
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// refreshReport describes how the lineup and guide changed in a refresh,
+// compared to the data that was served before it.
+type refreshReport struct {
+	Time         time.Time       `json:"time"`
+	Initial      bool            `json:"initial"`
+	ChannelCount int             `json:"channelCount"`
+	Added        []channelChange `json:"added"`
+	Removed      []channelChange `json:"removed"`
+	Renamed      []channelChange `json:"renamed"`
+	Regrouped    []channelChange `json:"regrouped"`
+	EPG          epgCoverage     `json:"epg"`
+}
+
+type channelChange struct {
+	ID       string `json:"id"`
+	TvgID    string `json:"tvgId,omitempty"`
+	Name     string `json:"name"`
+	OldName  string `json:"oldName,omitempty"`
+	Group    string `json:"group,omitempty"`
+	OldGroup string `json:"oldGroup,omitempty"`
+}
+
+// epgCoverage counts the channels that have programmes in the guide, and
+// lists the channels that gained or lost their programmes in the refresh.
+type epgCoverage struct {
+	Covered         int             `json:"covered"`
+	PreviousCovered int             `json:"previousCovered"`
+	Gained          []channelChange `json:"gained"`
+	Lost            []channelChange `json:"lost"`
+}
+
+// HasChanges reports whether any channel or its guide coverage changed.
+func (r *refreshReport) HasChanges() bool {
+	return len(r.Added)+len(r.Removed)+len(r.Renamed)+len(r.Regrouped)+len(r.EPG.Gained)+len(r.EPG.Lost) > 0
+}
+
+func newChannelChange(track *Track) channelChange {
+	return channelChange{
+		ID:    track.ID,
+		TvgID: track.Tags["tvg-id"],
+		Name:  track.Name,
+		Group: track.Tags["group-title"],
+	}
+}
+
+// coveredChannels returns the tvg-ids of the channels with programmes, other
+// than placeholder programmes.
+func coveredChannels(snap *snapshot) map[string]bool {
+	covered := make(map[string]bool)
+	if snap.epg == nil {
+		return covered
+	}
+	for i := range snap.epg.Programmes {
+		if id := snap.epg.Programmes[i].Channel; !snap.placeholders[id] {
+			covered[id] = true
+		}
+	}
+	return covered
+}
+
+// diffSnapshots compares the lineups of two snapshots. Channels are matched by
+// tvg-id, or by source and name for channels without one. A channel that is
+// left unmatched is then paired with a channel of the same name, so that a
+// channel whose tvg-id changed isn't reported as removed and added.
+func diffSnapshots(prev *snapshot, next *snapshot) *refreshReport {
+	report := &refreshReport{
+		Time:         next.refreshed,
+		Initial:      len(prev.tracks) == 0,
+		ChannelCount: len(next.tracks),
+	}
+
+	covered := coveredChannels(next)
+	for i := range next.tracks {
+		if covered[next.tracks[i].Tags["tvg-id"]] {
+			report.EPG.Covered++
+		}
+	}
+	if report.Initial {
+		return report
+	}
+
+	prevCovered := coveredChannels(prev)
+	for i := range prev.tracks {
+		if prevCovered[prev.tracks[i].Tags["tvg-id"]] {
+			report.EPG.PreviousCovered++
+		}
+	}
+
+	prevByKey := make(map[string]*Track, len(prev.tracks))
+	for i := range prev.tracks {
+		prevByKey[channelKey(&prev.tracks[i])] = &prev.tracks[i]
+	}
+
+	type pair struct{ prev, next *Track }
+	var pairs []pair
+	var added []*Track
+	for i := range next.tracks {
+		track := &next.tracks[i]
+		key := channelKey(track)
+		if old, ok := prevByKey[key]; ok {
+			pairs = append(pairs, pair{old, track})
+			delete(prevByKey, key)
+		} else {
+			added = append(added, track)
+		}
+	}
+
+	removedByName := make(map[string][]*Track)
+	for _, track := range prevByKey {
+		removedByName[track.Name] = append(removedByName[track.Name], track)
+	}
+	for _, track := range added {
+		if old := removedByName[track.Name]; len(old) > 0 {
+			pairs = append(pairs, pair{old[0], track})
+			removedByName[track.Name] = old[1:]
+			delete(prevByKey, channelKey(old[0]))
+			continue
+		}
+		report.Added = append(report.Added, newChannelChange(track))
+	}
+	for _, track := range prevByKey {
+		report.Removed = append(report.Removed, newChannelChange(track))
+	}
+
+	for _, p := range pairs {
+		change := newChannelChange(p.next)
+		if p.prev.Name != p.next.Name {
+			renamed := change
+			renamed.OldName = p.prev.Name
+			report.Renamed = append(report.Renamed, renamed)
+		}
+		if oldGroup := p.prev.Tags["group-title"]; oldGroup != change.Group {
+			regrouped := change
+			regrouped.OldGroup = oldGroup
+			report.Regrouped = append(report.Regrouped, regrouped)
+		}
+
+		was, is := prevCovered[p.prev.Tags["tvg-id"]], covered[p.next.Tags["tvg-id"]]
+		if !was && is {
+			report.EPG.Gained = append(report.EPG.Gained, change)
+		} else if was && !is {
+			report.EPG.Lost = append(report.EPG.Lost, change)
+		}
+	}
+
+	for _, changes := range [][]channelChange{report.Added, report.Removed, report.Renamed,
+		report.Regrouped, report.EPG.Gained, report.EPG.Lost} {
+		sort.Slice(changes, func(i, j int) bool { return changes[i].Name < changes[j].Name })
+	}
+
+	return report
+}
+
+func (r *refreshReport) log() {
+	logger := log.WithFields(log.Fields{
+		"channelCount": r.ChannelCount,
+		"epgCovered":   r.EPG.Covered,
+	})
+	if r.Initial {
+		logger.Info("loaded channel lineup")
+		return
+	}
+	logger.WithFields(log.Fields{
+		"added":     len(r.Added),
+		"removed":   len(r.Removed),
+		"renamed":   len(r.Renamed),
+		"regrouped": len(r.Regrouped),
+		"epgGained": len(r.EPG.Gained),
+		"epgLost":   len(r.EPG.Lost),
+	}).Info("channel lineup changes")
+}
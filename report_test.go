@@ -0,0 +1,142 @@
+package proxytv
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/csfrancis/proxytv/xmltv"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiffSnapshots(t *testing.T) {
+	source := &Source{Name: "primary"}
+	track := func(id string, name string, group string) Track {
+		return Track{
+			ID:     id + name,
+			Name:   name,
+			Tags:   map[string]string{"tvg-id": id, "group-title": group},
+			Source: source,
+		}
+	}
+	guide := func(ids ...string) *xmltv.TV {
+		tv := &xmltv.TV{}
+		for _, id := range ids {
+			tv.Programmes = append(tv.Programmes, xmltv.Programme{Channel: id})
+		}
+		return tv
+	}
+
+	prev := &snapshot{
+		tracks: []Track{
+			track("news", "News", "General"),
+			track("sports", "Sports", "General"),
+			track("movies", "Movies", "General"),
+			track("", "Local", "General"),
+			track("old", "Weather", "General"),
+		},
+		epg: guide("news", "sports"),
+	}
+	next := &snapshot{
+		tracks: []Track{
+			track("news", "News HD", "General"),
+			track("sports", "Sports", "Sports"),
+			track("", "Local", "General"),
+			track("new", "Weather", "General"),
+			track("kids", "Kids", "Family"),
+		},
+		epg: guide("news", "kids", "new"),
+	}
+
+	report := diffSnapshots(prev, next)
+	assert.False(t, report.Initial)
+	assert.True(t, report.HasChanges())
+	assert.Equal(t, 5, report.ChannelCount)
+
+	require.Len(t, report.Added, 1)
+	assert.Equal(t, "Kids", report.Added[0].Name)
+	require.Len(t, report.Removed, 1)
+	assert.Equal(t, "Movies", report.Removed[0].Name)
+	require.Len(t, report.Renamed, 1)
+	assert.Equal(t, "News", report.Renamed[0].OldName)
+	assert.Equal(t, "News HD", report.Renamed[0].Name)
+	require.Len(t, report.Regrouped, 1)
+	assert.Equal(t, "Sports", report.Regrouped[0].Name)
+	assert.Equal(t, "General", report.Regrouped[0].OldGroup)
+	assert.Equal(t, "Sports", report.Regrouped[0].Group)
+
+	assert.Equal(t, 2, report.EPG.PreviousCovered)
+	assert.Equal(t, 3, report.EPG.Covered)
+	require.Len(t, report.EPG.Gained, 1)
+	assert.Equal(t, "Weather", report.EPG.Gained[0].Name)
+	require.Len(t, report.EPG.Lost, 1)
+	assert.Equal(t, "Sports", report.EPG.Lost[0].Name)
+
+	t.Run("Initial", func(t *testing.T) {
+		report := diffSnapshots(emptySnapshot, next)
+		assert.True(t, report.Initial)
+		assert.Empty(t, report.Added)
+		assert.Equal(t, 3, report.EPG.Covered)
+	})
+
+	t.Run("Unchanged", func(t *testing.T) {
+		assert.False(t, diffSnapshots(next, next).HasChanges())
+	})
+}
+
+func TestServerRefreshReport(t *testing.T) {
+	dir := t.TempDir()
+	m3uPath := filepath.Join(dir, "iptv.m3u")
+	require.NoError(t, os.WriteFile(m3uPath, []byte(testM3uContent), 0644))
+	epgPath := filepath.Join(dir, "epg.xml")
+	require.NoError(t, os.WriteFile(epgPath, []byte(testEpgContent), 0644))
+
+	config := &Config{
+		IPTVUrl: m3uPath,
+		EPGUrl:  epgPath,
+		Filters: []*Filter{{Type: "id", Value: ".*"}},
+	}
+	require.NoError(t, config.compileFilterRegexps())
+
+	provider, err := NewProvider(config)
+	require.NoError(t, err)
+
+	server, err := NewServer(config, provider, "test")
+	require.NoError(t, err)
+	server.setupRoutes()
+
+	request := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		server.router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+
+	assert.Equal(t, http.StatusNotFound, request("/api/refresh/last").Code)
+
+	require.NoError(t, provider.Refresh())
+	require.NoError(t, os.WriteFile(m3uPath, []byte(`#EXTM3U
+#EXTINF:-1 tvg-id="id1" tvg-name="name1" group-title="News",Channel One
+http://example.com/channel1`), 0644))
+	require.NoError(t, provider.Refresh())
+
+	w := request("/api/refresh/last")
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var report refreshReport
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+	assert.Equal(t, 1, report.ChannelCount)
+	require.Len(t, report.Removed, 1)
+	assert.Equal(t, "Channel 2", report.Removed[0].Name)
+	require.Len(t, report.Renamed, 1)
+	assert.Equal(t, "Channel One", report.Renamed[0].Name)
+	require.Len(t, report.Regrouped, 1)
+	assert.Equal(t, "News", report.Regrouped[0].Group)
+
+	w = request("/refresh-report")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "Channel 1 &rarr; Channel One")
+}
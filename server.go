@@ -1,18 +1,16 @@
 package proxytv
 
 import (
-	"bufio"
 	"bytes"
+	"cmp"
 	"context"
 	"errors"
 	"fmt"
 	"io"
 	"io/fs"
+	"net"
 	"net/http"
-	"os/exec"
 	"path"
-	"strconv"
-	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -30,7 +28,10 @@ import (
 	"golang.org/x/sync/semaphore"
 )
 
-const channelURIPrefix = "/channel/"
+const (
+	channelURIPrefix = "/channel/"
+	profileURIPrefix = "/p/"
+)
 
 var startTime = time.Now()
 
@@ -40,34 +41,38 @@ type Server struct {
 	server        *http.Server
 	provider      *Provider
 	useFfmpeg     bool
+	relay         bool
 	streamsSem    *semaphore.Weighted
 	maxStreams    int64
 	totalStreams  int64
-	streams       map[*http.Request]*streamInfo
+	streams       map[any]*streamInfo // by request, or by session for HLS
 	lock          sync.Mutex
 	version       string
 	headContent   template.HTML
+
+	opener       streamOpener
+	startTimeout time.Duration
+	stallTimeout time.Duration
+
+	hls  *hlsRelay
+	hdhr *hdhomerun
+	ssdp *ssdpResponder
 }
 
 type streamInfo struct {
 	ClientIP  string    `json:"clientIP"`
-	ChannelID int       `json:"channelID"`
+	ChannelID string    `json:"channelID"`
 	Name      string    `json:"name,omitempty"`
 	LogoURL   string    `json:"logoUrl,omitempty"`
 	StartTime time.Time `json:"startTime"`
 }
 
-func newStreamInfo(request *http.Request) (*streamInfo, error) {
-	channelID, err := strconv.Atoi(request.RequestURI[len(channelURIPrefix):])
-	if err != nil {
-		return nil, err
-	}
-
+func newStreamInfo(request *http.Request, channelID string) *streamInfo {
 	return &streamInfo{
 		ClientIP:  request.RemoteAddr,
 		ChannelID: channelID,
 		StartTime: time.Now(),
-	}, nil
+	}
 }
 
 func logrusLogFormatter(param gin.LogFormatterParams) string {
@@ -109,12 +114,26 @@ func NewServer(config *Config, provider *Provider, version string) (*Server, err
 		router:        gin.New(),
 		provider:      provider,
 		useFfmpeg:     config.UseFFMPEG,
+		relay:         config.Relay && !config.UseFFMPEG,
 		streamsSem:    semaphore.NewWeighted(int64(config.MaxStreams)),
 		maxStreams:    int64(config.MaxStreams),
 		totalStreams:  0,
-		streams:       make(map[*http.Request]*streamInfo),
+		streams:       make(map[any]*streamInfo),
 		version:       version,
 		headContent:   headContent(version),
+		opener:        ffmpegOpener{},
+		startTimeout:  config.Stream.StartTimeout,
+		stallTimeout:  config.Stream.StallTimeout,
+		hls:           newHLSRelay(config),
+		hdhr:          newHDHomeRun(config),
+	}
+
+	if server.relay {
+		server.opener = newHTTPOpener(config)
+	}
+
+	if server.hdhr != nil && config.HDHomeRun.SSDP {
+		server.ssdp = newSSDPResponder(server.hdhr, version)
 	}
 
 	server.router.Use(gin.LoggerWithFormatter(logrusLogFormatter))
@@ -130,20 +149,37 @@ func NewServer(config *Config, provider *Provider, version string) (*Server, err
 
 func (s *Server) getIptvM3u() gin.HandlerFunc {
 	return func(c *gin.Context) {
+		m3u, ok := s.provider.GetProfileM3u(c.Param("profile"))
+		if !ok {
+			c.String(http.StatusNotFound, "Profile not found")
+			return
+		}
 		c.Header("Content-Disposition", "attachment; filename=tv_channels.m3u")
 		c.Header("Content-Description", "File Transfer")
 		c.Header("Cache-Control", "no-cache")
-		c.Data(200, "application/octet-stream", []byte(s.provider.GetM3u()))
+		c.Data(200, "application/octet-stream", []byte(m3u))
 	}
 }
 
 func (s *Server) getEpgXML() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		c.Data(200, "application/xml", []byte(s.provider.GetEpgXML()))
+		epg, ok := s.provider.GetProfileEpgFile(c.Param("profile"))
+		if !ok {
+			c.String(http.StatusNotFound, "Profile not found")
+			return
+		}
+		if epg == nil {
+			c.String(http.StatusServiceUnavailable, "EPG not loaded")
+			return
+		}
+		defer epg.release()
+		epg.serve(c.Writer, c.Request)
 	}
 }
 
-func (s *Server) remuxStream(c *gin.Context, track *Track, channelID int) {
+// acquireStream takes one of the maxStreams slots, waiting briefly for one to
+// be released. It returns false if none is available.
+func (s *Server) acquireStream(channelID string) bool {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
@@ -151,11 +187,21 @@ func (s *Server) remuxStream(c *gin.Context, track *Track, channelID int) {
 		log.WithFields(log.Fields{
 			"channelId": channelID,
 		}).Warn("max streams reached")
+		return false
+	}
+	return true
+}
+
+// proxyStream streams a track to the client, remuxed by ffmpeg or relayed
+// from the upstream as it is.
+func (s *Server) proxyStream(c *gin.Context, track *Track, channelID string) {
+	if !s.acquireStream(channelID) {
 		c.String(429, "Too many requests")
 		return
 	}
 	defer s.streamsSem.Release(1)
 
+	s.lock.Lock()
 	streamInfo := s.streams[c.Request]
 	if streamInfo == nil {
 		log.Warn("no stream info found")
@@ -165,78 +211,71 @@ func (s *Server) remuxStream(c *gin.Context, track *Track, channelID int) {
 			streamInfo.LogoURL = logo
 		}
 	}
+	s.lock.Unlock()
 
 	logger := log.WithFields(log.Fields{
-		"url":       track.URI.String(),
+		"url":       redactURL(track.URI.String()),
 		"channelId": channelID,
 		"clientIP":  c.RemoteIP(),
 	})
-	logger.Info("remuxing stream")
-
-	start := time.Now()
-
-	run := exec.Command("ffmpeg", "-i", track.URI.String(), "-c:v", "copy", "-f", "mpegts", "pipe:1")
-	logger.WithField("cmd", strings.Join(run.Args, " ")).Debug("executing ffmpeg")
-	ffmpegout, err := run.StdoutPipe()
-	if err != nil {
-		logger.WithError(err).Error("error creating ffmpeg stdout pipe")
-		return
+	if track.Source != nil {
+		logger = logger.WithField("source", track.Source.Name)
 	}
-
-	stderr, stderrErr := run.StderrPipe()
-	if stderrErr != nil {
-		logger.WithError(stderrErr).Errorln("error creating ffmpeg stderr pipe")
+	if s.relay {
+		logger.Info("relaying stream")
+	} else {
+		logger.Info("remuxing stream")
 	}
 
-	if startErr := run.Start(); startErr != nil {
-		log.WithError(startErr).Errorln("error starting ffmpeg")
+	start := time.Now()
+
+	stream := newFailoverStream(c.Request.Context(), s.opener, track, s.startTimeout, s.stallTimeout, logger)
+	defer stream.Close()
+	if err := stream.start(); err != nil {
+		logger.WithError(err).Error("unable to start stream")
+		c.String(http.StatusBadGateway, "Unable to start stream")
 		return
 	}
-	defer run.Wait()
-
-	go func() {
-		scanner := bufio.NewScanner(stderr)
-		scanner.Split(split)
-		for scanner.Scan() {
-			log.Debugln(scanner.Text())
-		}
-	}()
 
 	atomic.AddInt64(&s.totalStreams, 1)
 
-	bytesWritten := int64(0)
-	continueStream := true
-	c.Header("Content-Type", `video/mpeg; codecs="avc1.4D401E"`)
+	// Relayed streams keep the content type of the upstream, which may not be
+	// MPEG-TS
+	contentType := `video/mpeg; codecs="avc1.4D401E"`
+	if s.relay {
+		contentType = cmp.Or(stream.contentType(), "video/mp2t")
+	}
+	c.Header("Content-Type", contentType)
 
 	c.Stream(func(w io.Writer) bool {
-		defer func() {
-			logger.WithFields(log.Fields{
-				"duration": time.Since(start),
-				"bytes":    bytesWritten,
-			}).Info("stopped streaming")
-			if killErr := run.Process.Kill(); killErr != nil {
-				logger.WithError(killErr).Error("error killing ffmpeg")
-			}
-			continueStream = false
-		}()
-
-		timeoutReader := NewTimeoutReader(ffmpegout, 30*time.Second)
-		timeoutWriter := NewTimeoutWriter(w, 30*time.Second)
+		timeoutWriter := NewTimeoutWriter(&flushWriter{w: w, flusher: c.Writer}, 30*time.Second)
 
-		if bytesWritten, err = io.Copy(timeoutWriter, timeoutReader); err != nil {
+		bytesWritten, err := io.Copy(timeoutWriter, stream)
+		if err != nil && c.Request.Context().Err() == nil {
 			if err == ErrTimeout {
 				logger.Warn("timeout occurred during stream copy")
 			} else if !errors.Is(err, syscall.EPIPE) {
 				logger.WithError(err).Error("error when copying data")
 			}
-			continueStream = false
-			return false
 		}
 
-		return continueStream
+		logger.WithFields(log.Fields{
+			"duration": time.Since(start),
+			"bytes":    bytesWritten,
+			"switches": stream.switches,
+		}).Info("stopped streaming")
+		return false
 	})
 }
 
+func ffmpegArgs(track *Track) []string {
+	var args []string
+	if track.Source != nil && track.Source.UserAgent != "" {
+		args = append(args, "-user_agent", track.Source.UserAgent)
+	}
+	return append(args, "-i", track.URI.String(), "-c:v", "copy", "-f", "mpegts", "pipe:1")
+}
+
 func split(data []byte, atEOF bool) (advance int, token []byte, spliterror error) {
 	if atEOF && len(data) == 0 {
 		return 0, nil, nil
@@ -267,45 +306,80 @@ func (s *Server) refresh() gin.HandlerFunc {
 			c.String(500, "Error refreshing provider")
 			return
 		}
+		c.Header("HX-Trigger", "refreshed")
 		c.String(200, "Provider refreshed successfully")
 	}
 }
 
-func (s *Server) streamChannel() gin.HandlerFunc {
+func (s *Server) getRefreshReport() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		channelIDParam := c.Param("channelId")
-		channelID, err := strconv.Atoi(channelIDParam)
-		if err != nil {
-			log.WithError(err).Warn("invalid channelId")
-			c.String(400, "Invalid channel id")
+		report := s.provider.GetRefreshReport()
+		if report == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "no refresh has completed"})
 			return
 		}
+		c.JSON(http.StatusOK, report)
+	}
+}
 
-		if !s.useFfmpeg {
+func (s *Server) getEPGMatchReport() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		report := s.provider.GetEPGMatchReport()
+		if report == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "no guide has been loaded"})
+			return
+		}
+		c.JSON(http.StatusOK, report)
+	}
+}
+
+func (s *Server) getEPGMatchReportPanel() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.HTML(http.StatusOK, "epg_report.html", gin.H{"Report": s.provider.GetEPGMatchReport()})
+	}
+}
+
+func (s *Server) getRefreshReportPanel() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.HTML(http.StatusOK, "refresh_report.html", gin.H{"Report": s.provider.GetRefreshReport()})
+	}
+}
+
+func (s *Server) streamChannel() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		channelID := c.Param("channelId")
+
+		if !s.useFfmpeg && !s.relay && s.hls == nil {
 			c.String(404, "Channel not found")
 			return
 		}
 
-		track := s.provider.GetTrack(channelID)
+		track := s.provider.GetProfileTrack(c.Param("profile"), channelID)
 		if track.URI == nil {
 			log.WithField("channelId", channelID).Warn("channel not found")
 			c.String(404, "Channel not found")
 			return
 		}
 
-		s.remuxStream(c, track, channelID)
+		if s.hls != nil && isHLS(track.URI) {
+			s.serveHLS(c, track, channelID)
+			return
+		}
+		if !s.useFfmpeg && !s.relay {
+			c.String(404, "Channel not found")
+			return
+		}
+
+		s.proxyStream(c, track, channelID)
 	}
 }
 
 func (s *Server) streamTracker(c *gin.Context) {
-	isStream := strings.HasPrefix(c.Request.RequestURI, channelURIPrefix)
+	channelID := c.Param("channelId")
+	isStream := channelID != ""
 	if isStream {
 		s.lock.Lock()
-		if streamInfo, err := newStreamInfo(c.Request); err != nil {
-			log.WithError(err).Error("error creating stream info")
-		} else {
-			s.streams[c.Request] = streamInfo
-		}
+		s.streams[c.Request] = newStreamInfo(c.Request, channelID)
 		s.lock.Unlock()
 	}
 
@@ -323,7 +397,8 @@ func (s *Server) getActiveStreams() []*streamInfo {
 	defer s.lock.Unlock()
 	streams := make([]*streamInfo, 0, len(s.streams))
 	for _, stream := range s.streams {
-		streams = append(streams, stream)
+		info := *stream
+		streams = append(streams, &info)
 	}
 	return streams
 }
@@ -357,7 +432,11 @@ func (s *Server) debug() gin.HandlerFunc {
 				"max":         s.maxStreams,
 				"total":       totalStreams,
 				"lastRefresh": s.provider.GetLastRefresh().Format(time.RFC3339),
+				"stale":       s.provider.IsStale(),
 			},
+			"accounts": s.provider.GetAccounts(),
+			"sources":  s.provider.GetSourceStatus(),
+			"fetch":    s.provider.GetFetchMetrics(),
 		}
 
 		c.JSON(200, metrics)
@@ -419,6 +498,8 @@ func (s *Server) getStreamInfoData() gin.H {
 	return gin.H{
 		"ActiveStreams": s.getActiveStreams(),
 		"TotalStreams":  atomic.LoadInt64(&s.totalStreams),
+		"LastRefresh":   s.provider.GetLastRefresh(),
+		"Stale":         s.provider.IsStale(),
 		"Now":           time.Now(),
 	}
 }
@@ -429,7 +510,7 @@ func (s *Server) getStreamInfo() gin.HandlerFunc {
 	}
 }
 
-func (s *Server) Start(provider *Provider) chan error {
+func (s *Server) setupRoutes() {
 	s.router.GET("/ping", func(c *gin.Context) {
 		c.String(200, "PONG")
 	})
@@ -440,11 +521,29 @@ func (s *Server) Start(provider *Provider) chan error {
 	s.router.GET("/iptv.m3u", s.getIptvM3u())
 	s.router.GET("/epg.xml", s.getEpgXML())
 	s.router.GET(fmt.Sprintf("%s:channelId", channelURIPrefix), s.streamChannel())
+	s.router.GET(fmt.Sprintf("%s:profile/iptv.m3u", profileURIPrefix), s.getIptvM3u())
+	s.router.GET(fmt.Sprintf("%s:profile/epg.xml", profileURIPrefix), s.getEpgXML())
+	s.router.GET(fmt.Sprintf("%s:profile%s:channelId", profileURIPrefix, channelURIPrefix), s.streamChannel())
 	s.router.PUT("/refresh", s.refresh())
 	s.router.GET("/debug", s.debug())
 	s.router.GET("/stream-info", s.getStreamInfo())
+	s.router.GET("/refresh-report", s.getRefreshReportPanel())
+	s.router.GET("/api/refresh/last", s.getRefreshReport())
+	s.router.GET("/epg-report", s.getEPGMatchReportPanel())
+	s.router.GET("/api/epg/unmatched", s.getEPGMatchReport())
 	s.router.StaticFS("/static", static.AssetFile())
 
+	if s.hls != nil {
+		s.router.GET(fmt.Sprintf("%s:session/:token", hlsURIPrefix), s.relayHLS())
+	}
+	if s.hdhr != nil {
+		s.setupHDHomeRunRoutes()
+	}
+}
+
+func (s *Server) Start(provider *Provider) chan error {
+	s.setupRoutes()
+
 	s.server = &http.Server{
 		Addr:    s.listenAddress,
 		Handler: s.router,
@@ -454,13 +553,29 @@ func (s *Server) Start(provider *Provider) chan error {
 
 	errChan := make(chan error, 1)
 
+	// Listen before returning so the server accepts connections as soon as
+	// Start returns
+	listener, err := net.Listen("tcp", s.listenAddress)
+	if err != nil {
+		log.WithError(err).Error("failed to listen")
+		errChan <- err
+		return errChan
+	}
+
 	go func() {
-		if err := s.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.WithError(err).Error("failed to listen and serve")
+		if err := s.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.WithError(err).Error("failed to serve")
 			errChan <- err
 		}
 	}()
 
+	// The tuner can still be added by address if it can't be announced
+	if s.ssdp != nil {
+		if err := s.ssdp.start(ssdpAddress); err != nil {
+			log.WithError(err).Error("failed to start ssdp responder")
+		}
+	}
+
 	return errChan
 }
 
@@ -469,6 +584,10 @@ func (s *Server) Stop() error {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
+	if s.ssdp != nil {
+		s.ssdp.stop()
+	}
+
 	log.Info("stopping http server")
 
 	// Shutdown server
@@ -531,6 +650,21 @@ func (tw *TimeoutWriter) Write(p []byte) (int, error) {
 	}
 }
 
+// flushWriter flushes each write to the client, so that the stream isn't held
+// back in the response buffer.
+type flushWriter struct {
+	w       io.Writer
+	flusher http.Flusher
+}
+
+func (fw *flushWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	if err == nil {
+		fw.flusher.Flush()
+	}
+	return n, err
+}
+
 type readResult struct {
 	n   int
 	err error
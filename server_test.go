@@ -3,6 +3,10 @@ package proxytv
 import (
 	"io"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -57,3 +61,110 @@ func TestServerStartStop(t *testing.T) {
 	default:
 	}
 }
+
+func TestServerConcurrentRefresh(t *testing.T) {
+	m3u := newConditionalServer(testM3uContent, "")
+	defer m3u.Close()
+	epg := newConditionalServer(testEpgContent, "")
+	defer epg.Close()
+
+	config := &Config{
+		IPTVUrl:    m3u.URL + "/iptv.m3u",
+		EPGUrl:     epg.URL + "/epg.xml",
+		MaxStreams: 1,
+		Filters:    []*Filter{{Type: "id", Value: ".*"}},
+	}
+	require.NoError(t, config.compileFilterRegexps())
+
+	provider, err := NewProvider(config)
+	require.NoError(t, err)
+	require.NoError(t, provider.Refresh())
+
+	server, err := NewServer(config, provider, "test")
+	require.NoError(t, err)
+	server.setupRoutes()
+
+	request := func(method string, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		server.router.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+		return w
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				w := request(http.MethodGet, "/iptv.m3u")
+				assert.Equal(t, http.StatusOK, w.Code)
+				assert.Equal(t, 2, strings.Count(w.Body.String(), "#EXTINF"))
+
+				w = request(http.MethodGet, "/epg.xml")
+				assert.Equal(t, http.StatusOK, w.Code)
+				assert.Contains(t, w.Body.String(), `<channel id="id1">`)
+
+				assert.Equal(t, http.StatusOK, request(http.MethodGet, "/debug").Code)
+				assert.Equal(t, http.StatusOK, request(http.MethodGet, "/stream-info").Code)
+			}
+		}()
+	}
+
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				assert.Equal(t, http.StatusOK, request(http.MethodPut, "/refresh").Code)
+			}
+		}()
+	}
+
+	wg.Wait()
+}
+
+func TestServerProfiles(t *testing.T) {
+	m3uFile, err := createTempFile(testM3uContent, "test*.m3u")
+	require.NoError(t, err)
+	defer os.Remove(m3uFile.Name())
+	epgFile, err := createTempFile(testEpgContent, "test*.xml")
+	require.NoError(t, err)
+	defer os.Remove(epgFile.Name())
+
+	config := &Config{
+		IPTVUrl:  m3uFile.Name(),
+		EPGUrl:   epgFile.Name(),
+		Filters:  []*Filter{{Type: "id", Value: ".*"}},
+		Profiles: []*Profile{{Name: "one", Filters: []*Filter{{Type: "id", Value: "^id1$"}}}},
+	}
+	require.NoError(t, config.compileFilterRegexps())
+	require.NoError(t, config.validateProfiles())
+
+	provider, err := NewProvider(config)
+	require.NoError(t, err)
+	server, err := NewServer(config, provider, "test")
+	require.NoError(t, err)
+	server.setupRoutes()
+
+	request := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		server.router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+
+	assert.Equal(t, http.StatusServiceUnavailable, request("/p/one/epg.xml").Code)
+	require.NoError(t, provider.Refresh())
+
+	w := request("/p/one/iptv.m3u")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, 1, strings.Count(w.Body.String(), "#EXTINF"))
+	assert.Equal(t, 2, strings.Count(request("/iptv.m3u").Body.String(), "#EXTINF"))
+
+	w = request("/p/one/epg.xml")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `<channel id="id1">`)
+
+	assert.Equal(t, http.StatusNotFound, request("/p/two/iptv.m3u").Code)
+	assert.Equal(t, http.StatusNotFound, request("/p/two/epg.xml").Code)
+	assert.Equal(t, http.StatusNotFound, request("/p/two/channel/"+hashChannelKey("id:id1")).Code)
+}
@@ -0,0 +1,177 @@
+package proxytv
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	ssdpAddress        = "239.255.255.250:1900"
+	ssdpMaxAge         = 1800
+	ssdpNotifyInterval = 5 * time.Minute
+	ssdpDeviceType     = "urn:schemas-upnp-org:device:MediaServer:1"
+)
+
+// ssdpResponder announces the emulated HDHomeRun tuner on the local network,
+// so that clients find it without its address being entered. It answers
+// M-SEARCH requests and multicasts NOTIFY messages pointing at device.xml.
+type ssdpResponder struct {
+	location string
+	uuid     string
+	server   string
+	interval time.Duration
+
+	conn   *net.UDPConn
+	sender *net.UDPConn
+	group  *net.UDPAddr
+	done   chan struct{}
+	wg     sync.WaitGroup
+}
+
+func newSSDPResponder(h *hdhomerun, version string) *ssdpResponder {
+	return &ssdpResponder{
+		location: h.baseURL + "/device.xml",
+		uuid:     "uuid:" + h.deviceID,
+		server:   fmt.Sprintf("proxytv/%s UPnP/1.0", version),
+		interval: ssdpNotifyInterval,
+	}
+}
+
+// start joins the multicast group at address on the default interface, and
+// starts answering searches and sending announcements.
+func (r *ssdpResponder) start(address string) error {
+	group, err := net.ResolveUDPAddr("udp4", address)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenMulticastUDP("udp4", nil, group)
+	if err != nil {
+		return err
+	}
+	if group.Port == 0 {
+		group.Port = conn.LocalAddr().(*net.UDPAddr).Port
+	}
+	// Announcements are sent from their own socket, since the group listener
+	// doesn't loop multicasts back and clients on this host would miss them
+	sender, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	r.conn, r.sender, r.group, r.done = conn, sender, group, make(chan struct{})
+
+	log.WithFields(log.Fields{"address": group, "location": r.location}).Info("starting ssdp responder")
+
+	r.wg.Add(2)
+	go r.serve()
+	go r.announce()
+	return nil
+}
+
+// stop announces that the device is leaving and closes the connection.
+func (r *ssdpResponder) stop() {
+	if r.conn == nil {
+		return
+	}
+	close(r.done)
+	r.notify("ssdp:byebye")
+	r.conn.Close()
+	r.wg.Wait()
+	r.sender.Close()
+}
+
+// targets returns the search targets the device answers to.
+func (r *ssdpResponder) targets() []string {
+	return []string{"upnp:rootdevice", r.uuid, ssdpDeviceType}
+}
+
+func (r *ssdpResponder) usn(target string) string {
+	if target == r.uuid {
+		return r.uuid
+	}
+	return r.uuid + "::" + target
+}
+
+func (r *ssdpResponder) serve() {
+	defer r.wg.Done()
+	buf := make([]byte, 2048)
+	for {
+		n, from, err := r.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-r.done:
+			default:
+				log.WithError(err).Error("ssdp responder stopped")
+			}
+			return
+		}
+		r.handle(buf[:n], from)
+	}
+}
+
+func (r *ssdpResponder) handle(msg []byte, from *net.UDPAddr) {
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(msg)))
+	if err != nil || req.Method != "M-SEARCH" || req.Header.Get("MAN") != `"ssdp:discover"` {
+		return
+	}
+
+	st := req.Header.Get("ST")
+	for _, target := range r.targets() {
+		if st != "ssdp:all" && st != target {
+			continue
+		}
+		response := r.message("HTTP/1.1 200 OK", target, "EXT", "", "ST", target)
+		if _, err := r.conn.WriteToUDP(response, from); err != nil {
+			log.WithError(err).WithField("client", from).Warn("unable to answer ssdp search")
+			return
+		}
+	}
+	log.WithFields(log.Fields{"client": from, "st": st}).Debug("answered ssdp search")
+}
+
+func (r *ssdpResponder) announce() {
+	defer r.wg.Done()
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		r.notify("ssdp:alive")
+		select {
+		case <-ticker.C:
+		case <-r.done:
+			return
+		}
+	}
+}
+
+func (r *ssdpResponder) notify(nts string) {
+	for _, target := range r.targets() {
+		msg := r.message("NOTIFY * HTTP/1.1", target, "HOST", r.group.String(), "NT", target, "NTS", nts)
+		if _, err := r.sender.WriteToUDP(msg, r.group); err != nil {
+			log.WithError(err).Warn("unable to send ssdp notify")
+			return
+		}
+	}
+}
+
+// message formats an SSDP message about target with the given start line and
+// headers, followed by the headers common to every message about the device.
+func (r *ssdpResponder) message(start string, target string, headers ...string) []byte {
+	var b strings.Builder
+	b.WriteString(start + "\r\n")
+	for i := 0; i < len(headers); i += 2 {
+		fmt.Fprintf(&b, "%s: %s\r\n", headers[i], headers[i+1])
+	}
+	fmt.Fprintf(&b, "CACHE-CONTROL: max-age=%d\r\n", ssdpMaxAge)
+	fmt.Fprintf(&b, "LOCATION: %s\r\n", r.location)
+	fmt.Fprintf(&b, "SERVER: %s\r\n", r.server)
+	fmt.Fprintf(&b, "USN: %s\r\n\r\n", r.usn(target))
+	return []byte(b.String())
+}
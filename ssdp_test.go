@@ -0,0 +1,116 @@
+package proxytv
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSSDPResponder(t *testing.T) {
+	h := newHDHomeRun(&Config{
+		ServerAddress: "proxytv:6078",
+		MaxStreams:    1,
+		HDHomeRun:     HDHomeRunConfig{Enabled: true, DeviceID: "1234ABCD"},
+	})
+
+	// Announcements are received by joining the group on the responder's port
+	listener, err := net.ListenMulticastUDP("udp4", nil, &net.UDPAddr{IP: net.IPv4(239, 255, 255, 250)})
+	require.NoError(t, err)
+	defer listener.Close()
+	port := listener.LocalAddr().(*net.UDPAddr).Port
+	group := &net.UDPAddr{IP: net.IPv4(239, 255, 255, 250), Port: port}
+
+	responder := newSSDPResponder(h, "test")
+	require.NoError(t, responder.start(group.String()))
+	stopped := false
+	defer func() {
+		if !stopped {
+			responder.stop()
+		}
+	}()
+
+	// readNotify returns the next NOTIFY message sent to the group
+	readNotify := func(t *testing.T) *http.Request {
+		buf := make([]byte, 2048)
+		for {
+			require.NoError(t, listener.SetReadDeadline(time.Now().Add(2*time.Second)))
+			n, _, err := listener.ReadFromUDP(buf)
+			require.NoError(t, err)
+			req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(buf[:n])))
+			if err == nil && req.Method == "NOTIFY" {
+				return req
+			}
+		}
+	}
+
+	t.Run("Notify", func(t *testing.T) {
+		notify := readNotify(t)
+		assert.Equal(t, "ssdp:alive", notify.Header.Get("NTS"))
+		assert.Equal(t, "upnp:rootdevice", notify.Header.Get("NT"))
+		assert.Equal(t, "uuid:1234ABCD::upnp:rootdevice", notify.Header.Get("USN"))
+		assert.Equal(t, "http://proxytv:6078/device.xml", notify.Header.Get("LOCATION"))
+	})
+
+	search := func(t *testing.T, st string) []*http.Response {
+		client, err := net.ListenUDP("udp4", nil)
+		require.NoError(t, err)
+		defer client.Close()
+
+		msg := fmt.Sprintf("M-SEARCH * HTTP/1.1\r\nHOST: %s\r\nMAN: \"ssdp:discover\"\r\nMX: 1\r\nST: %s\r\n\r\n", group, st)
+		_, err = client.WriteToUDP([]byte(msg), group)
+		require.NoError(t, err)
+
+		var responses []*http.Response
+		buf := make([]byte, 2048)
+		for {
+			require.NoError(t, client.SetReadDeadline(time.Now().Add(500*time.Millisecond)))
+			n, _, err := client.ReadFromUDP(buf)
+			if err != nil {
+				return responses
+			}
+			resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+			require.NoError(t, err)
+			responses = append(responses, resp)
+		}
+	}
+
+	t.Run("Search", func(t *testing.T) {
+		responses := search(t, ssdpDeviceType)
+		require.Len(t, responses, 1)
+		assert.Equal(t, http.StatusOK, responses[0].StatusCode)
+		assert.Equal(t, ssdpDeviceType, responses[0].Header.Get("ST"))
+		assert.Equal(t, "uuid:1234ABCD::"+ssdpDeviceType, responses[0].Header.Get("USN"))
+		assert.Equal(t, "http://proxytv:6078/device.xml", responses[0].Header.Get("LOCATION"))
+		assert.Equal(t, "max-age=1800", responses[0].Header.Get("CACHE-CONTROL"))
+	})
+
+	t.Run("Search all", func(t *testing.T) {
+		var targets []string
+		for _, resp := range search(t, "ssdp:all") {
+			targets = append(targets, resp.Header.Get("ST"))
+		}
+		assert.ElementsMatch(t, []string{"upnp:rootdevice", "uuid:1234ABCD", ssdpDeviceType}, targets)
+	})
+
+	t.Run("Other targets are ignored", func(t *testing.T) {
+		assert.Empty(t, search(t, "urn:schemas-upnp-org:device:InternetGatewayDevice:1"))
+	})
+
+	t.Run("Bye", func(t *testing.T) {
+		responder.stop()
+		stopped = true
+		byebye := make(map[string]bool)
+		for len(byebye) < len(responder.targets()) {
+			if notify := readNotify(t); notify.Header.Get("NTS") == "ssdp:byebye" {
+				byebye[notify.Header.Get("NT")] = true
+			}
+		}
+	})
+}
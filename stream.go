@@ -0,0 +1,309 @@
+package proxytv
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var errNoVariants = errors.New("no variant of the channel could be started")
+
+// streamOpener starts reading the stream of a track. The stream is stopped
+// when the returned reader is closed or ctx is done.
+type streamOpener interface {
+	open(ctx context.Context, track *Track) (io.ReadCloser, error)
+}
+
+// ffmpegOpener remuxes streams with ffmpeg.
+type ffmpegOpener struct{}
+
+type ffmpegProcess struct {
+	io.ReadCloser
+	cmd *exec.Cmd
+}
+
+func (p *ffmpegProcess) Close() error {
+	if err := p.cmd.Process.Kill(); err != nil {
+		log.WithError(err).Debug("error killing ffmpeg")
+	}
+	p.cmd.Wait()
+	return nil
+}
+
+func (ffmpegOpener) open(ctx context.Context, track *Track) (io.ReadCloser, error) {
+	run := exec.CommandContext(ctx, "ffmpeg", ffmpegArgs(track)...)
+	uri := track.URI.String()
+	log.WithField("cmd", strings.ReplaceAll(strings.Join(run.Args, " "), uri, redactURL(uri))).Debug("executing ffmpeg")
+	stdout, err := run.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := run.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := run.Start(); err != nil {
+		return nil, err
+	}
+
+	go func() {
+		scanner := bufio.NewScanner(stderr)
+		scanner.Split(split)
+		for scanner.Scan() {
+			log.Debugln(scanner.Text())
+		}
+	}()
+
+	return &ffmpegProcess{ReadCloser: stdout, cmd: run}, nil
+}
+
+// httpOpener reads streams directly from the upstream server.
+type httpOpener struct {
+	client *http.Client
+}
+
+// newHTTPOpener returns an opener that connects within the fetch connect
+// timeout and waits no longer than the stream start timeout for the response
+// headers, so that an upstream that never answers fails over.
+func newHTTPOpener(config *Config) *httpOpener {
+	transport := newTransport(config.Fetch.ConnectTimeout, config.Stream.StartTimeout)
+	return &httpOpener{client: &http.Client{Transport: transport}}
+}
+
+// httpStream is the body of an upstream response, with its content type.
+type httpStream struct {
+	io.ReadCloser
+	contentType string
+}
+
+func (o *httpOpener) open(ctx context.Context, track *Track) (io.ReadCloser, error) {
+	resp, err := o.get(ctx, track, track.URI.String())
+	if err != nil {
+		return nil, err
+	}
+	return &httpStream{ReadCloser: resp.Body, contentType: resp.Header.Get("Content-Type")}, nil
+}
+
+// get requests rawURL with the user agent of the track's source.
+func (o *httpOpener) get(ctx context.Context, track *Track, rawURL string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if track.Source != nil && track.Source.UserAgent != "" {
+		req.Header.Set("User-Agent", track.Source.UserAgent)
+	}
+
+	client := o.client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, redactError(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, &httpStatusError{code: resp.StatusCode}
+	}
+	return resp, nil
+}
+
+// upstream reads a stream in the background, so that a read that blocks can
+// be abandoned when the stream stalls.
+type upstream struct {
+	reader io.ReadCloser
+	chunks chan []byte
+	done   chan struct{}
+	once   sync.Once
+	err    error
+}
+
+func newUpstream(reader io.ReadCloser) *upstream {
+	u := &upstream{reader: reader, chunks: make(chan []byte), done: make(chan struct{})}
+	go u.pump()
+	return u
+}
+
+func (u *upstream) pump() {
+	defer close(u.chunks)
+	for {
+		buf := make([]byte, 32*1024)
+		n, err := u.reader.Read(buf)
+		if n > 0 {
+			select {
+			case u.chunks <- buf[:n]:
+			case <-u.done:
+				return
+			}
+		}
+		if err != nil {
+			u.err = err
+			return
+		}
+	}
+}
+
+// next returns the next chunk of the stream, or ErrTimeout if none arrives
+// within timeout. A zero timeout waits indefinitely.
+func (u *upstream) next(ctx context.Context, timeout time.Duration) ([]byte, error) {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	select {
+	case chunk, ok := <-u.chunks:
+		if !ok {
+			if u.err == nil || errors.Is(u.err, io.EOF) {
+				return nil, io.ErrUnexpectedEOF
+			}
+			return nil, u.err
+		}
+		return chunk, nil
+	case <-expired:
+		return nil, ErrTimeout
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (u *upstream) close() {
+	u.once.Do(func() {
+		close(u.done)
+		u.reader.Close()
+	})
+}
+
+// failoverStream reads the stream of a channel, switching to the channel's
+// next variant when the current one fails to start, ends or stalls. The
+// stream ends once every variant has failed without delivering any data.
+type failoverStream struct {
+	ctx          context.Context
+	opener       streamOpener
+	variants     []*Track
+	startTimeout time.Duration
+	stallTimeout time.Duration
+	logger       *log.Entry
+
+	current  int
+	failures int
+	switches int
+	upstream *upstream
+	pending  []byte
+}
+
+func newFailoverStream(ctx context.Context, opener streamOpener, track *Track, startTimeout time.Duration,
+	stallTimeout time.Duration, logger *log.Entry) *failoverStream {
+	variants := make([]*Track, 0, 1+len(track.Alternates))
+	variants = append(variants, track)
+	for i := range track.Alternates {
+		variants = append(variants, &track.Alternates[i])
+	}
+	return &failoverStream{
+		ctx:          ctx,
+		opener:       opener,
+		variants:     variants,
+		startTimeout: startTimeout,
+		stallTimeout: stallTimeout,
+		logger:       logger,
+	}
+}
+
+// start opens the first variant that delivers data.
+func (f *failoverStream) start() error {
+	return f.openFrom(0)
+}
+
+// openFrom tries the variants in turn, starting at i, until one delivers data
+// or every variant has failed since data was last delivered.
+func (f *failoverStream) openFrom(i int) error {
+	for f.failures < len(f.variants) {
+		if err := f.ctx.Err(); err != nil {
+			return err
+		}
+		n := i % len(f.variants)
+		track := f.variants[n]
+		logger := f.logger.WithFields(log.Fields{"url": redactURL(track.URI.String()), "variant": n})
+
+		reader, err := f.opener.open(f.ctx, track)
+		if err == nil {
+			u := newUpstream(reader)
+			var chunk []byte
+			if chunk, err = u.next(f.ctx, f.startTimeout); err == nil {
+				if f.failures > 0 {
+					f.switches++
+					logger.Warn("switched to alternate stream")
+				}
+				f.current, f.upstream, f.pending, f.failures = n, u, chunk, 0
+				return nil
+			}
+			u.close()
+		}
+		if f.ctx.Err() != nil {
+			return f.ctx.Err()
+		}
+
+		logger.WithError(err).Warn("stream failed to start")
+		f.failures++
+		i++
+	}
+	return errNoVariants
+}
+
+func (f *failoverStream) Read(p []byte) (int, error) {
+	for len(f.pending) == 0 {
+		if f.upstream == nil {
+			return 0, errNoVariants
+		}
+		chunk, err := f.upstream.next(f.ctx, f.stallTimeout)
+		if err == nil {
+			f.pending = chunk
+			break
+		}
+		if f.ctx.Err() != nil {
+			return 0, f.ctx.Err()
+		}
+
+		f.logger.WithError(err).WithField("variant", f.current).Warn("stream failed")
+		f.upstream.close()
+		f.upstream = nil
+		f.failures = 1
+		if err := f.openFrom(f.current + 1); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, f.pending)
+	f.pending = f.pending[n:]
+	return n, nil
+}
+
+// contentType returns the content type the upstream reported for the variant
+// being streamed, or an empty string if it didn't report one.
+func (f *failoverStream) contentType() string {
+	if f.upstream == nil {
+		return ""
+	}
+	if s, ok := f.upstream.reader.(*httpStream); ok {
+		return s.contentType
+	}
+	return ""
+}
+
+func (f *failoverStream) Close() error {
+	if f.upstream != nil {
+		f.upstream.close()
+	}
+	return nil
+}
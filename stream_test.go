@@ -0,0 +1,230 @@
+package proxytv
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newFakeUpstream serves a stream that fails with a 404, one that never
+// answers, one that never sends any data, one that sends a chunk and then
+// stalls, and one that keeps sending data.
+func newFakeUpstream(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/missing", http.NotFound)
+	mux.HandleFunc("/silent", func(w http.ResponseWriter, r *http.Request) {
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	})
+	mux.HandleFunc("/hang", func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	})
+	mux.HandleFunc("/stall", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "video/mp2t")
+		w.Write([]byte("stall-"))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	})
+	mux.HandleFunc("/live", func(w http.ResponseWriter, r *http.Request) {
+		w.Header()["Content-Type"] = nil
+		for r.Context().Err() == nil {
+			if _, err := w.Write([]byte("live")); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestFailoverStream(t *testing.T) {
+	upstream := newFakeUpstream(t)
+	track := func(paths ...string) *Track {
+		tracks := make([]Track, len(paths))
+		for i, path := range paths {
+			tracks[i] = Track{URI: mustParseURL(upstream.URL + path)}
+		}
+		tracks[0].Alternates = tracks[1:]
+		return &tracks[0]
+	}
+	logger := log.NewEntry(log.StandardLogger())
+
+	t.Run("Switches on failure and stall", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		stream := newFailoverStream(ctx, &httpOpener{}, track("/missing", "/stall", "/live"), time.Second, 100*time.Millisecond, logger)
+		defer stream.Close()
+		require.NoError(t, stream.start())
+		assert.Equal(t, "video/mp2t", stream.contentType())
+
+		buf := make([]byte, 10)
+		_, err := io.ReadFull(stream, buf)
+		require.NoError(t, err)
+		assert.Equal(t, "stall-live", string(buf))
+		assert.Equal(t, 2, stream.switches)
+		assert.Empty(t, stream.contentType())
+	})
+
+	t.Run("No variant starts", func(t *testing.T) {
+		stream := newFailoverStream(context.Background(), &httpOpener{}, track("/missing", "/missing"), time.Second, time.Second, logger)
+		defer stream.Close()
+		assert.ErrorIs(t, stream.start(), errNoVariants)
+	})
+
+	t.Run("Upstream never answers", func(t *testing.T) {
+		opener := newHTTPOpener(&Config{Stream: StreamConfig{StartTimeout: 50 * time.Millisecond}})
+		stream := newFailoverStream(context.Background(), opener, track("/hang"), 50*time.Millisecond, time.Second, logger)
+		defer stream.Close()
+		assert.ErrorIs(t, stream.start(), errNoVariants)
+	})
+
+	t.Run("Start timeout", func(t *testing.T) {
+		stream := newFailoverStream(context.Background(), &httpOpener{}, track("/silent"), 50*time.Millisecond, time.Second, logger)
+		defer stream.Close()
+		assert.ErrorIs(t, stream.start(), errNoVariants)
+	})
+}
+
+func TestServerStreamFailover(t *testing.T) {
+	upstream := newFakeUpstream(t)
+
+	dir := t.TempDir()
+	m3uPath := filepath.Join(dir, "iptv.m3u")
+	require.NoError(t, os.WriteFile(m3uPath, []byte(fmt.Sprintf(`#EXTM3U
+#EXTINF:-1 tvg-id="id1",Channel HD
+%[1]s/missing
+#EXTINF:-1 tvg-id="id1",Channel SD
+%[1]s/live
+#EXTINF:-1 tvg-id="id2",Other
+%[1]s/missing`, upstream.URL)), 0644))
+	epgPath := filepath.Join(dir, "epg.xml")
+	require.NoError(t, os.WriteFile(epgPath, []byte(testEpgContent), 0644))
+
+	config := &Config{
+		IPTVUrl:    m3uPath,
+		EPGUrl:     epgPath,
+		UseFFMPEG:  true,
+		MaxStreams: 1,
+		Filters:    []*Filter{{Type: "id", Value: ".*"}},
+		Stream:     StreamConfig{StartTimeout: time.Second, StallTimeout: time.Second},
+	}
+	require.NoError(t, config.compileFilterRegexps())
+
+	provider, err := NewProvider(config)
+	require.NoError(t, err)
+	require.NoError(t, provider.Refresh())
+
+	server, err := NewServer(config, provider, "test")
+	require.NoError(t, err)
+	server.opener = &httpOpener{}
+	server.setupRoutes()
+
+	proxy := httptest.NewServer(server.router)
+	defer proxy.Close()
+
+	tracks := provider.snapshot().tracks
+	require.Len(t, tracks, 2)
+	require.Len(t, tracks[0].Alternates, 1)
+
+	resp, err := http.Get(proxy.URL + channelURIPrefix + tracks[0].ID)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(resp.Body, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "live", string(buf))
+	resp.Body.Close()
+
+	require.Eventually(t, func() bool { return server.streamsSem.TryAcquire(1) }, time.Second, 10*time.Millisecond)
+	server.streamsSem.Release(1)
+
+	resp, err = http.Get(proxy.URL + channelURIPrefix + tracks[1].ID)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+}
+
+func TestServerRelay(t *testing.T) {
+	started := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("User-Agent") != "relay-agent" {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Content-Type", "video/x-flv")
+		w.Write([]byte("relay"))
+		w.(http.Flusher).Flush()
+		close(started)
+		<-r.Context().Done()
+	}))
+	defer upstream.Close()
+
+	dir := t.TempDir()
+	m3uPath := filepath.Join(dir, "iptv.m3u")
+	require.NoError(t, os.WriteFile(m3uPath, []byte(fmt.Sprintf(`#EXTM3U
+#EXTINF:-1 tvg-id="id1",Channel 1
+%s/stream?token=secret`, upstream.URL)), 0644))
+	epgPath := filepath.Join(dir, "epg.xml")
+	require.NoError(t, os.WriteFile(epgPath, []byte(testEpgContent), 0644))
+
+	config := &Config{
+		IPTVUrl:       m3uPath,
+		EPGUrl:        epgPath,
+		ServerAddress: "proxytv:6078",
+		UserAgent:     "relay-agent",
+		Relay:         true,
+		MaxStreams:    1,
+		Filters:       []*Filter{{Type: "id", Value: ".*"}},
+		Stream:        StreamConfig{StartTimeout: time.Second, StallTimeout: time.Second},
+	}
+	require.NoError(t, config.compileFilterRegexps())
+
+	provider, err := NewProvider(config)
+	require.NoError(t, err)
+	require.NoError(t, provider.Refresh())
+
+	// The playlist points at the server rather than the upstream
+	tracks := provider.GetTracks()
+	require.Len(t, tracks, 1)
+	m3u := provider.GetM3u()
+	assert.Contains(t, m3u, "http://proxytv:6078"+channelURIPrefix+tracks[0].ID)
+	assert.NotContains(t, m3u, "secret")
+
+	server, err := NewServer(config, provider, "test")
+	require.NoError(t, err)
+	server.setupRoutes()
+
+	proxy := httptest.NewServer(server.router)
+	defer proxy.Close()
+
+	resp, err := http.Get(proxy.URL + channelURIPrefix + tracks[0].ID)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "video/x-flv", resp.Header.Get("Content-Type"))
+	<-started
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(resp.Body, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "relay", string(buf))
+
+	// The stream counts against maxStreams and is tracked while it's open
+	assert.False(t, server.streamsSem.TryAcquire(1))
+	active := server.getActiveStreams()
+	require.Len(t, active, 1)
+	assert.Equal(t, "Channel 1", active[0].Name)
+}
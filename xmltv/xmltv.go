@@ -149,6 +149,7 @@ type Channel struct {
 	DisplayNames []CommonElement `xml:"display-name"   json:"display_names"  `
 	Icons        []Icon          `xml:"icon,omitempty" json:"icons,omitempty"`
 	URLs         []string        `xml:"url,omitempty"  json:"urls,omitempty" `
+	LCN          string          `xml:"lcn,omitempty"  json:"lcn,omitempty"  `
 	ID           string          `xml:"id,attr"        json:"id,omitempty"   `
 }
 
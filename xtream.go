@@ -0,0 +1,341 @@
+package proxytv
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/csfrancis/proxytv/xmltv"
+	"golang.org/x/sync/errgroup"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const xtreamShortEPGConcurrency = 4
+
+// xtreamValue decodes Xtream API fields that are sent as either JSON strings
+// or numbers depending on the panel version.
+type xtreamValue string
+
+func (v *xtreamValue) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		*v = ""
+		return nil
+	}
+	if len(data) > 0 && data[0] == '"' {
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		*v = xtreamValue(s)
+		return nil
+	}
+	*v = xtreamValue(strings.TrimSpace(string(data)))
+	return nil
+}
+
+func (v xtreamValue) Int() int {
+	i, _ := strconv.Atoi(string(v))
+	return i
+}
+
+type xtreamAccount struct {
+	UserInfo struct {
+		Username       string      `json:"username"`
+		Status         string      `json:"status"`
+		ExpDate        xtreamValue `json:"exp_date"`
+		IsTrial        xtreamValue `json:"is_trial"`
+		ActiveCons     xtreamValue `json:"active_cons"`
+		MaxConnections xtreamValue `json:"max_connections"`
+	} `json:"user_info"`
+	ServerInfo struct {
+		URL      string      `json:"url"`
+		Port     xtreamValue `json:"port"`
+		Protocol string      `json:"server_protocol"`
+		Timezone string      `json:"timezone"`
+	} `json:"server_info"`
+}
+
+type xtreamCategory struct {
+	CategoryID   xtreamValue `json:"category_id"`
+	CategoryName string      `json:"category_name"`
+}
+
+type xtreamStream struct {
+	Num               xtreamValue `json:"num"`
+	Name              string      `json:"name"`
+	StreamID          xtreamValue `json:"stream_id"`
+	StreamIcon        string      `json:"stream_icon"`
+	EPGChannelID      xtreamValue `json:"epg_channel_id"`
+	CategoryID        xtreamValue `json:"category_id"`
+	TVArchive         xtreamValue `json:"tv_archive"`
+	TVArchiveDuration xtreamValue `json:"tv_archive_duration"`
+}
+
+type xtreamListing struct {
+	Title          string      `json:"title"`
+	Description    string      `json:"description"`
+	Lang           string      `json:"lang"`
+	StartTimestamp xtreamValue `json:"start_timestamp"`
+	StopTimestamp  xtreamValue `json:"stop_timestamp"`
+}
+
+// xtreamSource loads a playlist source through the Xtream Codes player API
+// instead of parsing the get.php M3U export.
+type xtreamSource struct {
+	source  *Source
+	fetcher *fetcher
+
+	lock      sync.Mutex
+	account   *xtreamAccount
+	streamIDs map[string]string // tvg-id to stream_id
+}
+
+func newXtreamSource(source *Source, fetcher *fetcher) *xtreamSource {
+	return &xtreamSource{source: source, fetcher: fetcher}
+}
+
+func (x *xtreamSource) apiURL(params url.Values) string {
+	params.Set("username", x.source.Username)
+	params.Set("password", x.source.Password)
+	return fmt.Sprintf("%s/player_api.php?%s", strings.TrimSuffix(x.source.URL, "/"), params.Encode())
+}
+
+func (x *xtreamSource) call(action string, params url.Values, v any) error {
+	if params == nil {
+		params = url.Values{}
+	}
+	if action != "" {
+		params.Set("action", action)
+	}
+
+	reader, err := x.fetcher.load(x.apiURL(params), x.source.UserAgent)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	if err := json.NewDecoder(reader).Decode(v); err != nil {
+		return fmt.Errorf("invalid %q response: %w", action, err)
+	}
+	return nil
+}
+
+func (x *xtreamSource) streamURL(streamID string) *url.URL {
+	uri, _ := url.Parse(fmt.Sprintf("%s/live/%s/%s/%s.ts", strings.TrimSuffix(x.source.URL, "/"),
+		url.PathEscape(x.source.Username), url.PathEscape(x.source.Password), streamID))
+	return uri
+}
+
+// load fetches the account, categories and live streams and passes a Track for
+// each stream to the handler, so the source's filters apply as they would to
+// an M3U playlist.
+func (x *xtreamSource) load(handler m3uHandler) error {
+	account := &xtreamAccount{}
+	if err := x.call("", nil, account); err != nil {
+		return err
+	}
+	if account.UserInfo.Status != "" && account.UserInfo.Status != "Active" {
+		return fmt.Errorf("xtream account status is %q", account.UserInfo.Status)
+	}
+
+	logger := log.WithField("source", x.source.Name)
+	logger.WithFields(log.Fields{
+		"status":         account.UserInfo.Status,
+		"expires":        xtreamTime(account.UserInfo.ExpDate),
+		"maxConnections": account.UserInfo.MaxConnections,
+	}).Info("loaded xtream account")
+
+	var categories []xtreamCategory
+	if err := x.call("get_live_categories", nil, &categories); err != nil {
+		return err
+	}
+	groups := make(map[xtreamValue]string, len(categories))
+	for _, category := range categories {
+		groups[category.CategoryID] = category.CategoryName
+	}
+
+	var streams []xtreamStream
+	if err := x.call("get_live_streams", nil, &streams); err != nil {
+		return err
+	}
+
+	streamIDs := make(map[string]string)
+	handler.OnPlaylistStart()
+	for i := range streams {
+		track := x.newTrack(&streams[i], groups[streams[i].CategoryID], i+1)
+		if id := track.Tags["tvg-id"]; id != "" {
+			streamIDs[id] = string(streams[i].StreamID)
+		}
+		handler.OnTrack(track)
+	}
+	handler.OnPlaylistEnd()
+
+	x.lock.Lock()
+	x.account = account
+	x.streamIDs = streamIDs
+	x.lock.Unlock()
+
+	return nil
+}
+
+func (x *xtreamSource) newTrack(stream *xtreamStream, group string, lineNumber int) *Track {
+	tags := []string{
+		"tvg-id", string(stream.EPGChannelID),
+		"tvg-name", stream.Name,
+		"tvg-logo", stream.StreamIcon,
+		"group-title", group,
+	}
+	if stream.TVArchive.Int() > 0 {
+		tags = append(tags, "catchup", "xc", "catchup-days", string(stream.TVArchiveDuration))
+	}
+
+	var raw strings.Builder
+	raw.WriteString("#EXTINF:-1")
+	tagMap := make(map[string]string, len(tags)/2)
+	for i := 0; i < len(tags); i += 2 {
+		val := strings.ReplaceAll(tags[i+1], `"`, "'")
+		fmt.Fprintf(&raw, ` %s="%s"`, tags[i], val)
+		tagMap[tags[i]] = val
+	}
+	raw.WriteString(",")
+	raw.WriteString(stream.Name)
+
+	return &Track{
+		Name:       stream.Name,
+		Length:     0,
+		URI:        x.streamURL(string(stream.StreamID)),
+		Tags:       tagMap,
+		Raw:        raw.String(),
+		LineNumber: lineNumber,
+	}
+}
+
+// loadShortEPG builds a guide from the player API's short EPG for each of the
+// given tracks that came from this source.
+func (x *xtreamSource) loadShortEPG(tracks []Track) *xmltv.TV {
+	x.lock.Lock()
+	streamIDs := x.streamIDs
+	x.lock.Unlock()
+
+	start := time.Now()
+	tv := &xmltv.TV{GeneratorInfoName: "proxytv-xtream"}
+	var lock sync.Mutex
+
+	var g errgroup.Group
+	g.SetLimit(xtreamShortEPGConcurrency)
+
+	for i := range tracks {
+		track := &tracks[i]
+		id := track.Tags["tvg-id"]
+		streamID, ok := streamIDs[id]
+		if track.Source != x.source || !ok {
+			continue
+		}
+
+		channel := xmltv.Channel{
+			ID:           id,
+			DisplayNames: []xmltv.CommonElement{{Value: track.Name}},
+		}
+		if logo := track.Tags["tvg-logo"]; logo != "" {
+			channel.Icons = []xmltv.Icon{{Source: logo}}
+		}
+		tv.Channels = append(tv.Channels, channel)
+
+		g.Go(func() error {
+			programmes, err := x.shortEPG(id, streamID)
+			if err != nil {
+				log.WithError(err).WithFields(log.Fields{
+					"source":   x.source.Name,
+					"streamId": streamID,
+				}).Warn("unable to load xtream short epg")
+				return nil
+			}
+			lock.Lock()
+			tv.Programmes = append(tv.Programmes, programmes...)
+			lock.Unlock()
+			return nil
+		})
+	}
+	g.Wait()
+
+	log.WithFields(log.Fields{
+		"source":         x.source.Name,
+		"channelCount":   len(tv.Channels),
+		"programmeCount": len(tv.Programmes),
+		"duration":       time.Since(start),
+	}).Info("loaded xtream short epg")
+
+	return tv
+}
+
+func (x *xtreamSource) shortEPG(channelID string, streamID string) ([]xmltv.Programme, error) {
+	var resp struct {
+		Listings []xtreamListing `json:"epg_listings"`
+	}
+	if err := x.call("get_short_epg", url.Values{"stream_id": {streamID}}, &resp); err != nil {
+		return nil, err
+	}
+
+	programmes := make([]xmltv.Programme, 0, len(resp.Listings))
+	for _, listing := range resp.Listings {
+		programme := xmltv.Programme{
+			Channel: channelID,
+			Titles:  []xmltv.CommonElement{{Lang: listing.Lang, Value: decodeXtreamText(listing.Title)}},
+			Start:   &xmltv.Time{Time: xtreamTime(listing.StartTimestamp)},
+			Stop:    &xmltv.Time{Time: xtreamTime(listing.StopTimestamp)},
+		}
+		if desc := decodeXtreamText(listing.Description); desc != "" {
+			programme.Descriptions = []xmltv.CommonElement{{Lang: listing.Lang, Value: desc}}
+		}
+		programmes = append(programmes, programme)
+	}
+	return programmes, nil
+}
+
+// GetAccount returns the account details reported by the player API, or nil
+// before the first successful load.
+func (x *xtreamSource) GetAccount() *xtreamAccount {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+	return x.account
+}
+
+func xtreamTime(v xtreamValue) time.Time {
+	ts, err := strconv.ParseInt(string(v), 10, 64)
+	if err != nil || ts == 0 {
+		return time.Time{}
+	}
+	return time.Unix(ts, 0).UTC()
+}
+
+// decodeXtreamText decodes the base64 encoded titles and descriptions used by
+// the short EPG, falling back to the raw value for panels that send plain text.
+// Short words such as "News" are valid base64 too, so a value is only decoded
+// when the result is printable text.
+func decodeXtreamText(s string) string {
+	decoded, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || !isPrintableText(decoded) {
+		return s
+	}
+	return string(decoded)
+}
+
+func isPrintableText(b []byte) bool {
+	if !utf8.Valid(b) {
+		return false
+	}
+	for _, r := range string(b) {
+		if !unicode.IsPrint(r) && !unicode.IsSpace(r) {
+			return false
+		}
+	}
+	return true
+}
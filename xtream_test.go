@@ -0,0 +1,160 @@
+package proxytv
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newFakeXtreamServer(t *testing.T) *httptest.Server {
+	responses := map[string]any{
+		"": map[string]any{
+			"user_info": map[string]any{
+				"username":        "user",
+				"status":          "Active",
+				"exp_date":        "1893456000",
+				"max_connections": "2",
+			},
+			"server_info": map[string]any{"timezone": "UTC"},
+		},
+		"get_live_categories": []map[string]any{
+			{"category_id": "1", "category_name": "News"},
+			{"category_id": 2, "category_name": "Sports"},
+		},
+		"get_live_streams": []map[string]any{
+			{"num": 1, "name": "News One", "stream_id": 101, "stream_icon": "http://logo/1.png", "epg_channel_id": "news1", "category_id": "1"},
+			{"num": 2, "name": "Sports One", "stream_id": "102", "epg_channel_id": "sports1", "category_id": "2", "tv_archive": 1, "tv_archive_duration": "7"},
+			{"num": 3, "name": "Sports Two", "stream_id": 103, "epg_channel_id": nil, "category_id": "2"},
+		},
+	}
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if r.URL.Path != "/player_api.php" || query.Get("username") != "user" || query.Get("password") != "pass" {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+
+		action := query.Get("action")
+		if action == "get_short_epg" {
+			if query.Get("stream_id") != "101" {
+				json.NewEncoder(w).Encode(map[string]any{"epg_listings": []any{}})
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]any{
+				"epg_listings": []map[string]any{
+					{
+						"title":           base64.StdEncoding.EncodeToString([]byte("Morning News")),
+						"description":     base64.StdEncoding.EncodeToString([]byte("Headlines")),
+						"start_timestamp": "1704103200",
+						"stop_timestamp":  "1704106800",
+					},
+				},
+			})
+			return
+		}
+
+		resp, ok := responses[action]
+		if !ok {
+			http.Error(w, "unknown action", http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+}
+
+func TestXtreamSource(t *testing.T) {
+	server := newFakeXtreamServer(t)
+	defer server.Close()
+
+	config := &Config{
+		Sources: []*Source{
+			{
+				Name:     "xtream",
+				Type:     sourceTypeXtream,
+				URL:      server.URL,
+				Username: "user",
+				Password: "pass",
+				ShortEPG: true,
+				Filters: []*Filter{
+					{Type: "group", Value: "News"},
+					{Type: "name", Value: "Sports One"},
+				},
+			},
+		},
+	}
+	require.NoError(t, config.compileFilterRegexps())
+
+	provider, err := NewProvider(config)
+	require.NoError(t, err)
+	require.NoError(t, provider.Refresh())
+
+	assert.Equal(t, `#EXTM3U
+#EXTINF:-1 tvg-id="news1" tvg-name="News One" tvg-logo="http://logo/1.png" group-title="News",News One
+`+server.URL+`/live/user/pass/101.ts
+#EXTINF:-1 tvg-id="sports1" tvg-name="Sports One" tvg-logo="" group-title="Sports" catchup="xc" catchup-days="7",Sports One
+`+server.URL+`/live/user/pass/102.ts
+`, provider.GetM3u())
+
+	track := provider.GetTrack("1")
+	assert.Equal(t, "xtream", track.Source.Name)
+	assert.Equal(t, "7", track.Tags["catchup-days"])
+
+	epg := provider.snapshot().epg
+	require.Len(t, epg.Channels, 2)
+	assert.Equal(t, "news1", epg.Channels[0].ID)
+	require.Len(t, epg.Programmes, 1)
+	assert.Equal(t, "news1", epg.Programmes[0].Channel)
+	assert.Equal(t, "Morning News", epg.Programmes[0].Titles[0].Value)
+	assert.Equal(t, "Headlines", epg.Programmes[0].Descriptions[0].Value)
+	assert.Equal(t, int64(1704103200), epg.Programmes[0].Start.Unix())
+
+	account := provider.GetAccounts()["xtream"]
+	require.NotNil(t, account)
+	assert.Equal(t, "Active", account.UserInfo.Status)
+	assert.Equal(t, 2, account.UserInfo.MaxConnections.Int())
+}
+
+func TestXtreamSourceUnauthorized(t *testing.T) {
+	server := newFakeXtreamServer(t)
+	defer server.Close()
+
+	config := &Config{
+		Sources: []*Source{
+			{Name: "xtream", Type: sourceTypeXtream, URL: server.URL, Username: "user", Password: "wrong"},
+		},
+	}
+
+	provider, err := NewProvider(config)
+	require.NoError(t, err)
+	assert.Error(t, provider.Refresh())
+}
+
+func TestDecodeXtreamText(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected string
+	}{
+		{base64.StdEncoding.EncodeToString([]byte("Morning News")), "Morning News"},
+		{base64.StdEncoding.EncodeToString([]byte("Café\nLive")), "Café\nLive"},
+		{"Morning News", "Morning News"},
+		// Plain words that are valid base64 but don't decode to text
+		{"News", "News"},
+		{"Live", "Live"},
+		{"Golf", "Golf"},
+		{"Cars", "Cars"},
+		{"Film", "Film"},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			assert.Equal(t, tt.expected, decodeXtreamText(tt.value))
+		})
+	}
+}